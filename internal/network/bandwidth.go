@@ -0,0 +1,273 @@
+// +build linux
+
+package network
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// minBandwidth is the lowest rate in bits per second that can be shaped.
+	// This matches the minimum accepted by Kubernetes for the bandwidth
+	// annotations.
+	minBandwidth = 1000
+	// minBurst is the smallest burst in bits used when none is requested. A
+	// token bucket smaller than a few full sized frames stalls the interface.
+	minBurst = 64 * 1024 * 8
+	// tbfLatencyMs is the maximum time a packet may wait in a token bucket
+	// before being dropped.
+	tbfLatencyMs = 25
+)
+
+// BandwidthLimits are the traffic shaping limits of a network interface. Rates
+// are in bits per second and bursts in bits. A rate of `0` means unlimited and
+// a burst of `0` selects a default based on the rate.
+//
+// Ingress is the traffic received by the interface and egress the traffic sent
+// by it.
+type BandwidthLimits struct {
+	IngressRate  uint64
+	IngressBurst uint64
+	EgressRate   uint64
+	EgressBurst  uint64
+}
+
+// Validate returns an error if `bl` contains a rate that cannot be shaped.
+func (bl BandwidthLimits) Validate() error {
+	if bl.IngressRate != 0 && bl.IngressRate < minBandwidth {
+		return errors.Errorf("ingress bandwidth %d is below the minimum of %d bits per second", bl.IngressRate, minBandwidth)
+	}
+	if bl.EgressRate != 0 && bl.EgressRate < minBandwidth {
+		return errors.Errorf("egress bandwidth %d is below the minimum of %d bits per second", bl.EgressRate, minBandwidth)
+	}
+	if _, err := newTbf(0, bl.IngressRate, bl.IngressBurst); bl.IngressRate != 0 && err != nil {
+		return errors.Wrap(err, "invalid ingress burst")
+	}
+	if _, err := newTbf(0, bl.EgressRate, bl.EgressBurst); bl.EgressRate != 0 && err != nil {
+		return errors.Wrap(err, "invalid egress burst")
+	}
+	return nil
+}
+
+// quantitySuffixes maps the suffixes of a Kubernetes resource quantity to
+// their multiplier.
+var quantitySuffixes = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"E":  1e18,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+	"Ei": 1 << 60,
+}
+
+// ParseBandwidthQuantity parses a Kubernetes resource quantity such as the
+// value of the `kubernetes.io/ingress-bandwidth` annotation (for example `10M`
+// or `1Gi`) into bits per second.
+func ParseBandwidthQuantity(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+	mult, ok := quantitySuffixes[s[i:]]
+	if !ok {
+		return 0, errors.Errorf("invalid bandwidth quantity '%s': unknown suffix '%s'", s, s[i:])
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid bandwidth quantity '%s'", s)
+	}
+	bits := v * mult
+	if bits >= math.MaxUint64 {
+		return 0, errors.Errorf("invalid bandwidth quantity '%s': out of range", s)
+	}
+	return uint64(math.Round(bits)), nil
+}
+
+// newTbf returns a token bucket filter qdisc limiting the root of the link at
+// `linkIndex` to `rate` bits per second with a bucket of `burst` bits.
+func newTbf(linkIndex int, rate, burst uint64) (*netlink.Tbf, error) {
+	if burst == 0 {
+		// Allow up to 100ms worth of traffic at line rate.
+		burst = rate / 10
+		if burst < minBurst {
+			burst = minBurst
+		}
+	}
+	rateBytes := float64(rate / 8)
+	burstBytes := float64(burst / 8)
+	buffer := burstBytes * netlink.TIME_UNITS_PER_SEC / rateBytes * netlink.TickInUsec()
+	if buffer > math.MaxUint32 {
+		return nil, errors.Errorf("burst of %d bits is too large for a rate of %d bits per second", burst, rate)
+	}
+	limit := rateBytes*tbfLatencyMs/1000 + burstBytes
+	if limit > math.MaxUint32 {
+		return nil, errors.Errorf("burst of %d bits is too large", burst)
+	}
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rate / 8,
+		Buffer: uint32(buffer),
+		Limit:  uint32(limit),
+	}, nil
+}
+
+// ifbName returns the name of the intermediate functional block device used to
+// shape the ingress traffic of `ifStr`.
+func ifbName(ifStr string) string {
+	name := "ifb" + ifStr
+	if len(name) > unix.IFNAMSIZ-1 {
+		name = name[:unix.IFNAMSIZ-1]
+	}
+	return name
+}
+
+// delRootTbf removes the token bucket filter from the root of `link` if one
+// is present.
+func delRootTbf(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return errors.Wrapf(err, "netlink.QdiscList(%#v) failed", link)
+	}
+	for _, q := range qdiscs {
+		if q.Type() == "tbf" && q.Attrs().Parent == netlink.HANDLE_ROOT {
+			if err := netlink.QdiscDel(q); err != nil {
+				return errors.Wrapf(err, "netlink.QdiscDel(%#v) failed", q)
+			}
+		}
+	}
+	return nil
+}
+
+// NetNSConfigBandwidth replaces the traffic shaping of the network interface
+// `ifStr` with `limits`. Egress traffic is shaped by a token bucket filter at
+// the root of `ifStr`. Ingress traffic is redirected to an ifb device in the
+// same namespace whose root is shaped the same way. Passing zero rates removes
+// all shaping.
+//
+// This function MUST be used in tandem with `DoInNetNS` or some other means that ensures that the goroutine
+// executing this code stays on the same thread.
+func NetNSConfigBandwidth(ctx context.Context, ifStr string, limits BandwidthLimits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	log.G(ctx).Debugf("Configure bandwidth of %s with: %+v", ifStr, limits)
+
+	link, err := netlink.LinkByName(ifStr)
+	if err != nil {
+		return errors.Wrapf(err, "netlink.LinkByName(%s) failed", ifStr)
+	}
+
+	// Egress
+	if limits.EgressRate != 0 {
+		tbf, err := newTbf(link.Attrs().Index, limits.EgressRate, limits.EgressBurst)
+		if err != nil {
+			return err
+		}
+		if err := netlink.QdiscReplace(tbf); err != nil {
+			return errors.Wrapf(err, "netlink.QdiscReplace(%#v) failed", tbf)
+		}
+	} else if err := delRootTbf(link); err != nil {
+		return err
+	}
+
+	// Ingress
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	ifbStr := ifbName(ifStr)
+	if limits.IngressRate == 0 {
+		if err := netlink.QdiscDel(ingress); err != nil && err != unix.ENOENT && err != unix.EINVAL {
+			return errors.Wrapf(err, "netlink.QdiscDel(%#v) failed", ingress)
+		}
+		if ifb, err := netlink.LinkByName(ifbStr); err == nil {
+			if err := netlink.LinkDel(ifb); err != nil {
+				return errors.Wrapf(err, "netlink.LinkDel(%#v) failed", ifb)
+			}
+		}
+		return nil
+	}
+
+	ifb, err := netlink.LinkByName(ifbStr)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return errors.Wrapf(err, "netlink.LinkByName(%s) failed", ifbStr)
+		}
+		ifb = &netlink.Ifb{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:   ifbStr,
+				MTU:    link.Attrs().MTU,
+				TxQLen: 1000,
+			},
+		}
+		if err := netlink.LinkAdd(ifb); err != nil {
+			return errors.Wrapf(err, "netlink.LinkAdd(%#v) failed", ifb)
+		}
+		if ifb, err = netlink.LinkByName(ifbStr); err != nil {
+			return errors.Wrapf(err, "netlink.LinkByName(%s) failed", ifbStr)
+		}
+	}
+	if err := netlink.LinkSetUp(ifb); err != nil {
+		return errors.Wrapf(err, "netlink.LinkSetUp(%#v) failed", ifb)
+	}
+	tbf, err := newTbf(ifb.Attrs().Index, limits.IngressRate, limits.IngressBurst)
+	if err != nil {
+		return err
+	}
+	if err := netlink.QdiscReplace(tbf); err != nil {
+		return errors.Wrapf(err, "netlink.QdiscReplace(%#v) failed", tbf)
+	}
+	// The ingress qdisc has no parameters and does not support being replaced
+	// so an existing one is kept.
+	if err := netlink.QdiscAdd(ingress); err != nil && err != unix.EEXIST {
+		return errors.Wrapf(err, "netlink.QdiscAdd(%#v) failed", ingress)
+	}
+	// Redirect everything received on the interface to the egress of the ifb
+	// device where it is shaped. The filter only references the ifb device so
+	// an existing one is kept when the limits are updated.
+	filters, err := netlink.FilterList(link, ingress.Handle)
+	if err != nil {
+		return errors.Wrapf(err, "netlink.FilterList(%#v) failed", link)
+	}
+	if len(filters) == 0 {
+		filter := &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    ingress.Handle,
+				Priority:  1,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Actions: []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+		}
+		if err := netlink.FilterAdd(filter); err != nil {
+			return errors.Wrapf(err, "netlink.FilterAdd(%#v) failed", filter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,456 @@
+// +build linux
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// firewallTable is the name of the nftables table holding the network
+	// policy of a network namespace.
+	firewallTable = "opengcs"
+	// firewallIngressChain and firewallEgressChain are the base chains of
+	// `firewallTable` hooked on local input and local output.
+	firewallIngressChain = "ingress"
+	firewallEgressChain  = "egress"
+
+	// nfDrop and nfAccept are the netfilter verdicts.
+	nfDrop   = 0
+	nfAccept = 1
+	// ctStateEstablishedRelated are the conntrack state bits of established
+	// and related connections.
+	ctStateEstablishedRelated = 1<<1 | 1<<2
+	// icmpv6RouterSolicitation to icmpv6Redirect are the ICMPv6 types of the
+	// neighbor discovery protocol, without which IPv6 does not work.
+	icmpv6RouterSolicitation = 133
+	icmpv6Redirect           = 137
+)
+
+// nftMsg is a single nftables message of a batch.
+type nftMsg struct {
+	msgType uint16
+	flags   uint16
+	attrs   []*nl.RtAttr
+}
+
+func nftBE16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func nftBE32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func nftString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func nftNested(attrType int, children ...*nl.RtAttr) *nl.RtAttr {
+	a := nl.NewRtAttr(attrType|unix.NLA_F_NESTED, nil)
+	for _, c := range children {
+		a.AddChild(c)
+	}
+	return a
+}
+
+func nftExpr(name string, data ...*nl.RtAttr) *nl.RtAttr {
+	return nftNested(unix.NFTA_LIST_ELEM,
+		nl.NewRtAttr(unix.NFTA_EXPR_NAME, nftString(name)),
+		nftNested(unix.NFTA_EXPR_DATA, data...))
+}
+
+// nftMeta loads the meta `key` of the packet into register 1.
+func nftMeta(key uint32) *nl.RtAttr {
+	return nftExpr("meta",
+		nl.NewRtAttr(unix.NFTA_META_DREG, nftBE32(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_META_KEY, nftBE32(key)))
+}
+
+// nftPayload loads `length` bytes at `offset` of the packet header `base` into
+// register 1.
+func nftPayload(base, offset, length uint32) *nl.RtAttr {
+	return nftExpr("payload",
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_DREG, nftBE32(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_BASE, nftBE32(base)),
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_OFFSET, nftBE32(offset)),
+		nl.NewRtAttr(unix.NFTA_PAYLOAD_LEN, nftBE32(length)))
+}
+
+// nftCt loads the conntrack `key` of the packet into register 1.
+func nftCt(key uint32) *nl.RtAttr {
+	return nftExpr("ct",
+		nl.NewRtAttr(unix.NFTA_CT_DREG, nftBE32(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_CT_KEY, nftBE32(key)))
+}
+
+// nftBitwise masks register 1 with `mask`.
+func nftBitwise(mask []byte) *nl.RtAttr {
+	return nftExpr("bitwise",
+		nl.NewRtAttr(unix.NFTA_BITWISE_SREG, nftBE32(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_BITWISE_DREG, nftBE32(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_BITWISE_LEN, nftBE32(uint32(len(mask)))),
+		nftNested(unix.NFTA_BITWISE_MASK, nl.NewRtAttr(unix.NFTA_DATA_VALUE, mask)),
+		nftNested(unix.NFTA_BITWISE_XOR, nl.NewRtAttr(unix.NFTA_DATA_VALUE, make([]byte, len(mask)))))
+}
+
+// nftCmp ends the rule unless register 1 compares to `data` with `op`.
+func nftCmp(op uint32, data []byte) *nl.RtAttr {
+	return nftExpr("cmp",
+		nl.NewRtAttr(unix.NFTA_CMP_SREG, nftBE32(unix.NFT_REG_1)),
+		nl.NewRtAttr(unix.NFTA_CMP_OP, nftBE32(op)),
+		nftNested(unix.NFTA_CMP_DATA, nl.NewRtAttr(unix.NFTA_DATA_VALUE, data)))
+}
+
+// nftVerdict sets the verdict of the packet to `code`.
+func nftVerdict(code uint32) *nl.RtAttr {
+	return nftExpr("immediate",
+		nl.NewRtAttr(unix.NFTA_IMMEDIATE_DREG, nftBE32(unix.NFT_REG_VERDICT)),
+		nftNested(unix.NFTA_IMMEDIATE_DATA,
+			nftNested(unix.NFTA_DATA_VERDICT,
+				nl.NewRtAttr(unix.NFTA_VERDICT_CODE, nftBE32(code)))))
+}
+
+func nftTableMsg(msgType uint16, flags uint16) nftMsg {
+	return nftMsg{
+		msgType: msgType,
+		flags:   flags,
+		attrs:   []*nl.RtAttr{nl.NewRtAttr(unix.NFTA_TABLE_NAME, nftString(firewallTable))},
+	}
+}
+
+func nftChainMsg(name string, hook uint32, policy uint32) nftMsg {
+	return nftMsg{
+		msgType: unix.NFT_MSG_NEWCHAIN,
+		flags:   unix.NLM_F_CREATE,
+		attrs: []*nl.RtAttr{
+			nl.NewRtAttr(unix.NFTA_CHAIN_TABLE, nftString(firewallTable)),
+			nl.NewRtAttr(unix.NFTA_CHAIN_NAME, nftString(name)),
+			nftNested(unix.NFTA_CHAIN_HOOK,
+				nl.NewRtAttr(unix.NFTA_HOOK_HOOKNUM, nftBE32(hook)),
+				nl.NewRtAttr(unix.NFTA_HOOK_PRIORITY, nftBE32(0))),
+			nl.NewRtAttr(unix.NFTA_CHAIN_POLICY, nftBE32(policy)),
+			nl.NewRtAttr(unix.NFTA_CHAIN_TYPE, nftString("filter")),
+		},
+	}
+}
+
+func nftRuleMsg(chain string, exprs ...*nl.RtAttr) nftMsg {
+	return nftMsg{
+		msgType: unix.NFT_MSG_NEWRULE,
+		flags:   unix.NLM_F_CREATE | unix.NLM_F_APPEND,
+		attrs: []*nl.RtAttr{
+			nl.NewRtAttr(unix.NFTA_RULE_TABLE, nftString(firewallTable)),
+			nl.NewRtAttr(unix.NFTA_RULE_CHAIN, nftString(chain)),
+			nftNested(unix.NFTA_RULE_EXPRESSIONS, exprs...),
+		},
+	}
+}
+
+// nftRemoveTableMsgs returns the messages that remove `firewallTable` whether
+// or not it exists. Adding an existing table is a no-op so the delete always
+// finds it.
+func nftRemoveTableMsgs() []nftMsg {
+	return []nftMsg{
+		nftTableMsg(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE),
+		nftTableMsg(unix.NFT_MSG_DELTABLE, 0),
+	}
+}
+
+func firewallVerdict(action prot.NetworkPolicyAction) (uint32, error) {
+	switch action {
+	case "", prot.NpaAllow:
+		return nfAccept, nil
+	case prot.NpaDeny:
+		return nfDrop, nil
+	default:
+		return 0, errors.Errorf("invalid network policy action '%s'", action)
+	}
+}
+
+// firewallRuleMsgs compiles `rule` into one nftables rule for each combination
+// of its addresses, protocols and ports.
+func firewallRuleMsgs(rule *prot.NetworkPolicyRuleV2) ([]nftMsg, error) {
+	if rule.Action == "" {
+		return nil, errors.New("network policy rule action must be specified")
+	}
+	verdict, err := firewallVerdict(rule.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain string
+	// Offsets of the remote address in the IPv4 and IPv6 headers.
+	var offset4, offset6 uint32
+	switch rule.Direction {
+	case prot.NpdIngress:
+		chain, offset4, offset6 = firewallIngressChain, 12, 8
+	case prot.NpdEgress:
+		chain, offset4, offset6 = firewallEgressChain, 16, 24
+	default:
+		return nil, errors.Errorf("invalid network policy direction '%s'", rule.Direction)
+	}
+
+	nets := []*net.IPNet{nil}
+	if len(rule.Addresses) > 0 {
+		nets = nets[:0]
+		for _, a := range rule.Addresses {
+			_, ipNet, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid network policy address '%s'", a)
+			}
+			nets = append(nets, ipNet)
+		}
+	}
+
+	var protos []byte
+	switch strings.ToUpper(rule.Protocol) {
+	case "TCP":
+		protos = []byte{unix.IPPROTO_TCP}
+	case "UDP":
+		protos = []byte{unix.IPPROTO_UDP}
+	case "":
+		if len(rule.Ports) > 0 {
+			protos = []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP}
+		} else {
+			protos = []byte{0}
+		}
+	default:
+		return nil, errors.Errorf("invalid network policy protocol '%s'", rule.Protocol)
+	}
+
+	for _, port := range rule.Ports {
+		if port == 0 {
+			return nil, errors.New("invalid network policy port 0")
+		}
+	}
+	ports := rule.Ports
+	if len(ports) == 0 {
+		ports = []uint16{0}
+	}
+
+	var msgs []nftMsg
+	for _, ipNet := range nets {
+		for _, proto := range protos {
+			for _, port := range ports {
+				var exprs []*nl.RtAttr
+				if ipNet != nil {
+					family, offset, ip := byte(unix.NFPROTO_IPV4), offset4, ipNet.IP.To4()
+					if ip == nil {
+						family, offset, ip = unix.NFPROTO_IPV6, offset6, ipNet.IP.To16()
+					}
+					mask := []byte(ipNet.Mask)
+					exprs = append(exprs,
+						nftMeta(unix.NFT_META_NFPROTO),
+						nftCmp(unix.NFT_CMP_EQ, []byte{family}),
+						nftPayload(unix.NFT_PAYLOAD_NETWORK_HEADER, offset, uint32(len(ip))),
+						nftBitwise(mask),
+						nftCmp(unix.NFT_CMP_EQ, ip))
+				}
+				if proto != 0 {
+					exprs = append(exprs,
+						nftMeta(unix.NFT_META_L4PROTO),
+						nftCmp(unix.NFT_CMP_EQ, []byte{proto}))
+				}
+				if port != 0 {
+					exprs = append(exprs,
+						nftPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 2, 2),
+						nftCmp(unix.NFT_CMP_EQ, nftBE16(port)))
+				}
+				exprs = append(exprs, nftVerdict(verdict))
+				msgs = append(msgs, nftRuleMsg(chain, exprs...))
+			}
+		}
+	}
+	return msgs, nil
+}
+
+// firewallPolicyMsgs compiles `policy` into a batch that atomically replaces
+// `firewallTable`.
+func firewallPolicyMsgs(policy *prot.NetworkPolicyV2) ([]nftMsg, error) {
+	ingressPolicy, err := firewallVerdict(policy.DefaultIngressAction)
+	if err != nil {
+		return nil, err
+	}
+	egressPolicy, err := firewallVerdict(policy.DefaultEgressAction)
+	if err != nil {
+		return nil, err
+	}
+
+	loName := make([]byte, unix.IFNAMSIZ)
+	copy(loName, "lo")
+
+	msgs := nftRemoveTableMsgs()
+	msgs = append(msgs,
+		nftTableMsg(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE),
+		nftChainMsg(firewallIngressChain, unix.NF_INET_LOCAL_IN, ingressPolicy),
+		nftChainMsg(firewallEgressChain, unix.NF_INET_LOCAL_OUT, egressPolicy))
+	for _, chain := range []struct {
+		name   string
+		ifname uint32
+	}{
+		{firewallIngressChain, unix.NFT_META_IIFNAME},
+		{firewallEgressChain, unix.NFT_META_OIFNAME},
+	} {
+		mask := make([]byte, 4)
+		nl.NativeEndian().PutUint32(mask, ctStateEstablishedRelated)
+		msgs = append(msgs,
+			nftRuleMsg(chain.name,
+				nftMeta(chain.ifname),
+				nftCmp(unix.NFT_CMP_EQ, loName),
+				nftVerdict(nfAccept)),
+			nftRuleMsg(chain.name,
+				nftCt(unix.NFT_CT_STATE),
+				nftBitwise(mask),
+				nftCmp(unix.NFT_CMP_NEQ, make([]byte, 4)),
+				nftVerdict(nfAccept)),
+			nftRuleMsg(chain.name,
+				nftMeta(unix.NFT_META_NFPROTO),
+				nftCmp(unix.NFT_CMP_EQ, []byte{unix.NFPROTO_IPV6}),
+				nftMeta(unix.NFT_META_L4PROTO),
+				nftCmp(unix.NFT_CMP_EQ, []byte{unix.IPPROTO_ICMPV6}),
+				nftPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 0, 1),
+				nftCmp(unix.NFT_CMP_GTE, []byte{icmpv6RouterSolicitation}),
+				nftCmp(unix.NFT_CMP_LTE, []byte{icmpv6Redirect}),
+				nftVerdict(nfAccept)))
+	}
+	for i := range policy.Rules {
+		ruleMsgs, err := firewallRuleMsgs(&policy.Rules[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network policy rule %d", i)
+		}
+		msgs = append(msgs, ruleMsgs...)
+	}
+	return msgs, nil
+}
+
+// serializeNftBatch serializes `msgs` into a single nfnetlink batch starting
+// at sequence number `seq`. All messages but the batch delimiters request an
+// acknowledgement.
+func serializeNftBatch(msgs []nftMsg, seq uint32) []byte {
+	native := nl.NativeEndian()
+	var buf []byte
+	appendMsg := func(msgType, flags uint16, family uint8, resID uint16, attrs []*nl.RtAttr) {
+		var payload []byte
+		for _, a := range attrs {
+			payload = append(payload, a.Serialize()...)
+		}
+		hdr := make([]byte, unix.SizeofNlMsghdr+4)
+		native.PutUint32(hdr[0:4], uint32(len(hdr)+len(payload)))
+		native.PutUint16(hdr[4:6], msgType)
+		native.PutUint16(hdr[6:8], unix.NLM_F_REQUEST|flags)
+		native.PutUint32(hdr[8:12], seq)
+		hdr[16] = family
+		hdr[17] = unix.NFNETLINK_V0
+		binary.BigEndian.PutUint16(hdr[18:20], resID)
+		buf = append(buf, hdr...)
+		buf = append(buf, payload...)
+		seq++
+	}
+	appendMsg(unix.NFNL_MSG_BATCH_BEGIN, 0, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES, nil)
+	for _, m := range msgs {
+		appendMsg(unix.NFNL_SUBSYS_NFTABLES<<8|m.msgType, unix.NLM_F_ACK|m.flags, unix.NFPROTO_INET, 0, m.attrs)
+	}
+	appendMsg(unix.NFNL_MSG_BATCH_END, 0, unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES, nil)
+	return buf
+}
+
+// sendNftBatch commits `msgs` as a single nftables transaction in the current
+// network namespace. Either all messages are applied or none are.
+func sendNftBatch(msgs []nftMsg) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return errors.Wrap(err, "failed to create netfilter netlink socket")
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return errors.Wrap(err, "failed to bind netfilter netlink socket")
+	}
+
+	// The batch begin message takes the first sequence number.
+	const seq = 1
+	if err := unix.Sendto(fd, serializeNftBatch(msgs, seq), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return errors.Wrap(err, "failed to send nftables batch")
+	}
+
+	pending := len(msgs)
+	rb := make([]byte, unix.Getpagesize()*4)
+	for pending > 0 {
+		n, _, err := unix.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return errors.Wrap(err, "failed to receive nftables batch response")
+		}
+		resps, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return errors.Wrap(err, "failed to parse nftables batch response")
+		}
+		for _, r := range resps {
+			if r.Header.Type != unix.NLMSG_ERROR || len(r.Data) < 4 {
+				continue
+			}
+			if errno := int32(nl.NativeEndian().Uint32(r.Data[0:4])); errno != 0 {
+				i := int(r.Header.Seq) - seq - 1
+				if i >= 0 && i < len(msgs) {
+					return errors.Wrapf(unix.Errno(-errno), "nftables message %d of type %d failed", i, msgs[i].msgType)
+				}
+				return errors.Wrap(unix.Errno(-errno), "nftables batch failed")
+			}
+			pending--
+		}
+	}
+	return nil
+}
+
+// ValidateFirewallPolicy returns an error if `policy` cannot be compiled into
+// nftables rules.
+func ValidateFirewallPolicy(policy *prot.NetworkPolicyV2) error {
+	_, err := firewallPolicyMsgs(policy)
+	return err
+}
+
+// NetNSConfigFirewall atomically replaces the firewall of the current network
+// namespace with the nftables rules of `policy`.
+//
+// This function MUST be used in tandem with `DoInNetNS` or some other means that ensures that the goroutine
+// executing this code stays on the same thread.
+func NetNSConfigFirewall(ctx context.Context, policy *prot.NetworkPolicyV2) error {
+	msgs, err := firewallPolicyMsgs(policy)
+	if err != nil {
+		return err
+	}
+
+	log.G(ctx).Debugf("Configure firewall with %d nftables messages: %+v", len(msgs), policy)
+
+	if err := sendNftBatch(msgs); err != nil {
+		return errors.Wrap(err, "failed to configure firewall")
+	}
+	return nil
+}
+
+// NetNSRemoveFirewall removes the firewall installed by `NetNSConfigFirewall`
+// from the current network namespace. It is not an error if there is none.
+//
+// This function MUST be used in tandem with `DoInNetNS` or some other means that ensures that the goroutine
+// executing this code stays on the same thread.
+func NetNSRemoveFirewall(ctx context.Context) error {
+	log.G(ctx).Debug("Removing firewall")
+
+	if err := sendNftBatch(nftRemoveTableMsgs()); err != nil {
+		return errors.Wrap(err, "failed to remove firewall")
+	}
+	return nil
+}
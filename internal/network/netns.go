@@ -13,6 +13,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 // MoveInterfaceToNS moves the adapter with interface name `ifStr` to the network namespace
@@ -34,6 +35,111 @@ func MoveInterfaceToNS(ifStr string, pid int) error {
 	return nil
 }
 
+// MoveInterfaceToNSHandle moves the adapter with interface name `ifStr` to the
+// network namespace referenced by `ns`.
+func MoveInterfaceToNSHandle(ifStr string, ns netns.NsHandle) error {
+	link, err := netlink.LinkByName(ifStr)
+	if err != nil {
+		return errors.Wrapf(err, "netlink.LinkByName(%s) failed", ifStr)
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return errors.Wrapf(err, "netlink.LinkSetDown(%#v) failed", link)
+	}
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		return errors.Wrapf(err, "netlink.LinkSetNsFd(%#v, %v) failed", link, ns)
+	}
+	return nil
+}
+
+// WaitForInterface waits for the adapter with interface name `ifStr` to be
+// present in the current network namespace.
+//
+// Will retry the operation until `ctx` is exceeded or canceled.
+func WaitForInterface(ctx context.Context, ifStr string) error {
+	for {
+		if _, err := netlink.LinkByName(ifStr); err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				select {
+				case <-ctx.Done():
+					return errors.Wrapf(ctx.Err(), "timed out waiting for interface %s", ifStr)
+				default:
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+			}
+			return errors.Wrapf(err, "netlink.LinkByName(%s) failed", ifStr)
+		}
+		return nil
+	}
+}
+
+// Routing is the policy routing configuration of a network adapter. An adapter
+// with a low metric gets its own routing table `Table` holding its default
+// route, and a rule of priority `Priority` that looks up `Table` for traffic
+// sourced from its address. Each adapter in a namespace MUST use a distinct
+// table and priority.
+type Routing struct {
+	Table    int
+	Priority int
+	// Routes are static routes through the adapter.
+	Routes []prot.RouteV2
+}
+
+// ValidateRoutes returns an error if any of `routes` is invalid.
+func ValidateRoutes(routes []prot.RouteV2) error {
+	for _, r := range routes {
+		if _, _, err := net.ParseCIDR(r.DestinationPrefix); err != nil {
+			return errors.Wrapf(err, "invalid route destination '%s'", r.DestinationPrefix)
+		}
+		if r.NextHop != "" && net.ParseIP(r.NextHop) == nil {
+			return errors.Errorf("invalid route next hop '%s'", r.NextHop)
+		}
+	}
+	return nil
+}
+
+// sourceRule returns the rule routing traffic sourced from `ip` with `routing`.
+func sourceRule(ip string, routing *Routing) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Table = routing.Table
+	rule.Src = &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(32, 32)}
+	rule.Priority = routing.Priority
+	return rule
+}
+
+// addStaticRoutes adds `routing.Routes` through `link` to the main routing
+// table and, when `lowMetric` is set, to `routing.Table` as well so that
+// traffic sourced from the adapter uses them too.
+func addStaticRoutes(link netlink.Link, routing *Routing, lowMetric bool) error {
+	tables := []int{unix.RT_TABLE_MAIN}
+	if lowMetric {
+		tables = append(tables, routing.Table)
+	}
+	for _, r := range routing.Routes {
+		_, dst, err := net.ParseCIDR(r.DestinationPrefix)
+		if err != nil {
+			return errors.Wrapf(err, "invalid route destination '%s'", r.DestinationPrefix)
+		}
+		for _, table := range tables {
+			route := netlink.Route{
+				Scope:     netlink.SCOPE_LINK,
+				LinkIndex: link.Attrs().Index,
+				Dst:       dst,
+				Table:     table,
+				Priority:  int(r.Metric),
+			}
+			if r.NextHop != "" {
+				route.Scope = netlink.SCOPE_UNIVERSE
+				route.Gw = net.ParseIP(r.NextHop)
+			}
+			if err := netlink.RouteAdd(&route); err != nil {
+				return errors.Wrapf(err, "netlink.RouteAdd(%#v) failed", route)
+			}
+		}
+	}
+	return nil
+}
+
 // DoInNetNS is a utility to run a function `run` inside of a specific network namespace
 // `ns`. This is accomplished by locking the current goroutines thread to prevent the goroutine
 // from being scheduled to a new thread during execution of `run`. The threads original network namespace
@@ -58,13 +164,14 @@ func DoInNetNS(ns netns.NsHandle, run func() error) error {
 }
 
 // NetNSConfig moves a network interface into a network namespace and
-// configures it.
+// configures it. `routing` selects the routing table and rule priority used by
+// a low metric adapter and the static routes to add.
 //
 // This function MUST be used in tandem with `DoInNetNS` or some other means that ensures that the goroutine
 // executing this code stays on the same thread.
-func NetNSConfig(ctx context.Context, ifStr string, nsPid int, adapter *prot.NetworkAdapter) error {
-	if ifStr == "" || nsPid == -1 || adapter == nil {
-		return errors.New("All three arguments must be specified")
+func NetNSConfig(ctx context.Context, ifStr string, nsPid int, adapter *prot.NetworkAdapter, routing *Routing) error {
+	if ifStr == "" || nsPid == -1 || adapter == nil || routing == nil {
+		return errors.New("All four arguments must be specified")
 	}
 
 	if adapter.NatEnabled {
@@ -152,12 +259,7 @@ func NetNSConfig(ctx context.Context, ifStr string, nsPid int, adapter *prot.Net
 			} else {
 				// add a route rule for the new interface so packets coming on this interface
 				// always go out the same interface
-				srcNet := &net.IPNet{IP: net.ParseIP(adapter.AllocatedIPAddress), Mask: net.CIDRMask(32, 32)}
-				rule := netlink.NewRule()
-				rule.Table = 101
-				rule.Src = srcNet
-				rule.Priority = 5
-
+				rule := sourceRule(adapter.AllocatedIPAddress, routing)
 				if err := netlink.RuleAdd(rule); err != nil {
 					return errors.Wrapf(err, "netlink.RuleAdd(%#v) failed", rule)
 				}
@@ -215,6 +317,10 @@ func NetNSConfig(ctx context.Context, ifStr string, nsPid int, adapter *prot.Net
 		log.G(ctx).Debugf("udhcpc succeeded: %s", cos)
 	}
 
+	if err := addStaticRoutes(link, routing, adapter.NatEnabled && adapter.EnableLowMetric && adapter.HostIPAddress != ""); err != nil {
+		return err
+	}
+
 	// Add some debug logging
 	curNS, _ := netns.Get()
 	// Refresh link attributes/state
@@ -229,3 +335,57 @@ func NetNSConfig(ctx context.Context, ifStr string, nsPid int, adapter *prot.Net
 
 	return nil
 }
+
+// NetNSRemoveConfig removes the configuration applied by `NetNSConfig` to the
+// network interface `ifStr` and brings the interface down. It does not move the
+// interface out of the current network namespace.
+//
+// This function MUST be used in tandem with `DoInNetNS` or some other means that ensures that the goroutine
+// executing this code stays on the same thread.
+func NetNSRemoveConfig(ctx context.Context, ifStr string, adapter *prot.NetworkAdapter, routing *Routing) error {
+	if ifStr == "" || adapter == nil || routing == nil {
+		return errors.New("All arguments must be specified")
+	}
+
+	log.G(ctx).Debugf("Removing configuration of %s", ifStr)
+
+	link, err := netlink.LinkByName(ifStr)
+	if err != nil {
+		return errors.Wrapf(err, "netlink.LinkByName(%s) failed", ifStr)
+	}
+
+	// Bringing the interface down flushes all routes that go through it,
+	// including the default and static routes in the low metric table.
+	if err := netlink.LinkSetDown(link); err != nil {
+		return errors.Wrapf(err, "netlink.LinkSetDown(%#v) failed", link)
+	}
+
+	// The source rule for the low metric table is not tied to the link and
+	// must be removed explicitly.
+	if adapter.NatEnabled && adapter.EnableLowMetric && adapter.HostIPAddress != "" {
+		rule := sourceRule(adapter.AllocatedIPAddress, routing)
+		if err := netlink.RuleDel(rule); err != nil && err != unix.ENOENT {
+			return errors.Wrapf(err, "netlink.RuleDel(%#v) failed", rule)
+		}
+	}
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return errors.Wrapf(err, "netlink.AddrList(%#v) failed", link)
+	}
+	for _, addr := range addrs {
+		a := addr
+		if err := netlink.AddrDel(link, &a); err != nil && err != unix.EADDRNOTAVAIL {
+			return errors.Wrapf(err, "netlink.AddrDel(%#v, %#v) failed", link, a)
+		}
+	}
+
+	// Restore the MTU that was lowered for the encapsulation overhead.
+	if adapter.EncapOverhead != 0 {
+		mtu := link.Attrs().MTU + int(adapter.EncapOverhead)
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return errors.Wrapf(err, "netlink.LinkSetMTU(%#v, %d) failed", link, mtu)
+		}
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ package network
 import (
 	"context"
 	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
 )
 
 func Test_GenerateResolvConfContent(t *testing.T) {
@@ -165,3 +167,120 @@ ff02::2 ip6-allrouters
 		})
 	}
 }
+
+func Test_ParseBandwidthQuantity(t *testing.T) {
+	type testcase struct {
+		quantity  string
+		expected  uint64
+		expectErr bool
+	}
+	testcases := []testcase{
+		{quantity: "1000", expected: 1000},
+		{quantity: "10k", expected: 10000},
+		{quantity: "10M", expected: 10000000},
+		{quantity: "1.5G", expected: 1500000000},
+		{quantity: "1Ki", expected: 1024},
+		{quantity: "2Mi", expected: 2 * 1024 * 1024},
+		{quantity: "10m", expectErr: true},
+		{quantity: "M", expectErr: true},
+		{quantity: "", expectErr: true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.quantity, func(t *testing.T) {
+			v, err := ParseBandwidthQuantity(tc.quantity)
+			if tc.expectErr && err == nil {
+				t.Fatal("expected err got nil")
+			} else if !tc.expectErr && err != nil {
+				t.Fatalf("expected no error got %v:", err)
+			}
+			if v != tc.expected {
+				t.Fatalf("expected %d got %d", tc.expected, v)
+			}
+		})
+	}
+}
+
+func Test_ValidateFirewallPolicy(t *testing.T) {
+	type testcase struct {
+		name      string
+		policy    *prot.NetworkPolicyV2
+		expectErr bool
+	}
+	testcases := []*testcase{
+		{
+			name:   "Empty",
+			policy: &prot.NetworkPolicyV2{},
+		},
+		{
+			name: "Valid",
+			policy: &prot.NetworkPolicyV2{
+				DefaultIngressAction: prot.NpaDeny,
+				DefaultEgressAction:  prot.NpaAllow,
+				Rules: []prot.NetworkPolicyRuleV2{
+					{
+						Direction: prot.NpdIngress,
+						Action:    prot.NpaAllow,
+						Addresses: []string{"10.0.0.0/8", "fd00::/8"},
+						Protocol:  "tcp",
+						Ports:     []uint16{80, 443},
+					},
+					{
+						Direction: prot.NpdEgress,
+						Action:    prot.NpaDeny,
+						Ports:     []uint16{53},
+					},
+				},
+			},
+		},
+		{
+			name:      "InvalidDefaultAction",
+			policy:    &prot.NetworkPolicyV2{DefaultIngressAction: "Reject"},
+			expectErr: true,
+		},
+		{
+			name: "MissingAction",
+			policy: &prot.NetworkPolicyV2{
+				Rules: []prot.NetworkPolicyRuleV2{{Direction: prot.NpdIngress}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "InvalidDirection",
+			policy: &prot.NetworkPolicyV2{
+				Rules: []prot.NetworkPolicyRuleV2{{Direction: "Forward", Action: prot.NpaAllow}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "InvalidAddress",
+			policy: &prot.NetworkPolicyV2{
+				Rules: []prot.NetworkPolicyRuleV2{{Direction: prot.NpdEgress, Action: prot.NpaAllow, Addresses: []string{"10.0.0.1"}}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "InvalidProtocol",
+			policy: &prot.NetworkPolicyV2{
+				Rules: []prot.NetworkPolicyRuleV2{{Direction: prot.NpdEgress, Action: prot.NpaAllow, Protocol: "SCTP"}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "InvalidPort",
+			policy: &prot.NetworkPolicyV2{
+				Rules: []prot.NetworkPolicyRuleV2{{Direction: prot.NpdEgress, Action: prot.NpaAllow, Ports: []uint16{0}}},
+			},
+			expectErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateFirewallPolicy(tc.policy)
+			if tc.expectErr && err == nil {
+				t.Fatal("expected err got nil")
+			} else if !tc.expectErr && err != nil {
+				t.Fatalf("expected no error got %v:", err)
+			}
+		})
+	}
+}
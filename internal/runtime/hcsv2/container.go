@@ -27,6 +27,14 @@ type Container struct {
 
 	spec      *oci.Spec
 	isSandbox bool
+	// devices are the VMBus GUIDs of the devices assigned to the container in
+	// `spec.Windows.Devices`, which is cleared before the container is
+	// created.
+	devices []string
+	// netNS is the id of the network namespace owned by this container. It is
+	// only set for sandbox and standalone containers that were assigned a
+	// network namespace at create.
+	netNS string
 
 	container   runtime.Container
 	initProcess *containerProcess
@@ -36,6 +44,13 @@ type Container struct {
 
 	processesMutex sync.Mutex
 	processes      map[uint32]*containerProcess
+
+	// portForwardsMutex protects `portForwards` and `portForwardsClosed`.
+	portForwardsMutex  sync.Mutex
+	portForwards       map[*portForward]struct{}
+	portForwardsClosed bool
+	// portForwardsWg tracks the relay of every stream in `portForwards`.
+	portForwardsWg sync.WaitGroup
 }
 
 func (c *Container) Start(ctx context.Context, conSettings stdio.ConnectionSettings) (int, error) {
@@ -120,13 +135,23 @@ func (c *Container) Kill(ctx context.Context, signal syscall.Signal) error {
 }
 
 func (c *Container) Delete(ctx context.Context) error {
+	c.closePortForwards()
 	if c.isSandbox {
 		// remove user mounts in sandbox container
 		if err := storage.UnmountAllInPath(ctx, getSandboxMountsDir(c.id), true); err != nil {
 			log.G(ctx).WithError(err).Error("failed to unmount sandbox mounts")
 		}
 	}
-	return c.container.Delete()
+	if err := c.container.Delete(); err != nil {
+		return err
+	}
+	if c.netNS != "" {
+		// release the network namespace so its adapters and id can be reused
+		if err := releaseNetworkNamespace(ctx, c.netNS); err != nil {
+			log.G(ctx).WithError(err).Error("failed to release network namespace")
+		}
+	}
+	return nil
 }
 
 func (c *Container) Update(ctx context.Context, resources interface{}) error {
@@ -0,0 +1,286 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of mounts tracked by the `mountManager`.
+const (
+	mountKindSCSI     = "SCSI"
+	mountKindVPMem    = "VPMem"
+	mountKindPlan9    = "Plan9"
+	mountKindVirtioFS = "VirtioFS"
+	mountKindOverlay  = "Overlay"
+)
+
+// mountKey identifies a mount by the device it mounts and its target. SCSI
+// disks that are not mounted have an empty target.
+type mountKey struct {
+	kind   string
+	device string
+	target string
+}
+
+// mountEntry is the state of a mount in the `mountManager`.
+type mountEntry struct {
+	// mu is held for the duration of every mount and unmount of the entry so
+	// that concurrent requests for the same mount are serialized.
+	mu sync.Mutex
+
+	// The fields below are protected by `mountManager.mu`.
+
+	// refs is the number of adds of the mount not yet removed. Zero while the
+	// first add is in flight.
+	refs int
+	// settings are the settings the mount was added with.
+	settings interface{}
+	// pending is the number of requests for the mount that hold or wait for
+	// `mu`. The entry is deleted once it has neither refs nor pending
+	// requests.
+	pending int
+}
+
+// mountManager reference-counts the mounts created by `ModifySettings` so that
+// repeated adds of the same mount are idempotent and a mount is only torn down
+// by its last remove.
+type mountManager struct {
+	// mu protects `mounts` and the counts of its entries. It is never held
+	// while mounting or unmounting so that requests for different mounts run
+	// concurrently.
+	mu     sync.Mutex
+	mounts map[mountKey]*mountEntry
+}
+
+func newMountManager() *mountManager {
+	return &mountManager{
+		mounts: make(map[mountKey]*mountEntry),
+	}
+}
+
+// acquire returns the locked entry of `key`, creating it for an add. Returns
+// nil if `key` does not exist and `rt` is not an add. `release` must be called
+// with the returned entry.
+func (mm *mountManager) acquire(rt prot.ModifyRequestType, key mountKey) (*mountEntry, error) {
+	mm.mu.Lock()
+	e, ok := mm.mounts[key]
+	if !ok {
+		if rt != prot.MreqtAdd {
+			mm.mu.Unlock()
+			return nil, nil
+		}
+		if key.target != "" {
+			for k := range mm.mounts {
+				if k.target == key.target {
+					mm.mu.Unlock()
+					return nil, gcserr.WrapHresult(errors.Errorf("target '%s' is already mounted from %s %s", key.target, k.kind, k.device), gcserr.HrInvalidArg)
+				}
+			}
+		}
+		e = &mountEntry{}
+		mm.mounts[key] = e
+	}
+	e.pending++
+	mm.mu.Unlock()
+
+	e.mu.Lock()
+	return e, nil
+}
+
+// release unlocks `e` and deletes it if it is no longer referenced.
+func (mm *mountManager) release(key mountKey, e *mountEntry) {
+	e.mu.Unlock()
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	e.pending--
+	if e.refs == 0 && e.pending == 0 {
+		delete(mm.mounts, key)
+	}
+}
+
+// modify applies the request `rt` for the mount `key` by calling `fn` when the
+// reference count of `key` requires it. Adds of a mount that exists and
+// removes of a mount that is still referenced only update the reference count.
+// An add of a mount that exists with other `settings` fails. Removes of a
+// mount that does not exist succeed without calling `fn`. Any other request
+// type is always passed to `fn`. Requests for the same mount are serialized,
+// requests for different mounts are not.
+func (mm *mountManager) modify(ctx context.Context, rt prot.ModifyRequestType, key mountKey, settings interface{}, fn func() error) error {
+	entry := log.G(ctx).WithFields(logrus.Fields{
+		"kind":   key.kind,
+		"device": key.device,
+		"target": key.target,
+	})
+	e, err := mm.acquire(rt, key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		if rt == prot.MreqtRemove {
+			entry.Debug("mount does not exist")
+			return nil
+		}
+		return fn()
+	}
+	defer mm.release(key, e)
+
+	mm.mu.Lock()
+	refs, current := e.refs, e.settings
+	mm.mu.Unlock()
+	switch rt {
+	case prot.MreqtAdd:
+		if refs > 0 {
+			if !reflect.DeepEqual(current, settings) {
+				return gcserr.WrapHresult(errors.Errorf("%s %s is already mounted at '%s' with different settings", key.kind, key.device, key.target), gcserr.HrInvalidArg)
+			}
+			mm.setRefs(e, refs+1, current)
+			entry.WithField("refs", refs+1).Debug("mount already exists")
+			return nil
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		mm.setRefs(e, 1, settings)
+		return nil
+	case prot.MreqtRemove:
+		if refs == 0 {
+			entry.Debug("mount does not exist")
+			return nil
+		}
+		if refs > 1 {
+			mm.setRefs(e, refs-1, current)
+			entry.WithField("refs", refs-1).Debug("mount still referenced")
+			return nil
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		mm.setRefs(e, 0, nil)
+		return nil
+	default:
+		return fn()
+	}
+}
+
+// update calls `fn` with the settings the mount `key` was added with, under
+// the lock of the mount that serializes it with the mount's other requests.
+// Fails without calling `fn` if `key` is not mounted.
+func (mm *mountManager) update(key mountKey, fn func(settings interface{}) error) error {
+	e, err := mm.acquire(prot.MreqtUpdate, key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return gcserr.WrapHresult(errors.Errorf("%s %s is not mounted at '%s'", key.kind, key.device, key.target), gcserr.HrErrNotFound)
+	}
+	defer mm.release(key, e)
+
+	mm.mu.Lock()
+	refs, settings := e.refs, e.settings
+	mm.mu.Unlock()
+	if refs == 0 {
+		return gcserr.WrapHresult(errors.Errorf("%s %s is not mounted at '%s'", key.kind, key.device, key.target), gcserr.HrErrNotFound)
+	}
+	return fn(settings)
+}
+
+func (mm *mountManager) setRefs(e *mountEntry, refs int, settings interface{}) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	e.refs = refs
+	e.settings = settings
+}
+
+// list returns all the mounts sorted by target and device. Mounts whose first
+// add is still in flight are not returned.
+func (mm *mountManager) list() []prot.MountV2 {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	mounts := make([]prot.MountV2, 0, len(mm.mounts))
+	for k, e := range mm.mounts {
+		if e.refs == 0 {
+			continue
+		}
+		mounts = append(mounts, prot.MountV2{
+			Kind:     k.kind,
+			Device:   k.device,
+			Target:   k.target,
+			RefCount: e.refs,
+		})
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		if mounts[i].Target != mounts[j].Target {
+			return mounts[i].Target < mounts[j].Target
+		}
+		return mounts[i].Device < mounts[j].Device
+	})
+	return mounts
+}
+
+func scsiMountKey(mvd *prot.MappedVirtualDiskV2) mountKey {
+	return mountKey{
+		kind:   mountKindSCSI,
+		device: fmt.Sprintf("%d/%d", mvd.Controller, mvd.Lun),
+		target: mvd.MountPath,
+	}
+}
+
+func vpmemMountKey(vpd *prot.MappedVPMemDeviceV2) mountKey {
+	device := fmt.Sprintf("%d", vpd.DeviceNumber)
+	if vpd.MappingInfo != nil {
+		device = fmt.Sprintf("%d/%d", vpd.DeviceNumber, vpd.MappingInfo.DeviceOffsetInBytes)
+	}
+	return mountKey{
+		kind:   mountKindVPMem,
+		device: device,
+		target: vpd.MountPath,
+	}
+}
+
+func mappedDirectoryMountKey(md *prot.MappedDirectoryV2) mountKey {
+	if md.Transport == prot.MdtVirtioFS && md.VirtioFS != nil {
+		return mountKey{
+			kind:   mountKindVirtioFS,
+			device: md.VirtioFS.Tag,
+			target: md.MountPath,
+		}
+	}
+	return mountKey{
+		kind:   mountKindPlan9,
+		device: fmt.Sprintf("%d/%s", md.Port, md.ShareName),
+		target: md.MountPath,
+	}
+}
+
+func overlayMountKey(cl *prot.CombinedLayersV2) mountKey {
+	return mountKey{
+		kind:   mountKindOverlay,
+		device: "overlay",
+		target: cl.ContainerRootPath,
+	}
+}
+
+// scsiMountSettings returns the settings of the mount of `mvd` that a repeated
+// add must match. Settings that only apply to the first add or to the remove
+// are ignored.
+func scsiMountSettings(mvd *prot.MappedVirtualDiskV2) interface{} {
+	settings := *mvd
+	settings.FormatIfBlank = false
+	settings.CheckFilesystem = false
+	settings.BusyPolicy = ""
+	return settings
+}
@@ -0,0 +1,206 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+func Test_mountManager_RefCount(t *testing.T) {
+	mm := newMountManager()
+	key := vpmemMountKey(&prot.MappedVPMemDeviceV2{DeviceNumber: 1, MountPath: "/run/layers/p1"})
+
+	calls := 0
+	fn := func() error {
+		calls++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := mm.modify(context.Background(), prot.MreqtAdd, key, nil, fn); err != nil {
+			t.Fatalf("add %d: expected nil error got: %v", i, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 mount got %d", calls)
+	}
+	mounts := mm.list()
+	if len(mounts) != 1 || mounts[0].RefCount != 2 || mounts[0].Target != "/run/layers/p1" {
+		t.Fatalf("unexpected mounts: %+v", mounts)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := mm.modify(context.Background(), prot.MreqtRemove, key, nil, fn); err != nil {
+			t.Fatalf("remove %d: expected nil error got: %v", i, err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected 1 mount and 1 unmount got %d calls", calls)
+	}
+	if mounts := mm.list(); len(mounts) != 0 {
+		t.Fatalf("expected no mounts got: %+v", mounts)
+	}
+}
+
+func Test_mountManager_Failure_Not_Tracked(t *testing.T) {
+	mm := newMountManager()
+	key := scsiMountKey(&prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/run/mounts/m1"})
+
+	expectedErr := errors.New("mount failed")
+	err := mm.modify(context.Background(), prot.MreqtAdd, key, nil, func() error {
+		return expectedErr
+	})
+	if err != expectedErr {
+		t.Fatalf("expected error: %v got: %v", expectedErr, err)
+	}
+	if mounts := mm.list(); len(mounts) != 0 {
+		t.Fatalf("expected no mounts got: %+v", mounts)
+	}
+
+	if err := mm.modify(context.Background(), prot.MreqtAdd, key, nil, func() error { return nil }); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expectedErr = errors.New("unmount failed")
+	err = mm.modify(context.Background(), prot.MreqtRemove, key, nil, func() error {
+		return expectedErr
+	})
+	if err != expectedErr {
+		t.Fatalf("expected error: %v got: %v", expectedErr, err)
+	}
+	if mounts := mm.list(); len(mounts) != 1 {
+		t.Fatalf("expected mount to still be tracked got: %+v", mounts)
+	}
+}
+
+func Test_mountManager_Target_Conflict(t *testing.T) {
+	mm := newMountManager()
+	fn := func() error { return nil }
+
+	first := scsiMountKey(&prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/run/mounts/m1"})
+	if err := mm.modify(context.Background(), prot.MreqtAdd, first, nil, fn); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	second := scsiMountKey(&prot.MappedVirtualDiskV2{Controller: 0, Lun: 2, MountPath: "/run/mounts/m1"})
+	if err := mm.modify(context.Background(), prot.MreqtAdd, second, nil, fn); err == nil {
+		t.Fatal("expected error mounting a different device to the same target")
+	}
+
+	// Disks that are only attached have no target to conflict on.
+	for lun := uint8(3); lun < 5; lun++ {
+		key := scsiMountKey(&prot.MappedVirtualDiskV2{Controller: 0, Lun: lun})
+		if err := mm.modify(context.Background(), prot.MreqtAdd, key, nil, fn); err != nil {
+			t.Fatalf("expected nil error got: %v", err)
+		}
+	}
+	if mounts := mm.list(); len(mounts) != 3 {
+		t.Fatalf("expected 3 mounts got: %+v", mounts)
+	}
+}
+
+func Test_mountManager_Different_Mounts_Concurrent(t *testing.T) {
+	mm := newMountManager()
+	first := scsiMountKey(&prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/run/mounts/m1"})
+	second := scsiMountKey(&prot.MappedVirtualDiskV2{Controller: 0, Lun: 2, MountPath: "/run/mounts/m2"})
+
+	// The first mount only completes once the second one has, which requires
+	// that they do not wait for each other.
+	secondDone := make(chan struct{})
+	firstErr := make(chan error, 1)
+	go func() {
+		firstErr <- mm.modify(context.Background(), prot.MreqtAdd, first, nil, func() error {
+			select {
+			case <-secondDone:
+				return nil
+			case <-time.After(5 * time.Second):
+				return errors.New("timed out waiting for the second mount")
+			}
+		})
+	}()
+	if err := mm.modify(context.Background(), prot.MreqtAdd, second, nil, func() error { return nil }); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	close(secondDone)
+	if err := <-firstErr; err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if mounts := mm.list(); len(mounts) != 2 {
+		t.Fatalf("expected 2 mounts got: %+v", mounts)
+	}
+}
+
+func Test_mountManager_Same_Mount_Serialized(t *testing.T) {
+	mm := newMountManager()
+	key := scsiMountKey(&prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/run/mounts/m1"})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	active, calls := 0, 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := mm.modify(context.Background(), prot.MreqtAdd, key, nil, func() error {
+				mu.Lock()
+				active++
+				calls++
+				if active > 1 {
+					t.Error("concurrent mounts of the same key")
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				active--
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Errorf("expected nil error got: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("expected 1 mount got %d", calls)
+	}
+	if mounts := mm.list(); len(mounts) != 1 || mounts[0].RefCount != 8 {
+		t.Fatalf("unexpected mounts: %+v", mounts)
+	}
+}
+
+func Test_mountManager_Settings_Mismatch(t *testing.T) {
+	mm := newMountManager()
+	fn := func() error { return nil }
+
+	mvd := &prot.MappedVirtualDiskV2{Controller: 0, Lun: 1, MountPath: "/run/mounts/m1", ReadOnly: true}
+	key := scsiMountKey(mvd)
+	if err := mm.modify(context.Background(), prot.MreqtAdd, key, scsiMountSettings(mvd), fn); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	// Settings of the first add or of the remove do not need to match.
+	same := *mvd
+	same.CheckFilesystem = true
+	same.BusyPolicy = prot.BpKill
+	if err := mm.modify(context.Background(), prot.MreqtAdd, key, scsiMountSettings(&same), fn); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	for _, different := range []prot.MappedVirtualDiskV2{
+		{Controller: 0, Lun: 1, MountPath: "/run/mounts/m1"},
+		{Controller: 0, Lun: 1, MountPath: "/run/mounts/m1", ReadOnly: true, Encryption: &prot.DeviceEncryptionInfo{}},
+	} {
+		err := mm.modify(context.Background(), prot.MreqtAdd, key, scsiMountSettings(&different), fn)
+		if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrInvalidArg {
+			t.Fatalf("%+v: expected HrInvalidArg got: %v", different, err)
+		}
+	}
+	if mounts := mm.list(); len(mounts) != 1 || mounts[0].RefCount != 2 {
+		t.Fatalf("unexpected mounts: %+v", mounts)
+	}
+}
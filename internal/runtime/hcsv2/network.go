@@ -7,11 +7,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/internal/network"
 	"github.com/Microsoft/opengcs/internal/oc"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netns"
 	"go.opencensus.io/trace"
 )
@@ -27,6 +29,14 @@ var (
 	networkInstanceIDToName = network.InstanceIDToName
 )
 
+const (
+	// firstRouteTable and firstRulePriority are the routing table and rule
+	// priority of the first adapter in a namespace. Following adapters get the
+	// next free ones.
+	firstRouteTable   = 101
+	firstRulePriority = 5
+)
+
 func init() {
 	namespaces = make(map[string]*namespace)
 }
@@ -89,6 +99,55 @@ func removeNetworkNamespace(ctx context.Context, id string) (err error) {
 	return nil
 }
 
+// releaseNetworkNamespace removes the in-memory `namespace` found by `id` and
+// all of its adapters. Any adapter still assigned to a container pid has its
+// configuration removed and is moved back to the GCS network namespace so that
+// it can be reused. Adapters that could not be recovered are reported as
+// leaked in the returned error, but the namespace is always removed.
+func releaseNetworkNamespace(ctx context.Context, id string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "hcsv2::releaseNetworkNamespace")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	id = strings.ToLower(id)
+	span.AddAttributes(trace.StringAttribute("id", id))
+
+	namespaceSync.Lock()
+	defer namespaceSync.Unlock()
+
+	ns, ok := namespaces[id]
+	if !ok {
+		return nil
+	}
+	ns.m.Lock()
+	defer ns.m.Unlock()
+
+	if err := ns.removePolicy(ctx); err != nil {
+		log.G(ctx).WithError(err).WithField("namespace", id).Error("failed to remove network policy")
+	}
+
+	var leaked []string
+	for _, nic := range ns.nics {
+		if err := nic.removeFromPid(ctx); err != nil {
+			log.G(ctx).WithError(err).WithFields(logrus.Fields{
+				"namespace": id,
+				"adapterID": nic.adapter.ID,
+				"ifname":    nic.ifname,
+			}).Error("failed to release adapter")
+			leaked = append(leaked, nic.ifname)
+		}
+	}
+	ns.nics = nil
+	ns.routing = routingAllocator{}
+	ns.pid = 0
+	delete(namespaces, id)
+
+	if len(leaked) > 0 {
+		return errors.Errorf("network namespace '%s' leaked adapters: %s", id, strings.Join(leaked, ", "))
+	}
+	return nil
+}
+
 // namespace struct maps all vNIC's to the namespace ID used by the HNS.
 type namespace struct {
 	id string
@@ -96,6 +155,16 @@ type namespace struct {
 	m    sync.Mutex
 	pid  int
 	nics []*nicInNamespace
+	// routing allocates the routing table and rule priority of each adapter.
+	routing routingAllocator
+	// bandwidth is the default traffic shaping of adapters that do not set
+	// their own limits.
+	bandwidth network.BandwidthLimits
+	// policy is the firewall policy of the namespace or `nil` if none.
+	policy *prot.NetworkPolicyV2
+	// policyPid is the pid whose network namespace `policy` was applied to or
+	// `0` if not yet applied.
+	policyPid int
 }
 
 // ID is the id of the network namespace
@@ -125,6 +194,162 @@ func (n *namespace) AssignContainerPid(ctx context.Context, pid int) (err error)
 	return nil
 }
 
+// ContainerPid returns the pid whose network namespace `n` is assigned to or
+// `0` if not yet assigned.
+func (n *namespace) ContainerPid() int {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	return n.pid
+}
+
+// SetBandwidth sets the default traffic shaping limits of the adapters in `n`
+// that do not set their own. Adapters already assigned to a container pid are
+// not reconfigured.
+func (n *namespace) SetBandwidth(ctx context.Context, limits network.BandwidthLimits) (err error) {
+	_, span := trace.StartSpan(ctx, "namespace::SetBandwidth")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("namespace", n.id),
+		trace.StringAttribute("limits", fmt.Sprintf("%+v", limits)))
+
+	if err := limits.Validate(); err != nil {
+		return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+	}
+
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	n.bandwidth = limits
+	return nil
+}
+
+// AddPolicy sets the firewall policy of `n` to `policy`. Returns an error if
+// `n` already has a policy. If `n` is assigned to a container pid the policy is
+// applied immediately, otherwise it is applied by `Sync()`.
+func (n *namespace) AddPolicy(ctx context.Context, policy *prot.NetworkPolicyV2) (err error) {
+	ctx, span := trace.StartSpan(ctx, "namespace::AddPolicy")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("namespace", n.id),
+		trace.StringAttribute("policy", fmt.Sprintf("%+v", policy)))
+
+	return n.setPolicy(ctx, policy, false)
+}
+
+// UpdatePolicy replaces the firewall policy of `n` with `policy`. Returns an
+// error if `n` has no policy. If `n` is assigned to a container pid the policy
+// is applied immediately and atomically, otherwise it is applied by `Sync()`.
+func (n *namespace) UpdatePolicy(ctx context.Context, policy *prot.NetworkPolicyV2) (err error) {
+	ctx, span := trace.StartSpan(ctx, "namespace::UpdatePolicy")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("namespace", n.id),
+		trace.StringAttribute("policy", fmt.Sprintf("%+v", policy)))
+
+	return n.setPolicy(ctx, policy, true)
+}
+
+// setPolicy sets the firewall policy of `n` to `policy`. If `replace` is set
+// `n` must have a policy, otherwise it must not.
+func (n *namespace) setPolicy(ctx context.Context, policy *prot.NetworkPolicyV2, replace bool) error {
+	if err := network.ValidateFirewallPolicy(policy); err != nil {
+		return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+	}
+
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	if replace && n.policy == nil {
+		return gcserr.WrapHresult(errors.Errorf("network namespace '%s' has no network policy", n.id), gcserr.HrErrNotFound)
+	}
+	if !replace && n.policy != nil {
+		return errors.Errorf("network namespace '%s' already has a network policy", n.id)
+	}
+	if n.pid != 0 {
+		if err := n.applyPolicy(ctx, policy); err != nil {
+			return err
+		}
+	}
+	n.policy = policy
+	return nil
+}
+
+// Policy returns the firewall policy of `n` or `nil` if none.
+func (n *namespace) Policy() *prot.NetworkPolicyV2 {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	return n.policy
+}
+
+// RemovePolicy removes the firewall policy of `n`. If there is no policy
+// returns no error.
+func (n *namespace) RemovePolicy(ctx context.Context) (err error) {
+	ctx, span := trace.StartSpan(ctx, "namespace::RemovePolicy")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(trace.StringAttribute("namespace", n.id))
+
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	if err := n.removePolicy(ctx); err != nil {
+		return err
+	}
+	n.policy = nil
+	return nil
+}
+
+// applyPolicy applies `policy` to the network namespace of `n.pid`.
+//
+// The caller MUST hold `n.m`.
+func (n *namespace) applyPolicy(ctx context.Context, policy *prot.NetworkPolicyV2) error {
+	ns, err := netns.GetFromPid(n.pid)
+	if err != nil {
+		return errors.Wrapf(err, "netns.GetFromPid(%d) failed", n.pid)
+	}
+	defer ns.Close()
+
+	netNSCfgFirewall := func() error {
+		return network.NetNSConfigFirewall(ctx, policy)
+	}
+	if err := network.DoInNetNS(ns, netNSCfgFirewall); err != nil {
+		return errors.Wrapf(err, "failed to apply network policy to namespace: %s", n.id)
+	}
+	n.policyPid = n.pid
+	return nil
+}
+
+// removePolicy removes the applied policy from the network namespace of
+// `n.policyPid`. If the pid has exited its network namespace, and the policy
+// with it, is already gone.
+//
+// The caller MUST hold `n.m`.
+func (n *namespace) removePolicy(ctx context.Context) error {
+	if n.policyPid == 0 {
+		return nil
+	}
+	ns, err := netns.GetFromPid(n.policyPid)
+	if err != nil {
+		n.policyPid = 0
+		return nil
+	}
+	defer ns.Close()
+
+	netNSRemoveFirewall := func() error {
+		return network.NetNSRemoveFirewall(ctx)
+	}
+	if err := network.DoInNetNS(ns, netNSRemoveFirewall); err != nil {
+		return errors.Wrapf(err, "failed to remove network policy from namespace: %s", n.id)
+	}
+	n.policyPid = 0
+	return nil
+}
+
 // Adapters returns a copy of the adapters assigned to `n` at the time of the
 // call.
 func (n *namespace) Adapters() []*prot.NetworkAdapterV2 {
@@ -157,6 +382,12 @@ func (n *namespace) AddAdapter(ctx context.Context, adp *prot.NetworkAdapterV2)
 			return errors.Errorf("adapter with id: '%s' already present in namespace", adp.ID)
 		}
 	}
+	if err := adapterBandwidth(adp).Validate(); err != nil {
+		return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+	}
+	if err := network.ValidateRoutes(adp.Routes); err != nil {
+		return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+	}
 
 	resolveCtx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
@@ -164,9 +395,12 @@ func (n *namespace) AddAdapter(ctx context.Context, adp *prot.NetworkAdapterV2)
 	if err != nil {
 		return err
 	}
+	table, priority := n.routing.allocate()
 	n.nics = append(n.nics, &nicInNamespace{
-		adapter: adp,
-		ifname:  ifname,
+		adapter:  adp,
+		ifname:   ifname,
+		table:    table,
+		priority: priority,
 	})
 	return nil
 }
@@ -174,7 +408,7 @@ func (n *namespace) AddAdapter(ctx context.Context, adp *prot.NetworkAdapterV2)
 // RemoveAdapter removes the adapter matching `id` from `n`. If `id` is not
 // found returns no error.
 func (n *namespace) RemoveAdapter(ctx context.Context, id string) (err error) {
-	_, span := trace.StartSpan(ctx, "namespace::RemoveAdapter")
+	ctx, span := trace.StartSpan(ctx, "namespace::RemoveAdapter")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 	span.AddAttributes(
@@ -184,8 +418,6 @@ func (n *namespace) RemoveAdapter(ctx context.Context, id string) (err error) {
 	n.m.Lock()
 	defer n.m.Unlock()
 
-	// TODO: do we need to remove anything guestside from a sandbox namespace?
-
 	i := -1
 	for j, nic := range n.nics {
 		if strings.EqualFold(nic.adapter.ID, id) {
@@ -194,12 +426,51 @@ func (n *namespace) RemoveAdapter(ctx context.Context, id string) (err error) {
 		}
 	}
 	if i > -1 {
+		if err := n.nics[i].removeFromPid(ctx); err != nil {
+			return err
+		}
+		n.routing.release(n.nics[i].table)
 		n.nics = append(n.nics[:i], n.nics[i+1:]...)
 	}
 	return nil
 }
 
-// Sync moves all adapters to the network namespace of `n` if assigned.
+// UpdateAdapter updates the traffic shaping limits of the adapter matching
+// `adp.ID` in `n` to those of `adp`. If the adapter is assigned to a container
+// pid the new limits are applied immediately. Other settings of the adapter
+// cannot be updated.
+func (n *namespace) UpdateAdapter(ctx context.Context, adp *prot.NetworkAdapterV2) (err error) {
+	ctx, span := trace.StartSpan(ctx, "namespace::UpdateAdapter")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("namespace", n.id),
+		trace.StringAttribute("adapter", fmt.Sprintf("%+v", adp)))
+
+	if err := adapterBandwidth(adp).Validate(); err != nil {
+		return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+	}
+
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	for _, nic := range n.nics {
+		if strings.EqualFold(nic.adapter.ID, adp.ID) {
+			nic.adapter.IngressBandwidth = adp.IngressBandwidth
+			nic.adapter.IngressBurst = adp.IngressBurst
+			nic.adapter.EgressBandwidth = adp.EgressBandwidth
+			nic.adapter.EgressBurst = adp.EgressBurst
+			if nic.assignedPid == 0 {
+				return nil
+			}
+			return nic.applyBandwidth(ctx, n.bandwidth)
+		}
+	}
+	return gcserr.WrapHresult(errors.Errorf("adapter with id: '%s' not found in namespace '%s'", adp.ID, n.id), gcserr.HrErrNotFound)
+}
+
+// Sync moves all adapters to the network namespace of `n` and applies its
+// firewall policy if assigned.
 func (n *namespace) Sync(ctx context.Context) (err error) {
 	ctx, span := trace.StartSpan(ctx, "namespace::Sync")
 	defer span.End()
@@ -216,11 +487,19 @@ func (n *namespace) Sync(ctx context.Context) (err error) {
 			if i > 0 {
 				a.adapter.EnableLowMetric = true
 			}
-			err = a.assignToPid(ctx, n.pid)
+			if a.assignedPid == n.pid {
+				continue
+			}
+			err = a.assignToPid(ctx, n.pid, n.bandwidth)
 			if err != nil {
 				return err
 			}
 		}
+		if n.policy != nil && n.policyPid != n.pid {
+			if err := n.applyPolicy(ctx, n.policy); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -235,19 +514,53 @@ type nicInNamespace struct {
 	// assignedPid will be `0` for any nic in this namespace that has not been
 	// moved into a specific pid network namespace.
 	assignedPid int
+	// table and priority are the routing table and rule priority allocated to
+	// this adapter in the namespace.
+	table    int
+	priority int
 }
 
-// assignToPid assigns `nin.adapter`, represented by `nin.ifname` to `pid`.
-func (nin *nicInNamespace) assignToPid(ctx context.Context, pid int) (err error) {
-	ctx, span := trace.StartSpan(ctx, "nicInNamespace::assignToPid")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-	span.AddAttributes(
-		trace.StringAttribute("adapterID", nin.adapter.ID),
-		trace.StringAttribute("ifname", nin.ifname),
-		trace.Int64Attribute("pid", int64(pid)))
+// routingAllocator allocates the routing table and rule priority of the
+// adapters in a namespace so that no two adapters share them.
+type routingAllocator struct {
+	used []bool
+}
+
+// allocate returns the lowest free routing table and its rule priority.
+func (ra *routingAllocator) allocate() (table, priority int) {
+	i := 0
+	for ; i < len(ra.used); i++ {
+		if !ra.used[i] {
+			break
+		}
+	}
+	if i == len(ra.used) {
+		ra.used = append(ra.used, false)
+	}
+	ra.used[i] = true
+	return firstRouteTable + i, firstRulePriority + i
+}
 
-	v1Adapter := &prot.NetworkAdapter{
+// release frees `table` and its rule priority for reuse.
+func (ra *routingAllocator) release(table int) {
+	if i := table - firstRouteTable; i >= 0 && i < len(ra.used) {
+		ra.used[i] = false
+	}
+}
+
+// routing returns the policy routing configuration of `nin`.
+func (nin *nicInNamespace) routing() *network.Routing {
+	return &network.Routing{
+		Table:    nin.table,
+		Priority: nin.priority,
+		Routes:   nin.adapter.Routes,
+	}
+}
+
+// v1Adapter returns the `prot.NetworkAdapter` settings used to configure
+// `nin.adapter` in the network namespace.
+func (nin *nicInNamespace) v1Adapter() *prot.NetworkAdapter {
+	return &prot.NetworkAdapter{
 		NatEnabled:         nin.adapter.IPAddress != "",
 		AllocatedIPAddress: nin.adapter.IPAddress,
 		HostIPAddress:      nin.adapter.GatewayAddress,
@@ -255,6 +568,72 @@ func (nin *nicInNamespace) assignToPid(ctx context.Context, pid int) (err error)
 		EnableLowMetric:    nin.adapter.EnableLowMetric,
 		EncapOverhead:      nin.adapter.EncapOverhead,
 	}
+}
+
+// adapterBandwidth returns the traffic shaping limits set by `adp`.
+func adapterBandwidth(adp *prot.NetworkAdapterV2) network.BandwidthLimits {
+	return network.BandwidthLimits{
+		IngressRate:  adp.IngressBandwidth,
+		IngressBurst: adp.IngressBurst,
+		EgressRate:   adp.EgressBandwidth,
+		EgressBurst:  adp.EgressBurst,
+	}
+}
+
+// bandwidth returns the traffic shaping limits of `nin`. Each direction the
+// adapter does not limit itself falls back to `defaults`.
+func (nin *nicInNamespace) bandwidth(defaults network.BandwidthLimits) network.BandwidthLimits {
+	limits := adapterBandwidth(nin.adapter)
+	if limits.IngressRate == 0 {
+		limits.IngressRate = defaults.IngressRate
+		limits.IngressBurst = defaults.IngressBurst
+	}
+	if limits.EgressRate == 0 {
+		limits.EgressRate = defaults.EgressRate
+		limits.EgressBurst = defaults.EgressBurst
+	}
+	return limits
+}
+
+// applyBandwidth replaces the traffic shaping of `nin.ifname` in the network
+// namespace of `nin.assignedPid` with `nin.bandwidth(defaults)`.
+func (nin *nicInNamespace) applyBandwidth(ctx context.Context, defaults network.BandwidthLimits) (err error) {
+	ctx, span := trace.StartSpan(ctx, "nicInNamespace::applyBandwidth")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("adapterID", nin.adapter.ID),
+		trace.StringAttribute("ifname", nin.ifname),
+		trace.Int64Attribute("pid", int64(nin.assignedPid)))
+
+	ns, err := netns.GetFromPid(nin.assignedPid)
+	if err != nil {
+		return errors.Wrapf(err, "netns.GetFromPid(%d) failed", nin.assignedPid)
+	}
+	defer ns.Close()
+
+	limits := nin.bandwidth(defaults)
+	netNSCfgBandwidth := func() error {
+		return network.NetNSConfigBandwidth(ctx, nin.ifname, limits)
+	}
+	if err := network.DoInNetNS(ns, netNSCfgBandwidth); err != nil {
+		return errors.Wrapf(err, "failed to configure bandwidth of adapter aid: %s, if id: %s", nin.adapter.ID, nin.ifname)
+	}
+	return nil
+}
+
+// assignToPid assigns `nin.adapter`, represented by `nin.ifname` to `pid` and
+// shapes its traffic with `nin.bandwidth(defaults)`.
+func (nin *nicInNamespace) assignToPid(ctx context.Context, pid int, defaults network.BandwidthLimits) (err error) {
+	ctx, span := trace.StartSpan(ctx, "nicInNamespace::assignToPid")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("adapterID", nin.adapter.ID),
+		trace.StringAttribute("ifname", nin.ifname),
+		trace.Int64Attribute("pid", int64(pid)))
+
+	v1Adapter := nin.v1Adapter()
 
 	if err := network.MoveInterfaceToNS(nin.ifname, pid); err != nil {
 		return errors.Wrapf(err, "failed to move interface %s to network namespace", nin.ifname)
@@ -267,8 +646,13 @@ func (nin *nicInNamespace) assignToPid(ctx context.Context, pid int) (err error)
 	}
 	defer ns.Close()
 
+	limits := nin.bandwidth(defaults)
+	routing := nin.routing()
 	netNSCfg := func() error {
-		return network.NetNSConfig(ctx, nin.ifname, pid, v1Adapter)
+		if err := network.NetNSConfig(ctx, nin.ifname, pid, v1Adapter, routing); err != nil {
+			return err
+		}
+		return network.NetNSConfigBandwidth(ctx, nin.ifname, limits)
 	}
 
 	if err := network.DoInNetNS(ns, netNSCfg); err != nil {
@@ -277,3 +661,61 @@ func (nin *nicInNamespace) assignToPid(ctx context.Context, pid int) (err error)
 	nin.assignedPid = pid
 	return nil
 }
+
+// removeFromPid removes the configuration of `nin.adapter` from the network
+// namespace of `nin.assignedPid` and moves `nin.ifname` back to the GCS network
+// namespace. If the adapter was never assigned this is a no-op.
+//
+// If the container pid has already exited its network namespace is destroyed
+// by the kernel, which returns the adapter to the initial network namespace.
+// In that case this waits for `nin.ifname` to reappear in the GCS network
+// namespace and returns an error if it does not.
+func (nin *nicInNamespace) removeFromPid(ctx context.Context) (err error) {
+	ctx, span := trace.StartSpan(ctx, "nicInNamespace::removeFromPid")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("adapterID", nin.adapter.ID),
+		trace.StringAttribute("ifname", nin.ifname),
+		trace.Int64Attribute("pid", int64(nin.assignedPid)))
+
+	if nin.assignedPid == 0 {
+		return nil
+	}
+
+	ns, err := netns.GetFromPid(nin.assignedPid)
+	if err != nil {
+		waitCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+		defer cancel()
+		if err := network.WaitForInterface(waitCtx, nin.ifname); err != nil {
+			return errors.Wrapf(err, "adapter aid: %s, if id: %s was not returned to the GCS network namespace", nin.adapter.ID, nin.ifname)
+		}
+		nin.assignedPid = 0
+		return nil
+	}
+	defer ns.Close()
+
+	gcsNS, err := netns.Get()
+	if err != nil {
+		return errors.Wrap(err, "failed to get GCS network namespace")
+	}
+	defer gcsNS.Close()
+
+	netNSRemoveCfg := func() error {
+		// Removing the shaping also deletes the ifb device, which would
+		// otherwise be left behind in the container network namespace.
+		if err := network.NetNSConfigBandwidth(ctx, nin.ifname, network.BandwidthLimits{}); err != nil {
+			return err
+		}
+		if err := network.NetNSRemoveConfig(ctx, nin.ifname, nin.v1Adapter(), nin.routing()); err != nil {
+			return err
+		}
+		return network.MoveInterfaceToNSHandle(nin.ifname, gcsNS)
+	}
+
+	if err := network.DoInNetNS(ns, netNSRemoveCfg); err != nil {
+		return errors.Wrapf(err, "failed to remove adapter aid: %s, if id: %s", nin.adapter.ID, nin.ifname)
+	}
+	nin.assignedPid = 0
+	return nil
+}
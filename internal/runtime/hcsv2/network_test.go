@@ -4,8 +4,12 @@ package hcsv2
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/Microsoft/opengcs/internal/network"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 )
 
@@ -117,3 +121,237 @@ func Test_removeNetworkNamespace_HasAdapters(t *testing.T) {
 		t.Fatalf("should not have failed to delete empty namepace got: %v", err)
 	}
 }
+
+func Test_releaseNetworkNamespace_NotExist(t *testing.T) {
+	err := releaseNetworkNamespace(context.Background(), t.Name())
+	if err != nil {
+		t.Fatalf("failed to release non-existing ns with error: %v", err)
+	}
+}
+
+func Test_releaseNetworkNamespace_HasAdapters(t *testing.T) {
+	nsOld := networkInstanceIDToName
+	defer func() {
+		networkInstanceIDToName = nsOld
+	}()
+
+	ns := getOrAddNetworkNamespace(t.Name())
+
+	networkInstanceIDToName = func(ctx context.Context, id string) (string, error) {
+		return "/dev/sdz", nil
+	}
+	err := ns.AddAdapter(context.Background(), &prot.NetworkAdapterV2{ID: "test"})
+	if err != nil {
+		t.Fatalf("failed to add adapter: %v", err)
+	}
+	err = releaseNetworkNamespace(context.Background(), t.Name())
+	if err != nil {
+		t.Fatalf("should not have failed to release namespace with unassigned adapters got: %v", err)
+	}
+	if _, err := getNetworkNamespace(t.Name()); err == nil {
+		t.Fatal("namespace should not exist after release")
+	}
+	if len(ns.Adapters()) != 0 {
+		t.Fatalf("released namespace should not contain adapters, got: %+v", ns.Adapters())
+	}
+}
+
+func Test_modifyNetwork_Remove_NamespaceNotExist(t *testing.T) {
+	err := modifyNetwork(context.Background(), prot.MreqtRemove, &prot.NetworkAdapterV2{
+		NamespaceID: t.Name(),
+		ID:          "test",
+	})
+	if err != nil {
+		t.Fatalf("expected nil error removing adapter from released namespace got: %v", err)
+	}
+	if _, err := getNetworkNamespace(t.Name()); err == nil {
+		t.Fatal("remove should not create the namespace")
+	}
+}
+
+func Test_namespace_UpdateAdapter_Unassigned(t *testing.T) {
+	defer func() {
+		err := releaseNetworkNamespace(context.Background(), t.Name())
+		if err != nil {
+			t.Errorf("failed to release ns with error: %v", err)
+		}
+	}()
+	nsOld := networkInstanceIDToName
+	defer func() {
+		networkInstanceIDToName = nsOld
+	}()
+
+	ns := getOrAddNetworkNamespace(t.Name())
+
+	networkInstanceIDToName = func(ctx context.Context, id string) (string, error) {
+		return "/dev/sdz", nil
+	}
+	err := ns.AddAdapter(context.Background(), &prot.NetworkAdapterV2{ID: "test"})
+	if err != nil {
+		t.Fatalf("failed to add adapter: %v", err)
+	}
+	err = ns.UpdateAdapter(context.Background(), &prot.NetworkAdapterV2{ID: "test", EgressBandwidth: 1000000})
+	if err != nil {
+		t.Fatalf("failed to update adapter: %v", err)
+	}
+	if adps := ns.Adapters(); adps[0].EgressBandwidth != 1000000 {
+		t.Fatalf("expected egress bandwidth 1000000 got: %d", adps[0].EgressBandwidth)
+	}
+	err = ns.UpdateAdapter(context.Background(), &prot.NetworkAdapterV2{ID: "test", EgressBandwidth: 10})
+	if err == nil {
+		t.Fatal("expected error updating adapter with a rate below the minimum")
+	}
+	err = ns.UpdateAdapter(context.Background(), &prot.NetworkAdapterV2{ID: "missing"})
+	if err == nil {
+		t.Fatal("expected error updating adapter that does not exist")
+	}
+}
+
+func Test_nicInNamespace_bandwidth_Defaults(t *testing.T) {
+	defaults := network.BandwidthLimits{
+		IngressRate:  1000000,
+		IngressBurst: 8000,
+		EgressRate:   2000000,
+	}
+	nin := &nicInNamespace{
+		adapter: &prot.NetworkAdapterV2{
+			EgressBandwidth: 3000000,
+			EgressBurst:     16000,
+		},
+	}
+	expected := network.BandwidthLimits{
+		IngressRate:  1000000,
+		IngressBurst: 8000,
+		EgressRate:   3000000,
+		EgressBurst:  16000,
+	}
+	if limits := nin.bandwidth(defaults); limits != expected {
+		t.Fatalf("expected limits %+v got: %+v", expected, limits)
+	}
+}
+
+func Test_modifyNetworkPolicy_Unassigned(t *testing.T) {
+	defer func() {
+		err := releaseNetworkNamespace(context.Background(), t.Name())
+		if err != nil {
+			t.Errorf("failed to release ns with error: %v", err)
+		}
+	}()
+
+	policy := &prot.NetworkPolicyV2{
+		NamespaceID:          t.Name(),
+		DefaultIngressAction: prot.NpaDeny,
+	}
+	err := modifyNetworkPolicy(context.Background(), prot.MreqtUpdate, policy)
+	if err == nil {
+		t.Fatal("expected error updating policy of a namespace that does not exist")
+	}
+	err = modifyNetworkPolicy(context.Background(), prot.MreqtAdd, policy)
+	if err != nil {
+		t.Fatalf("failed to add policy: %v", err)
+	}
+	err = modifyNetworkPolicy(context.Background(), prot.MreqtAdd, policy)
+	if err == nil {
+		t.Fatal("expected error adding a second policy")
+	}
+	err = modifyNetworkPolicy(context.Background(), prot.MreqtUpdate, &prot.NetworkPolicyV2{
+		NamespaceID:          t.Name(),
+		DefaultIngressAction: "Reject",
+	})
+	if err == nil {
+		t.Fatal("expected error updating to an invalid policy")
+	}
+	ns, err := getNetworkNamespace(t.Name())
+	if err != nil {
+		t.Fatalf("expected namespace to exist got: %v", err)
+	}
+	if ns.Policy() != policy {
+		t.Fatalf("invalid update should not replace the policy, got: %+v", ns.Policy())
+	}
+	err = modifyNetworkPolicy(context.Background(), prot.MreqtRemove, policy)
+	if err != nil {
+		t.Fatalf("failed to remove policy: %v", err)
+	}
+	if ns.Policy() != nil {
+		t.Fatalf("expected no policy after remove got: %+v", ns.Policy())
+	}
+}
+
+func Test_routingAllocator_ReusesReleased(t *testing.T) {
+	var ra routingAllocator
+	for i := 0; i < 3; i++ {
+		table, priority := ra.allocate()
+		if table != firstRouteTable+i || priority != firstRulePriority+i {
+			t.Fatalf("expected table %d priority %d got table %d priority %d", firstRouteTable+i, firstRulePriority+i, table, priority)
+		}
+	}
+	ra.release(firstRouteTable + 1)
+	table, priority := ra.allocate()
+	if table != firstRouteTable+1 || priority != firstRulePriority+1 {
+		t.Fatalf("expected released table %d to be reused got table %d priority %d", firstRouteTable+1, table, priority)
+	}
+	table, _ = ra.allocate()
+	if table != firstRouteTable+3 {
+		t.Fatalf("expected table %d got %d", firstRouteTable+3, table)
+	}
+}
+
+func Test_namespace_AddAdapter_DistinctRouting(t *testing.T) {
+	defer func() {
+		err := releaseNetworkNamespace(context.Background(), t.Name())
+		if err != nil {
+			t.Errorf("failed to release ns with error: %v", err)
+		}
+	}()
+	nsOld := networkInstanceIDToName
+	defer func() {
+		networkInstanceIDToName = nsOld
+	}()
+
+	ns := getOrAddNetworkNamespace(t.Name())
+
+	networkInstanceIDToName = func(ctx context.Context, id string) (string, error) {
+		return "eth" + id, nil
+	}
+	for _, id := range []string{"0", "1"} {
+		if err := ns.AddAdapter(context.Background(), &prot.NetworkAdapterV2{ID: id}); err != nil {
+			t.Fatalf("failed to add adapter: %v", err)
+		}
+	}
+	if ns.nics[0].table == ns.nics[1].table || ns.nics[0].priority == ns.nics[1].priority {
+		t.Fatalf("adapters must not share routing, got: %+v, %+v", ns.nics[0], ns.nics[1])
+	}
+	err := ns.AddAdapter(context.Background(), &prot.NetworkAdapterV2{
+		ID:     "2",
+		Routes: []prot.RouteV2{{DestinationPrefix: "10.0.0.1"}},
+	})
+	if err == nil {
+		t.Fatal("expected error adding adapter with an invalid route")
+	}
+}
+
+func Test_namespace_AddPolicy_Concurrent(t *testing.T) {
+	ns := &namespace{id: t.Name()}
+	policy := &prot.NetworkPolicyV2{NamespaceID: t.Name()}
+
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ns.AddPolicy(context.Background(), policy); err == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Fatalf("expected exactly one policy to be added got: %d", added)
+	}
+
+	err := (&namespace{id: t.Name()}).UpdatePolicy(context.Background(), policy)
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrErrNotFound {
+		t.Fatalf("expected HrErrNotFound got: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/network"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/transport"
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netns"
+	"go.opencensus.io/trace"
+)
+
+// halfCloser is a connection that supports closing its write side while
+// continuing to read.
+type halfCloser interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+// portForward is a single stream relaying bytes between a host vsock connection
+// and a TCP connection in a container network namespace.
+type portForward struct {
+	host      transport.Connection
+	container halfCloser
+
+	closeOnce sync.Once
+}
+
+// relay copies bytes in both directions until both sides have closed their
+// write half or `pf` is closed. When one side finishes writing the write half
+// of the other side is closed so that the peer sees EOF.
+func (pf *portForward) relay(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(pf.container, pf.host); err != nil {
+			log.G(ctx).WithError(err).Debug("port forward host to container copy ended")
+		}
+		pf.container.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(pf.host, pf.container); err != nil {
+			log.G(ctx).WithError(err).Debug("port forward container to host copy ended")
+		}
+		pf.host.CloseWrite()
+	}()
+	wg.Wait()
+	pf.Close()
+}
+
+// Close closes both sides of the stream which unblocks any outstanding copy.
+func (pf *portForward) Close() {
+	pf.closeOnce.Do(func() {
+		pf.host.Close()
+		pf.container.Close()
+	})
+}
+
+// dialInNetNS connects to `127.0.0.1:port` in the network namespace of `pid`.
+// The socket is created in that namespace and stays there after return.
+func dialInNetNS(pid int, port uint16) (conn net.Conn, err error) {
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "netns.GetFromPid(%d) failed", pid)
+	}
+	defer ns.Close()
+
+	dial := func() error {
+		conn, err = net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second*5)
+		return err
+	}
+	if err := network.DoInNetNS(ns, dial); err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to port %d in network namespace of pid %d", port, pid)
+	}
+	return conn, nil
+}
+
+// PortForward dials the host on `vsockPort` and relays it to `127.0.0.1:port`
+// in the network namespace owned by `c`. It returns once both connections are
+// established; the stream then runs until both sides close or `c` is deleted.
+//
+// Only sandbox and standalone containers that own a network namespace support
+// port forwarding.
+func (c *Container) PortForward(ctx context.Context, port uint16, vsockPort uint32) (err error) {
+	ctx, span := trace.StartSpan(ctx, "opengcs::Container::PortForward")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(
+		trace.StringAttribute("cid", c.id),
+		trace.Int64Attribute("port", int64(port)),
+		trace.Int64Attribute("vsockPort", int64(vsockPort)))
+
+	if c.netNS == "" {
+		return gcserr.WrapHresult(errors.Errorf("container '%s' does not own a network namespace", c.id), gcserr.HrNotImpl)
+	}
+	ns, err := getNetworkNamespace(c.netNS)
+	if err != nil {
+		return err
+	}
+	pid := ns.ContainerPid()
+	if pid == 0 {
+		return errors.Errorf("network namespace '%s' is not assigned to a container", ns.ID())
+	}
+
+	containerConn, err := dialInNetNS(pid, port)
+	if err != nil {
+		return err
+	}
+	hostConn, err := c.vsock.Dial(vsockPort)
+	if err != nil {
+		containerConn.Close()
+		return errors.Wrapf(err, "failed to dial host port forward vsock port %d", vsockPort)
+	}
+	pf := &portForward{
+		host:      hostConn,
+		container: containerConn.(*net.TCPConn),
+	}
+
+	c.portForwardsMutex.Lock()
+	defer c.portForwardsMutex.Unlock()
+	if c.portForwardsClosed {
+		pf.Close()
+		return gcserr.WrapHresult(errors.Errorf("container '%s' is being deleted", c.id), gcserr.HrVmcomputeSystemNotFound)
+	}
+	c.portForwards[pf] = struct{}{}
+	c.portForwardsWg.Add(1)
+	go func() {
+		defer c.portForwardsWg.Done()
+		pf.relay(ctx)
+		c.portForwardsMutex.Lock()
+		delete(c.portForwards, pf)
+		c.portForwardsMutex.Unlock()
+	}()
+	return nil
+}
+
+// closePortForwards closes all active port forward streams of `c`, waits for
+// them to finish and prevents any new stream from being opened.
+func (c *Container) closePortForwards() {
+	c.portForwardsMutex.Lock()
+	c.portForwardsClosed = true
+	for pf := range c.portForwards {
+		pf.Close()
+	}
+	c.portForwardsMutex.Unlock()
+	c.portForwardsWg.Wait()
+}
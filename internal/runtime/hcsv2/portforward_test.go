@@ -0,0 +1,103 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a connected loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("failed to accept: %v", err)
+		}
+		accepted <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.FailNow()
+	}
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+func runRelay(pf *portForward) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		pf.relay(context.Background())
+		close(done)
+	}()
+	return done
+}
+
+func Test_portForward_relay_Bidirectional(t *testing.T) {
+	host, hostPeer := tcpPair(t)
+	container, containerPeer := tcpPair(t)
+	defer hostPeer.Close()
+	defer containerPeer.Close()
+
+	done := runRelay(&portForward{host: host, container: container})
+
+	if _, err := hostPeer.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write to host peer: %v", err)
+	}
+	hostPeer.CloseWrite()
+	b, err := ioutil.ReadAll(containerPeer)
+	if err != nil {
+		t.Fatalf("failed to read from container peer: %v", err)
+	}
+	if string(b) != "ping" {
+		t.Fatalf("expected container peer to read: 'ping' got: '%s'", b)
+	}
+
+	if _, err := containerPeer.Write([]byte("pong")); err != nil {
+		t.Fatalf("failed to write to container peer: %v", err)
+	}
+	containerPeer.CloseWrite()
+	b, err = ioutil.ReadAll(hostPeer)
+	if err != nil {
+		t.Fatalf("failed to read from host peer: %v", err)
+	}
+	if string(b) != "pong" {
+		t.Fatalf("expected host peer to read: 'pong' got: '%s'", b)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not finish after both sides closed")
+	}
+}
+
+func Test_portForward_Close_Unblocks_Relay(t *testing.T) {
+	host, hostPeer := tcpPair(t)
+	container, containerPeer := tcpPair(t)
+	defer hostPeer.Close()
+	defer containerPeer.Close()
+
+	pf := &portForward{host: host, container: container}
+	done := runRelay(pf)
+	pf.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not finish after close")
+	}
+}
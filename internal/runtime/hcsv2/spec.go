@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/Microsoft/opengcs/internal/network"
 	"github.com/opencontainers/runc/libcontainer/user"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
@@ -21,6 +22,45 @@ func getNetworkNamespaceID(spec *oci.Spec) string {
 	return ""
 }
 
+// getAssignedDevices returns the ids, the VMBus GUIDs of vpci devices, of the
+// devices in `spec.Windows.Devices`.
+func getAssignedDevices(spec *oci.Spec) []string {
+	if spec.Windows == nil {
+		return nil
+	}
+	var ids []string
+	for _, d := range spec.Windows.Devices {
+		ids = append(ids, d.ID)
+	}
+	return ids
+}
+
+const (
+	// annotationIngressBandwidth is the Kubernetes pod annotation limiting the
+	// rate of traffic received by the pod.
+	annotationIngressBandwidth = "kubernetes.io/ingress-bandwidth"
+	// annotationEgressBandwidth is the Kubernetes pod annotation limiting the
+	// rate of traffic sent by the pod.
+	annotationEgressBandwidth = "kubernetes.io/egress-bandwidth"
+)
+
+// getNetworkBandwidthLimits returns the traffic shaping limits requested by
+// the `kubernetes.io/ingress-bandwidth` and `kubernetes.io/egress-bandwidth`
+// annotations of `spec`.
+func getNetworkBandwidthLimits(spec *oci.Spec) (limits network.BandwidthLimits, err error) {
+	if v, ok := spec.Annotations[annotationIngressBandwidth]; ok {
+		if limits.IngressRate, err = network.ParseBandwidthQuantity(v); err != nil {
+			return limits, errors.Wrapf(err, "invalid '%s' annotation", annotationIngressBandwidth)
+		}
+	}
+	if v, ok := spec.Annotations[annotationEgressBandwidth]; ok {
+		if limits.EgressRate, err = network.ParseBandwidthQuantity(v); err != nil {
+			return limits, errors.Wrapf(err, "invalid '%s' annotation", annotationEgressBandwidth)
+		}
+	}
+	return limits, nil
+}
+
 // isRootReadonly returns `true` if the spec specifies the rootfs is readonly.
 func isRootReadonly(spec *oci.Spec) bool {
 	if spec.Root != nil {
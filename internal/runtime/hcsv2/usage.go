@@ -0,0 +1,197 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+)
+
+// Test dependencies
+var (
+	getFilesystemUsage = storage.GetFilesystemUsage
+	getDirectoryUsage  = storage.GetDirectoryUsage
+)
+
+// Kinds of storage usage that are not tracked by the `mountManager`.
+const (
+	mountKindWritableLayer = "WritableLayer"
+	mountKindSandboxMounts = "SandboxMounts"
+)
+
+func filesystemUsage(kind, path, containerPath string) (prot.FilesystemUsageV2, error) {
+	usage, err := getFilesystemUsage(path)
+	if err != nil {
+		return prot.FilesystemUsageV2{}, err
+	}
+	return prot.FilesystemUsageV2{
+		Kind:           kind,
+		Path:           path,
+		ContainerPath:  containerPath,
+		TotalBytes:     usage.TotalBytes,
+		UsedBytes:      usage.UsedBytes,
+		AvailableBytes: usage.AvailableBytes,
+		TotalInodes:    usage.TotalInodes,
+		UsedInodes:     usage.UsedInodes,
+		FreeInodes:     usage.FreeInodes,
+	}, nil
+}
+
+// sandboxMountsDirs returns the sandbox mounts directories of all the pods in
+// the UVM.
+func (h *Host) sandboxMountsDirs() []string {
+	h.containersMutex.Lock()
+	defer h.containersMutex.Unlock()
+
+	var dirs []string
+	for id, c := range h.containers {
+		if c.isSandbox {
+			dirs = append(dirs, getSandboxMountsDir(id))
+		}
+	}
+	return dirs
+}
+
+// GetStorageUsage returns the usage of the storage mounted for the UVM or the
+// container `containerID`. For the UVM that is every mount created by
+// `ModifySettings` and the sandbox mounts of every pod. For a container that
+// is its writable layer and every mount of its spec that is backed by such
+// storage.
+func (h *Host) GetStorageUsage(ctx context.Context, containerID string, query *prot.StorageUsageQueryV2) (_ *prot.StorageUsageV2, err error) {
+	ctx, span := trace.StartSpan(ctx, "hcsv2::GetStorageUsage")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(trace.StringAttribute("cid", containerID))
+
+	if query == nil {
+		query = &prot.StorageUsageQueryV2{}
+	}
+	mounts := h.mounts.list()
+	sandboxDirs := h.sandboxMountsDirs()
+	usage := &prot.StorageUsageV2{
+		Filesystems: []prot.FilesystemUsageV2{},
+	}
+
+	if containerID == UVMContainerID {
+		if query.WritableLayerDirectories {
+			return nil, gcserr.WrapHresult(errors.New("the UVM does not have a writable layer"), gcserr.HrInvalidArg)
+		}
+		for _, m := range mounts {
+			if m.Target == "" {
+				continue
+			}
+			fs, err := filesystemUsage(m.Kind, m.Target, "")
+			if err != nil {
+				return nil, err
+			}
+			usage.Filesystems = append(usage.Filesystems, fs)
+		}
+		for _, dir := range sandboxDirs {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				continue
+			}
+			fs, err := filesystemUsage(mountKindSandboxMounts, dir, "")
+			if err != nil {
+				return nil, err
+			}
+			usage.Filesystems = append(usage.Filesystems, fs)
+		}
+		return usage, nil
+	}
+
+	c, err := h.GetContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	upperdir := ""
+	if c.spec.Root != nil {
+		if l, ok := h.writableLayers.get(c.spec.Root.Path); ok {
+			upperdir = l.upperdir
+		}
+	}
+	if upperdir != "" {
+		fs, err := filesystemUsage(mountKindWritableLayer, upperdir, "/")
+		if err != nil {
+			return nil, err
+		}
+		usage.Filesystems = append(usage.Filesystems, fs)
+	}
+	for _, m := range c.spec.Mounts {
+		kind := ""
+		for _, hm := range mounts {
+			if hm.Target != "" && storage.IsUnder(m.Source, hm.Target) {
+				kind = hm.Kind
+				break
+			}
+		}
+		if kind == "" {
+			for _, dir := range sandboxDirs {
+				if storage.IsUnder(m.Source, dir) {
+					kind = mountKindSandboxMounts
+					break
+				}
+			}
+		}
+		if kind == "" {
+			continue
+		}
+		fs, err := filesystemUsage(kind, m.Source, m.Destination)
+		if err != nil {
+			return nil, err
+		}
+		usage.Filesystems = append(usage.Filesystems, fs)
+	}
+
+	if query.WritableLayerDirectories && upperdir != "" {
+		entries, err := ioutil.ReadDir(upperdir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			bytes, inodes, err := getDirectoryUsage(ctx, filepath.Join(upperdir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			usage.WritableLayer = append(usage.WritableLayer, prot.DirectoryUsageV2{
+				Path:       "/" + entry.Name(),
+				UsedBytes:  bytes,
+				UsedInodes: inodes,
+			})
+		}
+	}
+	return usage, nil
+}
+
+// GetScratchUsage returns the usage of the size limited scratch of the
+// container `containerID` or `nil` if its scratch is not limited.
+func (h *Host) GetScratchUsage(ctx context.Context, containerID string) (*prot.ScratchUsageV2, error) {
+	c, err := h.GetContainer(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if c.spec.Root == nil {
+		return nil, nil
+	}
+	l, ok := h.writableLayers.get(c.spec.Root.Path)
+	if !ok || l.scratch == nil {
+		return nil, nil
+	}
+	used, err := l.scratch.Usage()
+	if err != nil {
+		return nil, err
+	}
+	return &prot.ScratchUsageV2{
+		LimitInBytes: l.scratch.Limit,
+		UsedInBytes:  used,
+	}, nil
+}
@@ -0,0 +1,115 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_GetStorageUsage(t *testing.T) {
+	defer func() {
+		getFilesystemUsage = storage.GetFilesystemUsage
+		getDirectoryUsage = storage.GetDirectoryUsage
+	}()
+	getFilesystemUsage = func(path string) (*storage.FilesystemUsage, error) {
+		return &storage.FilesystemUsage{TotalBytes: 100, UsedBytes: 10, TotalInodes: 20, UsedInodes: 2}, nil
+	}
+	getDirectoryUsage = func(ctx context.Context, path string) (uint64, uint64, error) {
+		return 4096, 1, nil
+	}
+
+	upperdir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(upperdir)
+	if err := os.Mkdir(filepath.Join(upperdir, "var"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	rootPath := "/run/gcs/c/test/rootfs"
+	h := &Host{
+		containers:     make(map[string]*Container),
+		mounts:         newMountManager(),
+		writableLayers: newWritableLayers(),
+	}
+	h.writableLayers.set(rootPath, writableLayer{upperdir: upperdir})
+	h.mounts.mounts[mountKey{kind: mountKindSCSI, device: "0/1", target: "/run/mounts/m1"}] = &mountEntry{refs: 1}
+	h.mounts.mounts[mountKey{kind: mountKindSCSI, device: "0/2"}] = &mountEntry{refs: 1}
+	h.containers["test"] = &Container{
+		id: "test",
+		spec: &oci.Spec{
+			Root: &oci.Root{Path: rootPath},
+			Mounts: []oci.Mount{
+				{Source: "/run/mounts/m1/data", Destination: "/data"},
+				{Source: "/run/gcs/c/sandbox/sandboxMounts/cache", Destination: "/cache"},
+				{Source: "proc", Destination: "/proc"},
+			},
+		},
+	}
+	h.containers["sandbox"] = &Container{id: "sandbox", isSandbox: true}
+
+	usage, err := h.GetStorageUsage(context.Background(), "test", &prot.StorageUsageQueryV2{WritableLayerDirectories: true})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expected := []struct{ kind, path, containerPath string }{
+		{mountKindWritableLayer, upperdir, "/"},
+		{mountKindSCSI, "/run/mounts/m1/data", "/data"},
+		{mountKindSandboxMounts, "/run/gcs/c/sandbox/sandboxMounts/cache", "/cache"},
+	}
+	if len(usage.Filesystems) != len(expected) {
+		t.Fatalf("expected %d filesystems got: %+v", len(expected), usage.Filesystems)
+	}
+	for i, e := range expected {
+		fs := usage.Filesystems[i]
+		if fs.Kind != e.kind || fs.Path != e.path || fs.ContainerPath != e.containerPath || fs.UsedBytes != 10 || fs.UsedInodes != 2 {
+			t.Fatalf("%d: unexpected filesystem usage: %+v", i, fs)
+		}
+	}
+	if len(usage.WritableLayer) != 1 || usage.WritableLayer[0].Path != "/var" || usage.WritableLayer[0].UsedBytes != 4096 {
+		t.Fatalf("unexpected writable layer usage: %+v", usage.WritableLayer)
+	}
+
+	// Only mounted SCSI disks are reported for the UVM. The sandbox mounts
+	// directory of the pod does not exist.
+	usage, err = h.GetStorageUsage(context.Background(), UVMContainerID, nil)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(usage.Filesystems) != 1 || usage.Filesystems[0].Path != "/run/mounts/m1" {
+		t.Fatalf("unexpected UVM filesystems: %+v", usage.Filesystems)
+	}
+
+	_, err = h.GetStorageUsage(context.Background(), UVMContainerID, &prot.StorageUsageQueryV2{WritableLayerDirectories: true})
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrInvalidArg {
+		t.Fatalf("expected HrInvalidArg got: %v", err)
+	}
+}
+
+func Test_GetScratchUsage_NotLimited(t *testing.T) {
+	rootPath := "/run/gcs/c/test/rootfs"
+	h := &Host{
+		containers:     make(map[string]*Container),
+		writableLayers: newWritableLayers(),
+	}
+	h.writableLayers.set(rootPath, writableLayer{upperdir: "/run/gcs/c/test/scratch/upper"})
+	h.containers["test"] = &Container{id: "test", spec: &oci.Spec{Root: &oci.Root{Path: rootPath}}}
+
+	usage, err := h.GetScratchUsage(context.Background(), "test")
+	if err != nil || usage != nil {
+		t.Fatalf("expected no usage for an unlimited scratch got: %+v, %v", usage, err)
+	}
+	if _, err := h.GetScratchUsage(context.Background(), "missing"); err == nil {
+		t.Fatal("expected error for a missing container")
+	}
+}
@@ -11,16 +11,22 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/Microsoft/opengcs/internal/storage/overlay"
 	"github.com/Microsoft/opengcs/internal/storage/pci"
 	"github.com/Microsoft/opengcs/internal/storage/plan9"
 	"github.com/Microsoft/opengcs/internal/storage/pmem"
+	"github.com/Microsoft/opengcs/internal/storage/quota"
 	"github.com/Microsoft/opengcs/internal/storage/scsi"
+	"github.com/Microsoft/opengcs/internal/storage/virtiofs"
+	"github.com/Microsoft/opengcs/internal/storage/vmbus"
 	"github.com/Microsoft/opengcs/service/gcs/gcserr"
 	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/Microsoft/opengcs/service/gcs/runtime"
@@ -34,6 +40,14 @@ import (
 // for V2 where the specific message is targeted at the UVM itself.
 const UVMContainerID = "00000000-0000-0000-0000-000000000000"
 
+// scsiFormatTimeout is how long the add of a SCSI disk that may be formatted
+// waits for it to be mounted.
+const scsiFormatTimeout = 2 * time.Minute
+
+// vpciRemoveTimeout is how long the removal of a vpci device waits for the
+// host to remove it from the vmbus.
+const vpciRemoveTimeout = 30 * time.Second
+
 // Host is the structure tracking all UVM host state including all containers
 // and processes.
 type Host struct {
@@ -43,6 +57,18 @@ type Host struct {
 	externalProcessesMutex sync.Mutex
 	externalProcesses      map[int]*externalProcess
 
+	// mounts tracks the storage mounted by `ModifySettings`.
+	mounts *mountManager
+	// writableLayers tracks the writable layers of the container root
+	// filesystems mounted by `ModifySettings`.
+	writableLayers *writableLayers
+	// overlayFeatures are the optional overlay features supported by the
+	// kernel, detected once at startup.
+	overlayFeatures overlay.Features
+	// virtioFSSupported is true if the kernel supports virtio-fs mapped
+	// directories.
+	virtioFSSupported bool
+
 	// Rtime is the Runtime interface used by the GCS core.
 	rtime runtime.Runtime
 	vsock transport.Transport
@@ -52,6 +78,10 @@ func NewHost(rtime runtime.Runtime, vsock transport.Transport) *Host {
 	return &Host{
 		containers:        make(map[string]*Container),
 		externalProcesses: make(map[int]*externalProcess),
+		mounts:            newMountManager(),
+		writableLayers:    newWritableLayers(),
+		overlayFeatures:   overlay.DetectFeatures(),
+		virtioFSSupported: virtiofs.Supported(),
 		rtime:             rtime,
 		vsock:             vsock,
 	}
@@ -96,6 +126,9 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 		return nil, gcserr.NewHresultError(gcserr.HrVmcomputeSystemAlreadyExists)
 	}
 
+	// Capture the assigned devices because the container setup clears the
+	// Windows section.
+	assignedDevices := getAssignedDevices(settings.OCISpecification)
 	var namespaceID string
 	criType, isCRI := settings.OCISpecification.Annotations["io.kubernetes.cri.container-type"]
 	if isCRI {
@@ -166,9 +199,12 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 		vsock:     h.vsock,
 		spec:      settings.OCISpecification,
 		isSandbox: criType == "sandbox",
+		devices:   assignedDevices,
 		container: con,
 		exitType:  prot.NtUnexpectedExit,
 		processes: make(map[uint32]*containerProcess),
+
+		portForwards: make(map[*portForward]struct{}),
 	}
 	c.initProcess = newProcess(c, settings.OCISpecification.Process, con.(runtime.Process), uint32(c.container.Pid()), true)
 
@@ -180,12 +216,20 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 		}
 		// standalone is not required to have a networking namespace setup
 		if ns != nil {
+			limits, err := getNetworkBandwidthLimits(settings.OCISpecification)
+			if err != nil {
+				return nil, gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+			}
+			if err := ns.SetBandwidth(ctx, limits); err != nil {
+				return nil, err
+			}
 			if err := ns.AssignContainerPid(ctx, c.container.Pid()); err != nil {
 				return nil, err
 			}
 			if err := ns.Sync(ctx); err != nil {
 				return nil, err
 			}
+			c.netNS = ns.ID()
 		}
 	}
 
@@ -196,17 +240,32 @@ func (h *Host) CreateContainer(ctx context.Context, id string, settings *prot.VM
 func (h *Host) modifyHostSettings(ctx context.Context, containerID string, settings *prot.ModifySettingRequest) error {
 	switch settings.ResourceType {
 	case prot.MrtMappedVirtualDisk:
-		return modifyMappedVirtualDisk(ctx, settings.RequestType, settings.Settings.(*prot.MappedVirtualDiskV2))
+		mvd := settings.Settings.(*prot.MappedVirtualDiskV2)
+		return h.mounts.modify(ctx, settings.RequestType, scsiMountKey(mvd), scsiMountSettings(mvd), func() error {
+			_, err := modifyMappedVirtualDisk(ctx, settings.RequestType, mvd)
+			return err
+		})
 	case prot.MrtMappedDirectory:
-		return modifyMappedDirectory(ctx, h.vsock, settings.RequestType, settings.Settings.(*prot.MappedDirectoryV2))
+		md := settings.Settings.(*prot.MappedDirectoryV2)
+		return h.mounts.modify(ctx, settings.RequestType, mappedDirectoryMountKey(md), *md, func() error {
+			return modifyMappedDirectory(ctx, h.vsock, settings.RequestType, md, h.virtioFSSupported)
+		})
 	case prot.MrtVPMemDevice:
-		return modifyMappedVPMemDevice(ctx, settings.RequestType, settings.Settings.(*prot.MappedVPMemDeviceV2))
+		vpd := settings.Settings.(*prot.MappedVPMemDeviceV2)
+		return h.mounts.modify(ctx, settings.RequestType, vpmemMountKey(vpd), *vpd, func() error {
+			return modifyMappedVPMemDevice(ctx, settings.RequestType, vpd)
+		})
 	case prot.MrtCombinedLayers:
-		return modifyCombinedLayers(ctx, settings.RequestType, settings.Settings.(*prot.CombinedLayersV2))
+		cl := settings.Settings.(*prot.CombinedLayersV2)
+		return h.mounts.modify(ctx, settings.RequestType, overlayMountKey(cl), *cl, func() error {
+			return modifyCombinedLayers(ctx, settings.RequestType, cl, h.overlayFeatures, h.writableLayers)
+		})
 	case prot.MrtNetwork:
 		return modifyNetwork(ctx, settings.RequestType, settings.Settings.(*prot.NetworkAdapterV2))
+	case prot.MrtNetworkPolicy:
+		return modifyNetworkPolicy(ctx, settings.RequestType, settings.Settings.(*prot.NetworkPolicyV2))
 	case prot.MrtVPCIDevice:
-		return modifyMappedVPCIDevice(ctx, settings.RequestType, settings.Settings.(*prot.MappedVPCIDeviceV2))
+		return h.modifyMappedVPCIDevice(ctx, settings.RequestType, settings.Settings.(*prot.MappedVPCIDeviceV2))
 	case prot.MrtContainerConstraints:
 		c, err := h.GetContainer(containerID)
 		if err != nil {
@@ -232,11 +291,96 @@ func (h *Host) modifyContainerSettings(ctx context.Context, containerID string,
 	}
 }
 
-func (h *Host) ModifySettings(ctx context.Context, containerID string, settings *prot.ModifySettingRequest) error {
+// ModifySettings applies `settings` to the UVM or the container `containerID`.
+// The response is nil unless the request has a result.
+func (h *Host) ModifySettings(ctx context.Context, containerID string, settings *prot.ModifySettingRequest) (*prot.ModifySettingResponse, error) {
 	if containerID == UVMContainerID {
-		return h.modifyHostSettings(ctx, containerID, settings)
+		if settings.ResourceType == prot.MrtMappedVirtualDisk {
+			switch settings.RequestType {
+			case prot.MreqtAdd:
+				return h.addMappedVirtualDisk(ctx, settings.Settings.(*prot.MappedVirtualDiskV2))
+			case prot.MreqtUpdate:
+				return h.resizeMappedVirtualDisk(ctx, settings.Settings.(*prot.MappedVirtualDiskV2))
+			}
+		}
+		return nil, h.modifyHostSettings(ctx, containerID, settings)
+	}
+	return nil, h.modifyContainerSettings(ctx, containerID, settings)
+}
+
+// addMappedVirtualDisk mounts the SCSI disk `mvd`. The response holds the
+// result of the filesystem check if one was requested and the disk was not
+// already mounted.
+func (h *Host) addMappedVirtualDisk(ctx context.Context, mvd *prot.MappedVirtualDiskV2) (*prot.ModifySettingResponse, error) {
+	var result *storage.FilesystemCheckResult
+	err := h.mounts.modify(ctx, prot.MreqtAdd, scsiMountKey(mvd), scsiMountSettings(mvd), func() (err error) {
+		result, err = modifyMappedVirtualDisk(ctx, prot.MreqtAdd, mvd)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return h.modifyContainerSettings(ctx, containerID, settings)
+	if result == nil {
+		return nil, nil
+	}
+	return &prot.ModifySettingResponse{
+		FilesystemCheck: &prot.FilesystemCheckV2{
+			Repaired: result.Repaired,
+			Output:   result.Output,
+		},
+	}, nil
+}
+
+// resizeMappedVirtualDisk grows the filesystem mounted from the SCSI disk
+// `mvd` to the current capacity of the disk after it was expanded on the host.
+// The disk must be mounted and is resized with the encryption and verity
+// settings it was mounted with.
+func (h *Host) resizeMappedVirtualDisk(ctx context.Context, mvd *prot.MappedVirtualDiskV2) (*prot.ModifySettingResponse, error) {
+	if mvd.MountPath == "" {
+		return nil, gcserr.WrapHresult(errors.New("resizing a disk requires a mount path"), gcserr.HrInvalidArg)
+	}
+	var size prot.DiskSizeV2
+	err := h.mounts.update(scsiMountKey(mvd), func(settings interface{}) (err error) {
+		mounted := settings.(prot.MappedVirtualDiskV2)
+		if (mvd.Encryption != nil && !reflect.DeepEqual(mvd.Encryption, mounted.Encryption)) ||
+			(mvd.VerityInfo != nil && !reflect.DeepEqual(mvd.VerityInfo, mounted.VerityInfo)) {
+			return gcserr.WrapHresult(errors.New("the encryption and verity settings of a resize must match the mount"), gcserr.HrInvalidArg)
+		}
+		if mounted.ReadOnly {
+			return gcserr.WrapHresult(errors.New("resizing a readonly disk is not supported"), gcserr.HrInvalidArg)
+		}
+		if mounted.VerityInfo != nil {
+			return gcserr.WrapHresult(errors.New("resizing a verity disk is not supported"), gcserr.HrNotImpl)
+		}
+		if mounted.Encryption != nil && mounted.Encryption.Key == "" {
+			return gcserr.WrapHresult(errors.New("resizing a disk encrypted with an ephemeral key is not supported"), gcserr.HrNotImpl)
+		}
+		resizeCtx, cancel := context.WithTimeout(ctx, time.Second*4)
+		defer cancel()
+		size.DeviceSizeInBytes, size.FilesystemSizeInBytes, err = scsi.Resize(resizeCtx, mvd.Controller, mvd.Lun, mvd.MountPath, mounted.Encryption)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &prot.ModifySettingResponse{DiskSize: &size}, nil
+}
+
+// Mounts returns the storage mounted in the UVM by `ModifySettings` and how many
+// times each mount was added.
+func (h *Host) Mounts() []prot.MountV2 {
+	return h.mounts.list()
+}
+
+// VirtioFSSupported returns true if mapped directories can use virtio-fs.
+func (h *Host) VirtioFSSupported() bool {
+	return h.virtioFSSupported
+}
+
+// SupportedOverlayOptions returns the names of the optional overlay features
+// supported by the kernel.
+func (h *Host) SupportedOverlayOptions() []string {
+	return h.overlayFeatures.Names()
 }
 
 // Shutdown terminates this UVM. This is a destructive call and will destroy all
@@ -349,31 +493,94 @@ func newInvalidRequestTypeError(rt prot.ModifyRequestType) error {
 	return errors.Errorf("the RequestType \"%s\" is not supported", rt)
 }
 
-func modifyMappedVirtualDisk(ctx context.Context, rt prot.ModifyRequestType, mvd *prot.MappedVirtualDiskV2) (err error) {
+func modifyMappedVirtualDisk(ctx context.Context, rt prot.ModifyRequestType, mvd *prot.MappedVirtualDiskV2) (*storage.FilesystemCheckResult, error) {
 	switch rt {
 	case prot.MreqtAdd:
-		mountCtx, cancel := context.WithTimeout(ctx, time.Second*4)
+		timeout := time.Second * 4
+		if mvd.FormatIfBlank || mvd.Encryption != nil || mvd.CheckFilesystem {
+			// Formatting or checking a disk takes longer than finding it.
+			timeout = scsiFormatTimeout
+		}
+		mountCtx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 		if mvd.MountPath != "" {
-			return scsi.Mount(mountCtx, mvd.Controller, mvd.Lun, mvd.MountPath, mvd.ReadOnly, mvd.Options)
+			opts := scsi.MountOptions{
+				FsType:          mvd.Filesystem,
+				Options:         mvd.Options,
+				Encryption:      mvd.Encryption,
+				VerityInfo:      mvd.VerityInfo,
+				FormatIfBlank:   mvd.FormatIfBlank,
+				CheckFilesystem: mvd.CheckFilesystem,
+			}
+			result, err := scsi.Mount(mountCtx, mvd.Controller, mvd.Lun, mvd.MountPath, mvd.ReadOnly, opts)
+			if err != nil {
+				switch errors.Cause(err).(type) {
+				case *scsi.InvalidOptionsError:
+					return nil, gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+				case *storage.CorruptFilesystemError:
+					return nil, gcserr.WrapHresult(err, gcserr.HrErrDiskCorrupt)
+				}
+				return nil, err
+			}
+			return result, nil
 		}
-		return nil
+		if mvd.Encryption != nil || mvd.VerityInfo != nil || mvd.FormatIfBlank || mvd.CheckFilesystem {
+			return nil, gcserr.WrapHresult(errors.New("encryption, verity, format if blank and filesystem checks require a mount path"), gcserr.HrInvalidArg)
+		}
+		return nil, nil
 	case prot.MreqtRemove:
+		if err := scsi.ValidateBusyPolicy(mvd.BusyPolicy, mvd.Encryption, mvd.VerityInfo); err != nil {
+			return nil, gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+		}
+		removeCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+		defer cancel()
 		if mvd.MountPath != "" {
-			if err := storage.UnmountPath(ctx, mvd.MountPath, true); err != nil {
-				return err
+			if err := scsi.Unmount(removeCtx, mvd.Controller, mvd.Lun, mvd.MountPath, mvd.Encryption, mvd.VerityInfo, mvd.BusyPolicy); err != nil {
+				if _, ok := errors.Cause(err).(*storage.BusyError); ok {
+					return nil, gcserr.WrapHresult(err, gcserr.HrErrBusy)
+				}
+				return nil, err
 			}
 		}
-		return scsi.UnplugDevice(ctx, mvd.Controller, mvd.Lun)
+		return nil, scsi.UnplugDevice(removeCtx, mvd.Controller, mvd.Lun)
 	default:
-		return newInvalidRequestTypeError(rt)
+		return nil, newInvalidRequestTypeError(rt)
 	}
 }
 
-func modifyMappedDirectory(ctx context.Context, vsock transport.Transport, rt prot.ModifyRequestType, md *prot.MappedDirectoryV2) (err error) {
+func modifyMappedDirectory(ctx context.Context, vsock transport.Transport, rt prot.ModifyRequestType, md *prot.MappedDirectoryV2, virtioFSSupported bool) (err error) {
 	switch rt {
 	case prot.MreqtAdd:
-		return plan9.Mount(ctx, vsock, md.MountPath, md.ShareName, md.Port, md.ReadOnly)
+		switch md.Transport {
+		case "", prot.MdtPlan9:
+			var options *plan9.Options
+			if md.Plan9 != nil {
+				options = &plan9.Options{
+					Msize:      md.Plan9.Msize,
+					Cache:      md.Plan9.Cache,
+					Access:     md.Plan9.Access,
+					DefaultUID: md.Plan9.DefaultUID,
+					DefaultGID: md.Plan9.DefaultGID,
+				}
+				if err := options.Validate(); err != nil {
+					return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+				}
+			}
+			return plan9.Mount(ctx, vsock, md.MountPath, md.ShareName, md.Port, md.ReadOnly, options)
+		case prot.MdtVirtioFS:
+			if md.VirtioFS == nil || md.VirtioFS.Tag == "" {
+				return gcserr.WrapHresult(errors.New("a virtio-fs mapped directory requires a tag"), gcserr.HrInvalidArg)
+			}
+			if err := virtiofs.ValidateDAX(md.VirtioFS.DAX); err != nil {
+				return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+			}
+			if !virtioFSSupported {
+				return gcserr.WrapHresult(errors.New("virtio-fs is not supported by the kernel"), gcserr.HrNotImpl)
+			}
+			return virtiofs.Mount(ctx, md.VirtioFS.Tag, md.MountPath, md.ReadOnly, md.VirtioFS.DAX)
+		default:
+			return gcserr.WrapHresult(errors.Errorf("invalid mapped directory transport: %s", md.Transport), gcserr.HrInvalidArg)
+		}
 	case prot.MreqtRemove:
 		return storage.UnmountPath(ctx, md.MountPath, true)
 	default:
@@ -384,7 +591,7 @@ func modifyMappedDirectory(ctx context.Context, vsock transport.Transport, rt pr
 func modifyMappedVPMemDevice(ctx context.Context, rt prot.ModifyRequestType, vpd *prot.MappedVPMemDeviceV2) (err error) {
 	switch rt {
 	case prot.MreqtAdd:
-		return pmem.Mount(ctx, vpd.DeviceNumber, vpd.MountPath, vpd.MappingInfo, vpd.VerityInfo)
+		return pmem.Mount(ctx, vpd.DeviceNumber, vpd.MountPath, vpd.Filesystem, vpd.MappingInfo, vpd.VerityInfo)
 	case prot.MreqtRemove:
 		return pmem.Unmount(ctx, vpd.DeviceNumber, vpd.MountPath, vpd.MappingInfo, vpd.VerityInfo)
 	default:
@@ -392,18 +599,125 @@ func modifyMappedVPMemDevice(ctx context.Context, rt prot.ModifyRequestType, vpd
 	}
 }
 
-func modifyMappedVPCIDevice(ctx context.Context, rt prot.ModifyRequestType, vpciDev *prot.MappedVPCIDeviceV2) error {
+// vpciDeviceUser returns the id of a container that was assigned the vpci
+// device `vmBusGUID`, if any.
+func (h *Host) vpciDeviceUser(vmBusGUID string) (string, bool) {
+	h.containersMutex.Lock()
+	defer h.containersMutex.Unlock()
+
+	for id, c := range h.containers {
+		for _, d := range c.devices {
+			if strings.EqualFold(d, vmBusGUID) {
+				return id, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (h *Host) modifyMappedVPCIDevice(ctx context.Context, rt prot.ModifyRequestType, vpciDev *prot.MappedVPCIDeviceV2) error {
 	switch rt {
 	case prot.MreqtAdd:
-		return pci.WaitForPCIDeviceFromVMBusGUID(ctx, vpciDev.VMBusGUID)
+		if vpciDev.Driver == "" {
+			return pci.WaitForPCIDeviceFromVMBusGUID(ctx, vpciDev.VMBusGUID)
+		}
+		busLocation, err := pci.FindDeviceBusLocationFromVMBusGUID(ctx, vpciDev.VMBusGUID)
+		if err != nil {
+			return err
+		}
+		return pci.BindDriver(ctx, busLocation, vpciDev.Driver)
+	case prot.MreqtRemove:
+		if id, ok := h.vpciDeviceUser(vpciDev.VMBusGUID); ok {
+			return errors.Errorf("vpci device %s is still assigned to container %s", vpciDev.VMBusGUID, id)
+		}
+		// The host may have removed the device already.
+		if vmbus.DeviceExists(vpciDev.VMBusGUID) {
+			busLocation, err := pci.FindDeviceBusLocationFromVMBusGUID(ctx, vpciDev.VMBusGUID)
+			if err != nil {
+				return err
+			}
+			if err := pci.UnbindDriver(ctx, busLocation); err != nil {
+				return err
+			}
+		}
+		ctx, cancel := context.WithTimeout(ctx, vpciRemoveTimeout)
+		defer cancel()
+		return vmbus.WaitForDeviceRemoval(ctx, vpciDev.VMBusGUID)
 	default:
 		return newInvalidRequestTypeError(rt)
 	}
 }
 
-func modifyCombinedLayers(ctx context.Context, rt prot.ModifyRequestType, cl *prot.CombinedLayersV2) (err error) {
+// writableLayer is the writable layer of a container root filesystem.
+type writableLayer struct {
+	// upperdir is the overlay upper directory.
+	upperdir string
+	// scratch is the size limited scratch or `nil` if the scratch is not
+	// limited.
+	scratch *quota.Scratch
+}
+
+// writableLayers tracks the writable layers of the container root filesystems
+// mounted by `modifyCombinedLayers` by container root path.
+type writableLayers struct {
+	mu     sync.Mutex
+	layers map[string]writableLayer
+}
+
+func newWritableLayers() *writableLayers {
+	return &writableLayers{
+		layers: make(map[string]writableLayer),
+	}
+}
+
+// get returns the writable layer of the container with root path `rootPath`.
+// Returns false if its root filesystem is not writable.
+func (wl *writableLayers) get(rootPath string) (writableLayer, bool) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	l, ok := wl.layers[rootPath]
+	return l, ok
+}
+
+func (wl *writableLayers) set(rootPath string, l writableLayer) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	wl.layers[rootPath] = l
+}
+
+func (wl *writableLayers) remove(rootPath string) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+
+	delete(wl.layers, rootPath)
+}
+
+// tmpfsScratchPath returns the path the tmpfs scratch of the container with
+// root path `rootPath` is mounted at.
+func tmpfsScratchPath(rootPath string) string {
+	return filepath.Clean(rootPath) + "-scratch"
+}
+
+func modifyCombinedLayers(ctx context.Context, rt prot.ModifyRequestType, cl *prot.CombinedLayersV2, features overlay.Features, layers *writableLayers) (err error) {
 	switch rt {
 	case prot.MreqtAdd:
+		var options *overlay.Options
+		if cl.OverlayOptions != nil {
+			options = &overlay.Options{
+				Index:       cl.OverlayOptions.Index,
+				Metacopy:    cl.OverlayOptions.Metacopy,
+				RedirectDir: cl.OverlayOptions.RedirectDir,
+				Volatile:    cl.OverlayOptions.Volatile,
+			}
+			if err := options.Validate(); err != nil {
+				return gcserr.WrapHresult(err, gcserr.HrInvalidArg)
+			}
+			if err := features.Check(options); err != nil {
+				return gcserr.WrapHresult(err, gcserr.HrNotImpl)
+			}
+		}
 		layerPaths := make([]string, len(cl.Layers))
 		for i, layer := range cl.Layers {
 			layerPaths[i] = layer.Path
@@ -411,18 +725,70 @@ func modifyCombinedLayers(ctx context.Context, rt prot.ModifyRequestType, cl *pr
 
 		var upperdirPath string
 		var workdirPath string
+		var scratch *quota.Scratch
 		readonly := false
 		if cl.ScratchPath == "" {
-			// The user did not pass a scratch path. Mount overlay as readonly.
-			readonly = true
+			if cl.ScratchSizeInBytes != 0 {
+				return gcserr.WrapHresult(errors.New("a scratch size requires a scratch path"), gcserr.HrInvalidArg)
+			}
+			if cl.TmpfsScratchSizeInBytes == 0 {
+				// The user did not pass a scratch path. Mount overlay as readonly.
+				readonly = true
+			} else {
+				scratch, err = quota.NewTmpfsScratch(ctx, tmpfsScratchPath(cl.ContainerRootPath), cl.TmpfsScratchSizeInBytes)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if err != nil {
+						if err := scratch.Remove(ctx); err != nil {
+							log.G(ctx).WithError(err).Debugf("failed to cleanup scratch: %s", scratch.Path)
+						}
+					}
+				}()
+				upperdirPath = filepath.Join(scratch.Path, "upper")
+				workdirPath = filepath.Join(scratch.Path, "work")
+			}
+		} else if cl.TmpfsScratchSizeInBytes != 0 {
+			return gcserr.WrapHresult(errors.New("a tmpfs scratch cannot be used with a scratch path"), gcserr.HrInvalidArg)
 		} else {
-			upperdirPath = filepath.Join(cl.ScratchPath, "upper")
-			workdirPath = filepath.Join(cl.ScratchPath, "work")
+			scratchPath := cl.ScratchPath
+			if cl.ScratchSizeInBytes != 0 {
+				scratch, err = quota.NewScratch(ctx, cl.ScratchPath, cl.ScratchSizeInBytes)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if err != nil {
+						if err := scratch.Remove(ctx); err != nil {
+							log.G(ctx).WithError(err).Debugf("failed to cleanup scratch: %s", scratch.Path)
+						}
+					}
+				}()
+				scratchPath = scratch.Path
+			}
+			upperdirPath = filepath.Join(scratchPath, "upper")
+			workdirPath = filepath.Join(scratchPath, "work")
 		}
 
-		return overlay.Mount(ctx, layerPaths, upperdirPath, workdirPath, cl.ContainerRootPath, readonly)
+		if err := overlay.Mount(ctx, layerPaths, upperdirPath, workdirPath, cl.ContainerRootPath, readonly, options); err != nil {
+			return err
+		}
+		if !readonly {
+			layers.set(cl.ContainerRootPath, writableLayer{upperdir: upperdirPath, scratch: scratch})
+		}
+		return nil
 	case prot.MreqtRemove:
-		return storage.UnmountPath(ctx, cl.ContainerRootPath, true)
+		if err := overlay.Unmount(ctx, cl.ContainerRootPath); err != nil {
+			return err
+		}
+		if l, ok := layers.get(cl.ContainerRootPath); ok && l.scratch != nil {
+			if err := l.scratch.Remove(ctx); err != nil {
+				return err
+			}
+		}
+		layers.remove(cl.ContainerRootPath)
+		return nil
 	default:
 		return newInvalidRequestTypeError(rt)
 	}
@@ -439,11 +805,43 @@ func modifyNetwork(ctx context.Context, rt prot.ModifyRequestType, na *prot.Netw
 		// container or not so it must always call `Sync`.
 		return ns.Sync(ctx)
 	case prot.MreqtRemove:
-		ns := getOrAddNetworkNamespace(na.ID)
-		if err := ns.RemoveAdapter(ctx, na.ID); err != nil {
+		ns, err := getNetworkNamespace(na.NamespaceID)
+		if err != nil {
+			// The namespace was already released when its container was
+			// deleted, along with all of its adapters.
+			return nil
+		}
+		return ns.RemoveAdapter(ctx, na.ID)
+	case prot.MreqtUpdate:
+		ns, err := getNetworkNamespace(na.NamespaceID)
+		if err != nil {
 			return err
 		}
-		return nil
+		return ns.UpdateAdapter(ctx, na)
+	default:
+		return newInvalidRequestTypeError(rt)
+	}
+}
+
+func modifyNetworkPolicy(ctx context.Context, rt prot.ModifyRequestType, np *prot.NetworkPolicyV2) (err error) {
+	switch rt {
+	case prot.MreqtAdd:
+		ns := getOrAddNetworkNamespace(np.NamespaceID)
+		return ns.AddPolicy(ctx, np)
+	case prot.MreqtUpdate:
+		ns, err := getNetworkNamespace(np.NamespaceID)
+		if err != nil {
+			return err
+		}
+		return ns.UpdatePolicy(ctx, np)
+	case prot.MreqtRemove:
+		ns, err := getNetworkNamespace(np.NamespaceID)
+		if err != nil {
+			// The namespace was already released when its container was
+			// deleted, along with its policy.
+			return nil
+		}
+		return ns.RemovePolicy(ctx)
 	default:
 		return newInvalidRequestTypeError(rt)
 	}
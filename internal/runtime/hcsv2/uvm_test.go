@@ -0,0 +1,150 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Microsoft/opengcs/internal/storage/overlay"
+	"github.com/Microsoft/opengcs/service/gcs/gcserr"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_modifyCombinedLayers_Invalid_Scratch(t *testing.T) {
+	tests := []*prot.CombinedLayersV2{
+		{
+			ContainerRootPath:  "/run/gcs/c/test/rootfs",
+			ScratchSizeInBytes: 1024 * 1024,
+		},
+		{
+			ContainerRootPath:       "/run/gcs/c/test/rootfs",
+			ScratchPath:             "/run/gcs/c/test/scratch",
+			TmpfsScratchSizeInBytes: 1024 * 1024,
+		},
+	}
+	for _, cl := range tests {
+		err := modifyCombinedLayers(context.Background(), prot.MreqtAdd, cl, overlay.Features{}, newWritableLayers())
+		if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrInvalidArg {
+			t.Fatalf("%+v: expected HrInvalidArg got: %v", cl, err)
+		}
+	}
+}
+
+func Test_modifyCombinedLayers_Unsupported_Overlay_Options(t *testing.T) {
+	cl := &prot.CombinedLayersV2{
+		ContainerRootPath: "/run/gcs/c/test/rootfs",
+		ScratchPath:       "/run/gcs/c/test/scratch",
+		OverlayOptions: &prot.OverlayOptionsV2{
+			Metacopy: "on",
+			Volatile: true,
+		},
+	}
+	err := modifyCombinedLayers(context.Background(), prot.MreqtAdd, cl, overlay.Features{Metacopy: true}, newWritableLayers())
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrNotImpl {
+		t.Fatalf("expected HrNotImpl got: %v", err)
+	}
+
+	cl.OverlayOptions = &prot.OverlayOptionsV2{Metacopy: "yes"}
+	err = modifyCombinedLayers(context.Background(), prot.MreqtAdd, cl, overlay.Features{Metacopy: true}, newWritableLayers())
+	if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrInvalidArg {
+		t.Fatalf("expected HrInvalidArg got: %v", err)
+	}
+}
+
+func Test_modifyMappedVirtualDisk_Invalid_CheckFilesystem(t *testing.T) {
+	tests := []*prot.MappedVirtualDiskV2{
+		{
+			MountPath:       "/run/gcs/c/test/disk",
+			ReadOnly:        true,
+			CheckFilesystem: true,
+		},
+		{
+			MountPath:       "/run/gcs/c/test/disk",
+			Filesystem:      "xfs",
+			CheckFilesystem: true,
+		},
+		{
+			CheckFilesystem: true,
+		},
+	}
+	for _, mvd := range tests {
+		_, err := modifyMappedVirtualDisk(context.Background(), prot.MreqtAdd, mvd)
+		if hr, herr := gcserr.GetHresult(err); herr != nil || hr != gcserr.HrInvalidArg {
+			t.Fatalf("%+v: expected HrInvalidArg got: %v", mvd, err)
+		}
+	}
+}
+
+func Test_modifyMappedVPCIDevice_Remove_Assigned(t *testing.T) {
+	spec := &oci.Spec{
+		Windows: &oci.Windows{
+			Devices: []oci.WindowsDevice{
+				{ID: "1C5B0E5C-4A1F-4C1E-8E4B-6F2D0C3A9B7E", IDType: "gpu"},
+			},
+		},
+	}
+	h := &Host{
+		containers: map[string]*Container{
+			"test": {
+				id:      "test",
+				devices: getAssignedDevices(spec),
+			},
+		},
+	}
+	// The container setup clears the Windows section of the spec.
+	spec.Windows = nil
+
+	err := h.modifyMappedVPCIDevice(context.Background(), prot.MreqtRemove, &prot.MappedVPCIDeviceV2{
+		VMBusGUID: "1c5b0e5c-4a1f-4c1e-8e4b-6f2d0c3a9b7e",
+	})
+	if err == nil {
+		t.Fatal("expected error removing a device assigned to a container")
+	}
+}
+
+func Test_resizeMappedVirtualDisk_Invalid(t *testing.T) {
+	h := &Host{mounts: newMountManager()}
+	mounted := func(mvd prot.MappedVirtualDiskV2) {
+		h.mounts.mounts[scsiMountKey(&mvd)] = &mountEntry{refs: 1, settings: scsiMountSettings(&mvd)}
+	}
+	mounted(prot.MappedVirtualDiskV2{
+		MountPath:  "/run/mounts/m1",
+		Lun:        1,
+		Encryption: &prot.DeviceEncryptionInfo{Key: "00ff"},
+	})
+	mounted(prot.MappedVirtualDiskV2{
+		MountPath:  "/run/mounts/m2",
+		Lun:        2,
+		Encryption: &prot.DeviceEncryptionInfo{},
+	})
+	mounted(prot.MappedVirtualDiskV2{
+		MountPath:  "/run/mounts/m3",
+		Lun:        3,
+		VerityInfo: &prot.DeviceVerityInfo{RootDigest: "abc"},
+	})
+
+	tests := []struct {
+		mvd *prot.MappedVirtualDiskV2
+		hr  gcserr.Hresult
+	}{
+		// Not mounted.
+		{&prot.MappedVirtualDiskV2{MountPath: "/run/mounts/m4", Lun: 4}, gcserr.HrErrNotFound},
+		{&prot.MappedVirtualDiskV2{MountPath: "/run/mounts/m1", Lun: 2}, gcserr.HrErrNotFound},
+		// Another key than the one the disk was mounted with.
+		{&prot.MappedVirtualDiskV2{MountPath: "/run/mounts/m1", Lun: 1, Encryption: &prot.DeviceEncryptionInfo{Key: "ff00"}}, gcserr.HrInvalidArg},
+		// The ephemeral key is taken from the mount.
+		{&prot.MappedVirtualDiskV2{MountPath: "/run/mounts/m2", Lun: 2}, gcserr.HrNotImpl},
+		{&prot.MappedVirtualDiskV2{MountPath: "/run/mounts/m3", Lun: 3}, gcserr.HrNotImpl},
+	}
+	for _, test := range tests {
+		_, err := h.resizeMappedVirtualDisk(context.Background(), test.mvd)
+		if hr, herr := gcserr.GetHresult(err); herr != nil || hr != test.hr {
+			t.Fatalf("%+v: expected %v got: %v", test.mvd, test.hr, err)
+		}
+	}
+	if len(h.mounts.mounts) != 3 {
+		t.Fatalf("expected only the mounted disks to be tracked got: %+v", h.mounts.mounts)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage/scsi"
 	"github.com/opencontainers/runc/libcontainer/configs"
 	"github.com/opencontainers/runc/libcontainer/devices"
 	oci "github.com/opencontainers/runtime-spec/specs-go"
@@ -15,6 +18,12 @@ import (
 	"go.opencensus.io/trace"
 )
 
+// scsiDevicePrefix is the prefix of a `spec.Linux.Devices` path that refers to
+// a SCSI disk attached to the UVM rather than a device node.
+const scsiDevicePrefix = "scsi://"
+
+var scsiControllerLunToName = scsi.ControllerLunToName
+
 func getWorkloadRootDir(id string) string {
 	return filepath.Join("/run/gcs/c", id)
 }
@@ -44,6 +53,52 @@ func updateSandboxMounts(sbid string, spec *oci.Spec) error {
 	return nil
 }
 
+// parseSCSIDevicePath parses a device path of the form
+// `scsi://<controller>/<lun>[<container path>]`. If no container path is given
+// `containerPath` is empty.
+func parseSCSIDevicePath(p string) (controller, lun uint8, containerPath string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(p, scsiDevicePrefix), "/", 3)
+	if len(parts) < 2 {
+		return 0, 0, "", errors.Errorf("invalid SCSI device path '%s', expected '%s<controller>/<lun>[<container path>]'", p, scsiDevicePrefix)
+	}
+	c, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return 0, 0, "", errors.Wrapf(err, "invalid controller in SCSI device path '%s'", p)
+	}
+	l, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return 0, 0, "", errors.Wrapf(err, "invalid lun in SCSI device path '%s'", p)
+	}
+	if len(parts) == 3 {
+		containerPath = "/" + parts[2]
+	}
+	return uint8(c), uint8(l), containerPath, nil
+}
+
+// scsiDeviceFromPath returns the block device of the SCSI disk referenced by
+// the `scsi://` device path `p`. The device is exposed in the container at the
+// container path of `p`, or at its name in the UVM if none is given.
+func scsiDeviceFromPath(ctx context.Context, p string) (*configs.Device, error) {
+	controller, lun, containerPath, err := parseSCSIDevicePath(p)
+	if err != nil {
+		return nil, err
+	}
+	resolveCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	source, err := scsiControllerLunToName(resolveCtx, controller, lun)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find SCSI device for '%s'", p)
+	}
+	dev, err := devices.DeviceFromPath(source, "rwm")
+	if err != nil {
+		return nil, err
+	}
+	if containerPath != "" {
+		dev.Path = containerPath
+	}
+	return dev, nil
+}
+
 func specHasGPUDevice(spec *oci.Spec) bool {
 	for _, d := range spec.Windows.Devices {
 		if d.IDType == "gpu" {
@@ -118,9 +173,18 @@ func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.
 	// NODE.
 
 	// Check if we need to do any capability/device mappings
+	tempLinuxDevices := spec.Linux.Devices
 	if spec.Annotations["io.microsoft.virtualmachine.lcow.privileged"] == "true" {
 		log.G(ctx).Debug("'io.microsoft.virtualmachine.lcow.privileged' set for privileged container")
 
+		// Drop the `scsi://` paths, they are replaced by the resolved devices.
+		spec.Linux.Devices = []oci.LinuxDevice{}
+		for _, ld := range tempLinuxDevices {
+			if !strings.HasPrefix(ld.Path, scsiDevicePrefix) {
+				spec.Linux.Devices = append(spec.Linux.Devices, ld)
+			}
+		}
+
 		// Add all host devices
 		hostDevices, err := devices.HostDevices()
 		if err != nil {
@@ -129,6 +193,16 @@ func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.
 		for _, hostDevice := range hostDevices {
 			addLinuxDeviceToSpec(ctx, hostDevice, spec, false)
 		}
+		// SCSI disks are not named by the host so they must still be resolved.
+		for _, ld := range tempLinuxDevices {
+			if strings.HasPrefix(ld.Path, scsiDevicePrefix) {
+				hostDevice, err := scsiDeviceFromPath(ctx, ld.Path)
+				if err != nil {
+					return err
+				}
+				addLinuxDeviceToSpec(ctx, hostDevice, spec, false)
+			}
+		}
 
 		// Set the cgroup access
 		spec.Linux.Resources.Devices = []oci.LinuxDeviceCgroup{
@@ -138,10 +212,14 @@ func setupWorkloadContainerSpec(ctx context.Context, sbid, id string, spec *oci.
 			},
 		}
 	} else {
-		tempLinuxDevices := spec.Linux.Devices
 		spec.Linux.Devices = []oci.LinuxDevice{}
 		for _, ld := range tempLinuxDevices {
-			hostDevice, err := devices.DeviceFromPath(ld.Path, "rwm")
+			var hostDevice *configs.Device
+			if strings.HasPrefix(ld.Path, scsiDevicePrefix) {
+				hostDevice, err = scsiDeviceFromPath(ctx, ld.Path)
+			} else {
+				hostDevice, err = devices.DeviceFromPath(ld.Path, "rwm")
+			}
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,110 @@
+// +build linux
+
+package hcsv2
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	oci "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func Test_parseSCSIDevicePath(t *testing.T) {
+	type config struct {
+		path          string
+		controller    uint8
+		lun           uint8
+		containerPath string
+	}
+	tests := []config{
+		{"scsi://0/1", 0, 1, ""},
+		{"scsi://3/63/dev/xvda", 3, 63, "/dev/xvda"},
+	}
+	for _, test := range tests {
+		controller, lun, containerPath, err := parseSCSIDevicePath(test.path)
+		if err != nil {
+			t.Fatalf("%s: expected nil error got: %v", test.path, err)
+		}
+		if controller != test.controller || lun != test.lun || containerPath != test.containerPath {
+			t.Fatalf("%s: expected %d/%d '%s' got %d/%d '%s'", test.path, test.controller, test.lun, test.containerPath, controller, lun, containerPath)
+		}
+	}
+}
+
+func Test_parseSCSIDevicePath_Invalid(t *testing.T) {
+	for _, p := range []string{"scsi://", "scsi://0", "scsi://a/1", "scsi://0/256", "scsi:///1"} {
+		if _, _, _, err := parseSCSIDevicePath(p); err == nil {
+			t.Fatalf("%s: expected error got nil", p)
+		}
+	}
+}
+
+func Test_scsiDeviceFromPath(t *testing.T) {
+	orig := scsiControllerLunToName
+	scsiControllerLunToName = func(_ context.Context, controller, lun uint8) (string, error) {
+		if controller != 1 || lun != 2 {
+			t.Errorf("expected 1/2 got %d/%d", controller, lun)
+		}
+		return "/dev/null", nil
+	}
+	defer func() {
+		scsiControllerLunToName = orig
+	}()
+
+	dev, err := scsiDeviceFromPath(context.Background(), "scsi://1/2/dev/xvda")
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if dev.Path != "/dev/xvda" {
+		t.Fatalf("expected container path '/dev/xvda' got '%s'", dev.Path)
+	}
+
+	dev, err = scsiDeviceFromPath(context.Background(), "scsi://1/2")
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if dev.Path != "/dev/null" {
+		t.Fatalf("expected container path '/dev/null' got '%s'", dev.Path)
+	}
+}
+
+func Test_setupWorkloadContainerSpec_Privileged_SCSIDevice(t *testing.T) {
+	orig := scsiControllerLunToName
+	scsiControllerLunToName = func(_ context.Context, controller, lun uint8) (string, error) {
+		return "/dev/null", nil
+	}
+	defer func() {
+		scsiControllerLunToName = orig
+	}()
+
+	spec := &oci.Spec{
+		Annotations: map[string]string{
+			"io.microsoft.virtualmachine.lcow.privileged": "true",
+		},
+		Linux: &oci.Linux{
+			Devices: []oci.LinuxDevice{
+				{Path: "scsi://1/2/dev/xvda"},
+			},
+			Resources: &oci.LinuxResources{},
+		},
+	}
+	if err := setupWorkloadContainerSpec(context.Background(), "sandbox", "test", spec); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	found := false
+	for _, d := range spec.Linux.Devices {
+		if strings.HasPrefix(d.Path, scsiDevicePrefix) {
+			t.Fatalf("unexpected unresolved device: %+v", d)
+		}
+		if d.Path == "/dev/xvda" {
+			if d.Major != 1 || d.Minor != 3 {
+				t.Fatalf("expected /dev/xvda to be 1:3 got %d:%d", d.Major, d.Minor)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected resolved device /dev/xvda")
+	}
+}
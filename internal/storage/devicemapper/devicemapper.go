@@ -3,6 +3,8 @@
 package devicemapper
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path"
@@ -42,6 +44,11 @@ const (
 	_DM_READONLY_FLAG       = 1 << 0
 	_DM_SUSPEND_FLAG        = 1 << 1
 	_DM_PERSISTENT_DEV_FLAG = 1 << 3
+	_DM_BUFFER_FULL_FLAG    = 1 << 8
+
+	// initialBufferSize is the size of the first buffer used for ioctls that
+	// return data. It is doubled while the kernel reports it as full.
+	initialBufferSize = 16 * 1024
 
 	BlockSize = 512
 )
@@ -194,6 +201,24 @@ func PMemLinearTarget(lengthBytes int64, path string, deviceStartBytes int64) Ta
 	return LinearTarget(0, lengthInBlocks, path, startInBlocks)
 }
 
+// CryptTarget constructs a device-mapper target that transparently encrypts a
+// portion of a block device at the specified offset. `key` is the hex encoded
+// key for `cipher`.
+//
+// Example crypt target table:
+// 0 20971520 crypt aes-xts-plain64 0123...cdef 0 /dev/sdb 0
+// |     |      |          |            |      |    |     |
+// start |   target     cipher         key     | data_dev |
+//     size                          iv_offset        offset
+func CryptTarget(sectorStart, lengthBlocks int64, cipher, key string, ivOffset int64, path string, deviceStart int64) Target {
+	return Target{
+		Type:           "crypt",
+		SectorStart:    sectorStart,
+		LengthInBlocks: lengthBlocks,
+		Params:         fmt.Sprintf("%s %s %d %s %d", cipher, key, ivOffset, path, deviceStart),
+	}
+}
+
 // makeTableIoctl builds an ioctl input structure with a table of the specified
 // targets.
 func makeTableIoctl(name string, targets []Target) *dmIoctl {
@@ -288,3 +313,236 @@ func removeDevice(f *os.File, name string) error {
 	}
 	return nil
 }
+
+// ioctlWithData issues the specified device-mapper ioctl for `name` with room
+// for the kernel to return data, growing the buffer until the data fits. It
+// returns the ioctl header and the returned data.
+func ioctlWithData(f *os.File, code int, name string, flags uint32) (*dmIoctl, []byte, error) {
+	for size := initialBufferSize; ; size *= 2 {
+		b := make([]byte, size)
+		d := (*dmIoctl)(unsafe.Pointer(&b[0]))
+		initIoctl(d, size, name)
+		d.DataStart = uint32(unsafe.Sizeof(*d))
+		d.Flags = flags
+		if err := ioctl(f, code, d); err != nil {
+			return nil, nil, err
+		}
+		if d.Flags&_DM_BUFFER_FULL_FLAG == 0 {
+			end := int(d.DataSize)
+			if end < int(d.DataStart) || end > size {
+				end = size
+			}
+			return d, b[d.DataStart:end], nil
+		}
+	}
+}
+
+// cString returns the NUL terminated string at the start of `b`.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// DeviceInfo describes a device-mapper device.
+type DeviceInfo struct {
+	Name string
+	// Dev is the device number of the device.
+	Dev uint64
+}
+
+// parseNameList parses the `struct dm_name_list` entries returned by the list
+// devices ioctl.
+func parseNameList(b []byte) ([]DeviceInfo, error) {
+	const headerSize = 12 // dev, next
+	var devices []DeviceInfo
+	for off := 0; ; {
+		if off+headerSize > len(b) {
+			return nil, fmt.Errorf("device-mapper list devices: truncated entry at %d", off)
+		}
+		dev := binary.LittleEndian.Uint64(b[off:])
+		next := binary.LittleEndian.Uint32(b[off+8:])
+		// No devices is reported as a single empty entry.
+		if dev == 0 {
+			return devices, nil
+		}
+		devices = append(devices, DeviceInfo{
+			Name: cString(b[off+headerSize:]),
+			Dev:  dev,
+		})
+		if next == 0 {
+			return devices, nil
+		}
+		off += int(next)
+	}
+}
+
+// ListDevices returns all the device-mapper devices.
+func ListDevices() ([]DeviceInfo, error) {
+	f, err := openMapper()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, data, err := ioctlWithData(f, _DM_LIST_DEVICES, "", 0)
+	if err != nil {
+		return nil, err
+	}
+	return parseNameList(data)
+}
+
+// TargetStatus is the status of a single target of a device.
+type TargetStatus struct {
+	Type           string
+	SectorStart    int64
+	LengthInBlocks int64
+	// Status is the target specific status line, for example `V` for a valid
+	// verity target or `C` for a corrupted one.
+	Status string
+}
+
+// Corrupted returns true if the target is a verity target that has detected
+// corrupted data.
+func (t *TargetStatus) Corrupted() bool {
+	return t.Type == "verity" && t.Status == "C"
+}
+
+// DeviceStatus is the status of a device-mapper device and its active table.
+type DeviceStatus struct {
+	DeviceInfo
+	OpenCount int32
+	ReadOnly  bool
+	Suspended bool
+	Targets   []TargetStatus
+}
+
+// parseTargetStatus parses the `count` target specs, each followed by its
+// status line, returned by the table status ioctl. Unlike on input the `Next`
+// field of each spec is the offset of the next spec from the start of the
+// data.
+func parseTargetStatus(b []byte, count uint32) ([]TargetStatus, error) {
+	specSize := int(unsafe.Sizeof(targetSpec{}))
+	var targets []TargetStatus
+	off := 0
+	for i := uint32(0); i < count; i++ {
+		if off+specSize > len(b) {
+			return nil, fmt.Errorf("device-mapper table status: truncated target at %d", off)
+		}
+		spec := (*targetSpec)(unsafe.Pointer(&b[off]))
+		targets = append(targets, TargetStatus{
+			Type:           cString(spec.Type[:]),
+			SectorStart:    spec.SectorStart,
+			LengthInBlocks: spec.LengthInBlocks,
+			Status:         cString(b[off+specSize:]),
+		})
+		off = int(spec.Next)
+	}
+	return targets, nil
+}
+
+// Status returns the status of the device-mapper device `name` and of each
+// target of its active table.
+func Status(name string) (*DeviceStatus, error) {
+	f, err := openMapper()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d, data, err := ioctlWithData(f, _DM_TABLE_STATUS, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := parseTargetStatus(data, d.TargetCount)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceStatus{
+		DeviceInfo: DeviceInfo{
+			Name: cString(d.Name[:]),
+			Dev:  d.Dev,
+		},
+		OpenCount: d.OpenCount,
+		ReadOnly:  d.Flags&_DM_READONLY_FLAG != 0,
+		Suspended: d.Flags&_DM_SUSPEND_FLAG != 0,
+		Targets:   targets,
+	}, nil
+}
+
+// suspendDevice suspends or resumes the device `name`. Resuming a device with
+// an inactive table makes it the active table.
+func suspendDevice(f *os.File, name string, suspend bool) error {
+	var d dmIoctl
+	initIoctl(&d, int(unsafe.Sizeof(d)), name)
+	if suspend {
+		d.Flags = _DM_SUSPEND_FLAG
+	}
+	return ioctl(f, _DM_DEV_SUSPEND, &d)
+}
+
+// SuspendDevice suspends the device-mapper device `name`. I/O to the device is
+// queued until it is resumed.
+func SuspendDevice(name string) error {
+	f, err := openMapper()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return suspendDevice(f, name, true)
+}
+
+// ResumeDevice resumes the suspended device-mapper device `name`.
+func ResumeDevice(name string) error {
+	f, err := openMapper()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return suspendDevice(f, name, false)
+}
+
+// clearTable clears the inactive table of the device `name`.
+func clearTable(f *os.File, name string) error {
+	var d dmIoctl
+	initIoctl(&d, int(unsafe.Sizeof(d)), name)
+	return ioctl(f, _DM_TABLE_CLEAR, &d)
+}
+
+// ReloadDevice replaces the table of the device-mapper device `name` with
+// `targets` without recreating it, for example to change its size. The device
+// is briefly suspended while the new table is swapped in.
+//
+// If the new table cannot be resumed the device is resumed with its old table
+// and the error is returned. If that fails too the device is left suspended
+// and the returned error says so.
+func ReloadDevice(name string, flags CreateFlags, targets []Target) (err error) {
+	f, err := openMapper()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	di := makeTableIoctl(name, targets)
+	if flags&CreateReadOnly != 0 {
+		di.Flags |= _DM_READONLY_FLAG
+	}
+	if err := ioctl(f, _DM_TABLE_LOAD, di); err != nil {
+		return err
+	}
+	if err := suspendDevice(f, name, true); err != nil {
+		clearTable(f, name)
+		return err
+	}
+	if err := suspendDevice(f, name, false); err != nil {
+		// A failed resume may leave the new table inactive, clear it so the
+		// old table is resumed.
+		clearTable(f, name)
+		if rerr := suspendDevice(f, name, false); rerr != nil {
+			return fmt.Errorf("device-mapper device %s is still suspended: %s: resume with the old table: %s", name, err, rerr)
+		}
+		return err
+	}
+	return nil
+}
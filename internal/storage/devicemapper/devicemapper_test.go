@@ -3,8 +3,10 @@
 package devicemapper
 
 import (
+	"encoding/binary"
 	"flag"
 	"os"
+	"strings"
 	"testing"
 	"unsafe"
 
@@ -140,3 +142,146 @@ func TestLinearError(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCryptError(t *testing.T) {
+	if !*integration {
+		t.Skip()
+	}
+	b, err := createDevice("base-device", 0, []Target{
+		{Type: "error", SectorStart: 0, LengthInBlocks: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	d, err := createDevice("crypt-device", 0, []Target{
+		CryptTarget(0, 50, "aes-xts-plain64", strings.Repeat("00", 64), 0, b.Path, 50),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	validateDevice(t, d.Path, 50, true)
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseNameList(t *testing.T) {
+	var b []byte
+	entry := func(dev uint64, name string, last bool) {
+		e := make([]byte, (12+len(name)+1+7)&^7)
+		binary.LittleEndian.PutUint64(e, dev)
+		if !last {
+			binary.LittleEndian.PutUint32(e[8:], uint32(len(e)))
+		}
+		copy(e[12:], name)
+		b = append(b, e...)
+	}
+	entry(0xfd00, "dm-linear-pmem0", false)
+	entry(0xfd01, "dm-verity-scsi0-1", true)
+
+	devices, err := parseNameList(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DeviceInfo{{"dm-linear-pmem0", 0xfd00}, {"dm-verity-scsi0-1", 0xfd01}}
+	if len(devices) != len(expected) || devices[0] != expected[0] || devices[1] != expected[1] {
+		t.Fatalf("expected %+v got %+v", expected, devices)
+	}
+
+	devices, err = parseNameList(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 0 {
+		t.Fatalf("expected no devices got %+v", devices)
+	}
+}
+
+func TestParseTargetStatus(t *testing.T) {
+	specSize := int(unsafe.Sizeof(targetSpec{}))
+	b := make([]byte, 2*(specSize+8))
+	for i, status := range []string{"V", "C"} {
+		off := i * (specSize + 8)
+		spec := (*targetSpec)(unsafe.Pointer(&b[off]))
+		spec.SectorStart = int64(i * 100)
+		spec.LengthInBlocks = 100
+		spec.Next = uint32(off + specSize + 8)
+		copy(spec.Type[:], "verity")
+		copy(b[off+specSize:], status)
+	}
+
+	targets, err := parseTargetStatus(b, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets got %d", len(targets))
+	}
+	if targets[0].Corrupted() || targets[0].Status != "V" {
+		t.Fatalf("expected valid target got %+v", targets[0])
+	}
+	if !targets[1].Corrupted() || targets[1].SectorStart != 100 {
+		t.Fatalf("expected corrupted target got %+v", targets[1])
+	}
+
+	if _, err := parseTargetStatus(b, 3); err == nil {
+		t.Fatal("expected error for truncated status")
+	}
+}
+
+func TestStatusSuspendReload(t *testing.T) {
+	if !*integration {
+		t.Skip()
+	}
+	d, err := createDevice("test-device", 0, []Target{
+		{Type: "error", SectorStart: 0, LengthInBlocks: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	devices, err := ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, dev := range devices {
+		found = found || dev.Name == d.Name
+	}
+	if !found {
+		t.Fatalf("expected %s in %+v", d.Name, devices)
+	}
+
+	if err := SuspendDevice(d.Name); err != nil {
+		t.Fatal(err)
+	}
+	status, err := Status(d.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Suspended || len(status.Targets) != 1 || status.Targets[0].Type != "error" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if err := ResumeDevice(d.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReloadDevice(d.Name, 0, []Target{
+		{Type: "error", SectorStart: 0, LengthInBlocks: 20},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	validateDevice(t, d.Path, 20, true)
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,389 @@
+// +build linux
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+// Filesystem types that can be mounted from a block device.
+const (
+	FsTypeExt4     = "ext4"
+	FsTypeXfs      = "xfs"
+	FsTypeErofs    = "erofs"
+	FsTypeSquashfs = "squashfs"
+)
+
+// filesystem describes how to mount a filesystem type.
+type filesystem struct {
+	// readonlyData is the mount data used when mounting read-only so that the
+	// filesystem does not try to write to the device, for example to replay
+	// its journal.
+	readonlyData string
+	// readonlyOnly is set for filesystems that can only be mounted
+	// read-only.
+	readonlyOnly bool
+	// mkfsArgs are the arguments passed to `mkfs.<type>` before the device to
+	// format it non-interactively. Empty if the filesystem cannot be created
+	// in the guest.
+	mkfsArgs []string
+	// fsckArgs are the arguments passed to `fsck.<type>` before the device to
+	// replay its journal and repair it non-interactively. Empty if the
+	// filesystem cannot be checked in the guest.
+	fsckArgs []string
+	// dataOptions are the filesystem specific mount options, without any
+	// `=value`, that can be requested by the host.
+	dataOptions []string
+}
+
+var filesystems = map[string]filesystem{
+	FsTypeExt4: {
+		readonlyData: "noload",
+		mkfsArgs:     []string{"-q", "-F"},
+		fsckArgs:     []string{"-y"},
+		dataOptions: []string{
+			"auto_da_alloc", "noauto_da_alloc", "barrier", "nobarrier", "block_validity", "noblock_validity",
+			"bsdgroups", "sysvgroups", "commit", "dax", "data", "data_err", "delalloc", "nodelalloc",
+			"dioread_lock", "dioread_nolock", "discard", "nodiscard", "errors", "grpid", "nogrpid",
+			"init_itable", "noinit_itable", "inode_readahead_blks", "journal_async_commit",
+			"journal_checksum", "nojournal_checksum", "journal_ioprio", "max_batch_time",
+			"min_batch_time", "nombcache", "noload", "norecovery", "prefetch_block_bitmaps",
+			"no_prefetch_block_bitmaps", "resgid", "resuid", "stripe", "user_xattr", "nouser_xattr",
+			// Quotas
+			"quota", "noquota", "usrquota", "grpquota", "prjquota", "usrjquota", "grpjquota", "jqfmt",
+		},
+	},
+	FsTypeXfs: {
+		readonlyData: "norecovery",
+		mkfsArgs:     []string{"-q", "-f"},
+		dataOptions: []string{
+			"allocsize", "attr2", "noattr2", "bsdgroups", "sysvgroups", "dax", "discard", "nodiscard",
+			"filestreams", "grpid", "nogrpid", "ikeep", "noikeep", "inode32", "inode64", "largeio",
+			"nolargeio", "logbsize", "logbufs", "noalign", "norecovery", "nouuid", "sunit", "swalloc",
+			"swidth", "wsync",
+			// Quotas
+			"quota", "noquota", "qnoenforce", "uquota", "usrquota", "uqnoenforce", "gquota",
+			"grpquota", "gqnoenforce", "pquota", "prjquota", "pqnoenforce",
+		},
+	},
+	FsTypeErofs: {
+		readonlyOnly: true,
+		dataOptions:  []string{"cache_strategy", "dax", "user_xattr", "nouser_xattr"},
+	},
+	FsTypeSquashfs: {
+		readonlyOnly: true,
+		dataOptions:  []string{"errors", "threads"},
+	},
+}
+
+// blankCheckSize is the number of bytes at the start of a device that must be
+// zero for it to be considered blank. It covers the superblocks of all the
+// supported filesystems.
+const blankCheckSize = 64 * 1024
+
+// execCommand is stubbed in tests to avoid running mkfs and fsck.
+var execCommand = exec.CommandContext
+
+// superblockMagic identifies a filesystem by the bytes `magic` at byte
+// `offset` of the device.
+type superblockMagic struct {
+	fsType string
+	offset int64
+	magic  []byte
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+var superblockMagics = []superblockMagic{
+	// ext2, ext3 and ext4 share a superblock, all of them are mounted by the
+	// ext4 driver.
+	{FsTypeExt4, 1024 + 0x38, le16(0xEF53)},
+	{FsTypeXfs, 0, []byte("XFSB")},
+	{FsTypeErofs, 1024, le32(0xE0F5E1E2)},
+	{FsTypeSquashfs, 0, []byte("hsqs")},
+}
+
+// ValidateFilesystem returns an error if `fsType` is not a supported
+// filesystem type.
+func ValidateFilesystem(fsType string) error {
+	if _, ok := filesystems[fsType]; !ok {
+		return errors.Errorf("unsupported filesystem type '%s'", fsType)
+	}
+	return nil
+}
+
+// DetectFilesystem returns the type of the filesystem on the block device
+// `source` by reading its superblock magic. If `source` does not exist the
+// returned error satisfies `os.IsNotExist`.
+func DetectFilesystem(source string) (string, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, sb := range superblockMagics {
+		b := make([]byte, len(sb.magic))
+		if _, err := f.ReadAt(b, sb.offset); err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return "", errors.Wrapf(err, "failed to read superblock of %s", source)
+		}
+		if bytes.Equal(b, sb.magic) {
+			return sb.fsType, nil
+		}
+	}
+	return "", errors.Errorf("no supported filesystem found on %s", source)
+}
+
+// FilesystemMountOptions returns the mount flags and data used to mount
+// `fsType`. Filesystems that can only be mounted read-only are always mounted
+// with `MS_RDONLY`.
+func FilesystemMountOptions(fsType string, readonly bool) (flags uintptr, data string, err error) {
+	fs, ok := filesystems[fsType]
+	if !ok {
+		return 0, "", errors.Errorf("unsupported filesystem type '%s'", fsType)
+	}
+	if readonly || fs.readonlyOnly {
+		return unix.MS_RDONLY, fs.readonlyData, nil
+	}
+	return 0, "", nil
+}
+
+// ValidateMountData returns an error if any of the filesystem specific mount
+// options `data` is not supported by `fsType`.
+func ValidateMountData(fsType string, data []string) error {
+	fs, ok := filesystems[fsType]
+	if !ok {
+		return errors.Errorf("unsupported filesystem type '%s'", fsType)
+	}
+	for _, d := range data {
+		key := strings.SplitN(d, "=", 2)[0]
+		supported := false
+		for _, o := range fs.dataOptions {
+			if key == o {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return errors.Errorf("mount option '%s' is not supported for %s", d, fsType)
+		}
+	}
+	return nil
+}
+
+// IsBlankDevice returns true if the start of the device `source` is all zeros,
+// meaning that it has never been formatted.
+func IsBlankDevice(source string) (bool, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	b := make([]byte, blankCheckSize)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, errors.Wrapf(err, "failed to read %s", source)
+	}
+	for _, c := range b[:n] {
+		if c != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// BlockDeviceSize returns the size in bytes of the block device `source`.
+func BlockDeviceSize(source string) (int64, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errors.Wrapf(errno, "failed to get size of %s", source)
+	}
+	return size, nil
+}
+
+// FormatFilesystem creates a new `fsType` filesystem on the block device
+// `source` by running `mkfs.<fsType>` in the guest. Any existing data on
+// `source` is lost.
+func FormatFilesystem(ctx context.Context, source, fsType string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "storage::FormatFilesystem")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("source", source),
+		trace.StringAttribute("fsType", fsType))
+
+	fs, ok := filesystems[fsType]
+	if !ok || len(fs.mkfsArgs) == 0 {
+		return errors.Errorf("formatting filesystem type '%s' is not supported", fsType)
+	}
+	args := append(append([]string{}, fs.mkfsArgs...), source)
+	cmd := execCommand(ctx, "mkfs."+fsType, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to format %s as %s: %s", source, fsType, out)
+	}
+	return nil
+}
+
+// Exit status bits of fsck.
+const (
+	fsckErrorsCorrected   = 1
+	fsckRebootRequired    = 2
+	fsckErrorsUncorrected = 4
+)
+
+// FilesystemCheckResult is the outcome of `CheckFilesystem`.
+type FilesystemCheckResult struct {
+	// Repaired is true if errors were found and corrected, including a
+	// replayed journal.
+	Repaired bool
+	// Output is the output of fsck.
+	Output string
+}
+
+// CorruptFilesystemError is returned by `CheckFilesystem` when a filesystem
+// has errors that could not be repaired.
+type CorruptFilesystemError struct {
+	Source string
+	Output string
+}
+
+func (e *CorruptFilesystemError) Error() string {
+	return fmt.Sprintf("filesystem on %s has errors that could not be repaired: %s", e.Source, e.Output)
+}
+
+// ValidateCheckFilesystem returns an error if `fsType` cannot be checked in
+// the guest. An empty `fsType` is detected later and checked then.
+func ValidateCheckFilesystem(fsType string) error {
+	if fsType == "" {
+		return nil
+	}
+	if fs, ok := filesystems[fsType]; !ok || len(fs.fsckArgs) == 0 {
+		return errors.Errorf("checking filesystem type '%s' is not supported", fsType)
+	}
+	return nil
+}
+
+// CheckFilesystem replays the journal of the `fsType` filesystem on the block
+// device `source` and repairs any errors found by running `fsck.<fsType>` in
+// the guest. `source` must not be mounted. Errors that cannot be repaired
+// return a `*CorruptFilesystemError`.
+func CheckFilesystem(ctx context.Context, source, fsType string) (_ *FilesystemCheckResult, err error) {
+	ctx, span := trace.StartSpan(ctx, "storage::CheckFilesystem")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("source", source),
+		trace.StringAttribute("fsType", fsType))
+
+	fs, ok := filesystems[fsType]
+	if !ok || len(fs.fsckArgs) == 0 {
+		return nil, errors.Errorf("checking filesystem type '%s' is not supported", fsType)
+	}
+	args := append(append([]string{}, fs.fsckArgs...), source)
+	out, err := execCommand(ctx, "fsck."+fsType, args...).CombinedOutput()
+	result := &FilesystemCheckResult{Output: string(out)}
+	if err == nil {
+		return result, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return nil, errors.Wrapf(err, "failed to check %s", source)
+	}
+	status := exitErr.ExitCode()
+	switch {
+	case status&fsckErrorsUncorrected != 0:
+		return nil, &CorruptFilesystemError{Source: source, Output: string(out)}
+	case status&^(fsckErrorsCorrected|fsckRebootRequired) == 0:
+		result.Repaired = true
+		return result, nil
+	default:
+		return nil, errors.Errorf("failed to check %s, fsck exit status %d: %s", source, status, out)
+	}
+}
+
+// _EXT4_IOC_RESIZE_FS is `_IOW('f', 16, __u64)`.
+const _EXT4_IOC_RESIZE_FS = 0x40086610
+
+// GrowFilesystem grows the ext4 filesystem on `source` mounted at `target`
+// online to fill `sizeInBytes` and returns the new size of the filesystem in
+// bytes, as recorded in its superblock. Growing to the current size is a no-op,
+// shrinking is not supported.
+func GrowFilesystem(ctx context.Context, source, target string, sizeInBytes uint64) (_ uint64, err error) {
+	_, span := trace.StartSpan(ctx, "storage::GrowFilesystem")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("source", source),
+		trace.StringAttribute("target", target),
+		trace.Int64Attribute("sizeInBytes", int64(sizeInBytes)))
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(target, &st); err != nil {
+		return 0, errors.Wrapf(err, "failed to statfs %s", target)
+	}
+	if st.Type != unix.EXT4_SUPER_MAGIC {
+		return 0, errors.Errorf("growing the filesystem at %s is only supported for ext4", target)
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	blocks := sizeInBytes / uint64(st.Bsize)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), _EXT4_IOC_RESIZE_FS, uintptr(unsafe.Pointer(&blocks))); errno != 0 {
+		return 0, errors.Wrapf(errno, "failed to resize %s to %d blocks", target, blocks)
+	}
+	// statfs reports the blocks available for data, without the metadata
+	// overhead. Commit the resize and read the block count of the filesystem
+	// from its superblock instead.
+	if err := unix.Syncfs(int(f.Fd())); err != nil {
+		return 0, errors.Wrapf(err, "failed to sync %s", target)
+	}
+	dev, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer dev.Close()
+	size, err := ext4Size(dev)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read the size of %s", source)
+	}
+	return uint64(size), nil
+}
@@ -0,0 +1,289 @@
+// +build linux
+
+package storage
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var integration = flag.Bool("integration", false, "run integration tests")
+
+func Test_DetectFilesystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, sb := range superblockMagics {
+		t.Run(sb.fsType, func(t *testing.T) {
+			image := make([]byte, 4096)
+			copy(image[sb.offset:], sb.magic)
+			source := filepath.Join(dir, sb.fsType)
+			if err := ioutil.WriteFile(source, image, 0600); err != nil {
+				t.Fatalf("failed to write image: %v", err)
+			}
+			fsType, err := DetectFilesystem(source)
+			if err != nil {
+				t.Fatalf("expected nil error got: %v", err)
+			}
+			if fsType != sb.fsType {
+				t.Fatalf("expected filesystem: %s, got: %s", sb.fsType, fsType)
+			}
+		})
+	}
+
+	blank := filepath.Join(dir, "blank")
+	if err := ioutil.WriteFile(blank, make([]byte, 512), 0600); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+	if _, err := DetectFilesystem(blank); err == nil {
+		t.Fatal("expected error detecting filesystem of blank device")
+	}
+	if _, err := DetectFilesystem(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error got: %v", err)
+	}
+}
+
+func Test_FilesystemMountOptions(t *testing.T) {
+	type testcase struct {
+		fsType    string
+		readonly  bool
+		flags     uintptr
+		data      string
+		expectErr bool
+	}
+	testcases := []testcase{
+		{fsType: FsTypeExt4},
+		{fsType: FsTypeExt4, readonly: true, flags: unix.MS_RDONLY, data: "noload"},
+		{fsType: FsTypeXfs, readonly: true, flags: unix.MS_RDONLY, data: "norecovery"},
+		{fsType: FsTypeErofs, flags: unix.MS_RDONLY},
+		{fsType: FsTypeSquashfs, readonly: true, flags: unix.MS_RDONLY},
+		{fsType: "ntfs", expectErr: true},
+	}
+	for _, tc := range testcases {
+		flags, data, err := FilesystemMountOptions(tc.fsType, tc.readonly)
+		if tc.expectErr {
+			if err == nil {
+				t.Fatalf("%s: expected err got nil", tc.fsType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: expected nil error got: %v", tc.fsType, err)
+		}
+		if flags != tc.flags || data != tc.data {
+			t.Fatalf("%s readonly=%v: expected flags: %v data: %q, got flags: %v data: %q", tc.fsType, tc.readonly, tc.flags, tc.data, flags, data)
+		}
+	}
+}
+
+func Test_ValidateMountData(t *testing.T) {
+	for _, c := range []struct {
+		fsType string
+		data   []string
+		valid  bool
+	}{
+		{fsType: FsTypeExt4, valid: true},
+		{fsType: FsTypeExt4, data: []string{"discard", "barrier=0", "data=ordered"}, valid: true},
+		{fsType: FsTypeXfs, data: []string{"inode64", "logbufs=8"}, valid: true},
+		{fsType: FsTypeExt4, data: []string{"prjquota", "journal_async_commit"}, valid: true},
+		{fsType: FsTypeXfs, data: []string{"pquota", "prjquota", "usrquota"}, valid: true},
+		{fsType: FsTypeExt4, data: []string{"inode64"}},
+		{fsType: FsTypeSquashfs, data: []string{"discard"}},
+		{fsType: FsTypeExt4, data: []string{"bogus=1"}},
+		{fsType: "ntfs"},
+	} {
+		err := ValidateMountData(c.fsType, c.data)
+		if c.valid && err != nil {
+			t.Fatalf("%+v: expected nil error got: %v", c, err)
+		}
+		if !c.valid && err == nil {
+			t.Fatalf("%+v: expected error", c)
+		}
+	}
+}
+
+func Test_IsBlankDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := make([]byte, 2*blankCheckSize)
+	source := filepath.Join(dir, "image")
+	if err := ioutil.WriteFile(source, image, 0600); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+	if blank, err := IsBlankDevice(source); err != nil || !blank {
+		t.Fatalf("expected blank device got: %v, %v", blank, err)
+	}
+
+	// Data past the checked region does not count.
+	image[blankCheckSize] = 1
+	if err := ioutil.WriteFile(source, image, 0600); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+	if blank, err := IsBlankDevice(source); err != nil || !blank {
+		t.Fatalf("expected blank device got: %v, %v", blank, err)
+	}
+
+	image[blankCheckSize-1] = 1
+	if err := ioutil.WriteFile(source, image, 0600); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+	if blank, err := IsBlankDevice(source); err != nil || blank {
+		t.Fatalf("expected non-blank device got: %v, %v", blank, err)
+	}
+}
+
+func Test_FormatFilesystem(t *testing.T) {
+	defer func() {
+		execCommand = exec.CommandContext
+	}()
+
+	var name string
+	var args []string
+	execCommand = func(ctx context.Context, n string, a ...string) *exec.Cmd {
+		name, args = n, a
+		return exec.CommandContext(ctx, "true")
+	}
+	if err := FormatFilesystem(context.Background(), "/dev/sdz", FsTypeExt4); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if name != "mkfs.ext4" || args[len(args)-1] != "/dev/sdz" {
+		t.Fatalf("unexpected command: %s %v", name, args)
+	}
+
+	for _, fsType := range []string{FsTypeErofs, "ntfs"} {
+		if err := FormatFilesystem(context.Background(), "/dev/sdz", fsType); err == nil {
+			t.Fatalf("%s: expected error got nil", fsType)
+		}
+	}
+}
+
+func Test_CheckFilesystem(t *testing.T) {
+	defer func() {
+		execCommand = exec.CommandContext
+	}()
+
+	var name string
+	var args []string
+	status := 0
+	execCommand = func(ctx context.Context, n string, a ...string) *exec.Cmd {
+		name, args = n, a
+		return exec.CommandContext(ctx, "sh", "-c", fmt.Sprintf("echo checked; exit %d", status))
+	}
+
+	result, err := CheckFilesystem(context.Background(), "/dev/sdz", FsTypeExt4)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if name != "fsck.ext4" || args[len(args)-1] != "/dev/sdz" {
+		t.Fatalf("unexpected command: %s %v", name, args)
+	}
+	if result.Repaired || result.Output != "checked\n" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	for _, status = range []int{1, 2, 3} {
+		result, err := CheckFilesystem(context.Background(), "/dev/sdz", FsTypeExt4)
+		if err != nil || !result.Repaired {
+			t.Fatalf("%d: expected repaired result got: %+v, %v", status, result, err)
+		}
+	}
+
+	status = 4
+	_, err = CheckFilesystem(context.Background(), "/dev/sdz", FsTypeExt4)
+	if _, ok := err.(*CorruptFilesystemError); !ok {
+		t.Fatalf("expected *CorruptFilesystemError got: %v", err)
+	}
+
+	status = 8
+	_, err = CheckFilesystem(context.Background(), "/dev/sdz", FsTypeExt4)
+	if _, ok := err.(*CorruptFilesystemError); err == nil || ok {
+		t.Fatalf("expected operational error got: %v", err)
+	}
+
+	for _, fsType := range []string{FsTypeXfs, "ntfs"} {
+		if _, err := CheckFilesystem(context.Background(), "/dev/sdz", fsType); err == nil {
+			t.Fatalf("%s: expected error got nil", fsType)
+		}
+		if err := ValidateCheckFilesystem(fsType); err == nil {
+			t.Fatalf("%s: expected validation error got nil", fsType)
+		}
+	}
+}
+
+func Test_GrowFilesystem_Loop_Integration(t *testing.T) {
+	if !*integration {
+		t.Skip()
+	}
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(image, nil, 0600); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	if err := os.Truncate(image, 32*1024*1024); err != nil {
+		t.Fatalf("failed to size image: %v", err)
+	}
+	if err := FormatFilesystem(context.Background(), image, FsTypeExt4); err != nil {
+		t.Fatalf("failed to format image: %v", err)
+	}
+	out, err := exec.Command("losetup", "--find", "--show", image).Output()
+	if err != nil {
+		t.Fatalf("failed to attach loop device: %v", err)
+	}
+	loop := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "-d", loop).Run()
+	target := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatalf("failed to create target: %v", err)
+	}
+	if err := unix.Mount(loop, target, FsTypeExt4, 0, ""); err != nil {
+		t.Fatalf("failed to mount: %v", err)
+	}
+	defer unix.Unmount(target, 0)
+
+	before, err := GrowFilesystem(context.Background(), loop, target, 32*1024*1024)
+	if errors.Cause(err) == unix.EPERM {
+		t.Skip("online resize requires CAP_SYS_RESOURCE")
+	}
+	if err != nil {
+		t.Fatalf("expected nil error growing to the same size got: %v", err)
+	}
+	// Expand the disk and make the loop device pick up its new capacity.
+	if err := os.Truncate(image, 64*1024*1024); err != nil {
+		t.Fatalf("failed to expand image: %v", err)
+	}
+	if err := exec.Command("losetup", "-c", loop).Run(); err != nil {
+		t.Fatalf("failed to refresh loop device: %v", err)
+	}
+	size, err := BlockDeviceSize(loop)
+	if err != nil {
+		t.Fatalf("failed to get device size: %v", err)
+	}
+	after, err := GrowFilesystem(context.Background(), loop, target, uint64(size))
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if after <= before || after > uint64(size) {
+		t.Fatalf("expected filesystem to grow from %d to at most %d got %d", before, size, after)
+	}
+}
@@ -0,0 +1,162 @@
+// +build linux
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Test dependencies
+var procPath = "/proc"
+
+// Holder is a process that keeps a mount busy.
+type Holder struct {
+	PID     int
+	Command string
+	// Use is what in the process refers to the mount, such as "cwd", "fd 3"
+	// or "mount /data".
+	Use string
+}
+
+func (h Holder) String() string {
+	return fmt.Sprintf("%d (%s) %s", h.PID, h.Command, h.Use)
+}
+
+// BusyError is returned when a mount cannot be unmounted because processes
+// still use it.
+type BusyError struct {
+	Target  string
+	Holders []Holder
+}
+
+func (e *BusyError) Error() string {
+	holders := make([]string, len(e.Holders))
+	for i, h := range e.Holders {
+		holders[i] = h.String()
+	}
+	return fmt.Sprintf("%s is busy, used by: [%s]", e.Target, strings.Join(holders, ", "))
+}
+
+// IsUnder returns true if `path` is `dir` or a path under `dir`.
+func IsUnder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// mountUses returns the mount point of the /proc/<pid>/mountinfo line `line`
+// if the mount is of the device `dev`, is under `target` or refers to paths
+// under `target` in its options, as an overlay does. The mount of `target`
+// itself is not returned when `own` is set, as it is the mount being
+// unmounted in the mount namespace of the caller.
+func mountUses(line string, dev uint64, target string, own bool) (string, bool) {
+	fields := strings.Fields(line)
+	sep := -1
+	for i, f := range fields {
+		if f == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 5 || len(fields) < sep+4 {
+		return "", false
+	}
+	mountPoint := fields[4]
+	if own && mountPoint == target {
+		return "", false
+	}
+	if fields[2] == fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev)) || IsUnder(mountPoint, target) {
+		return mountPoint, true
+	}
+	for _, o := range strings.Split(fields[sep+3], ",") {
+		i := strings.Index(o, "=")
+		if i < 0 {
+			continue
+		}
+		for _, p := range strings.Split(o[i+1:], ":") {
+			if IsUnder(p, target) {
+				return mountPoint, true
+			}
+		}
+	}
+	return "", false
+}
+
+// FindHolders returns the processes whose root, cwd, executable or open files
+// are on the filesystem mounted at `target`, or whose mount namespace has
+// other mounts of or under it. Each mount namespace is reported once, by the
+// first process found in it.
+func FindHolders(target string) ([]Holder, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(target, &st); err != nil {
+		return nil, errors.Wrapf(err, "failed to stat %s", target)
+	}
+	dev := st.Dev
+	onDevice := func(path string) bool {
+		var st unix.Stat_t
+		return unix.Stat(path, &st) == nil && st.Dev == dev
+	}
+
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	ownNS, err := os.Readlink(filepath.Join(procPath, "self", "ns", "mnt"))
+	if err != nil {
+		return nil, err
+	}
+	var holders []Holder
+	namespaces := make(map[string]bool)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		pidPath := filepath.Join(procPath, e.Name())
+		comm, err := ioutil.ReadFile(filepath.Join(pidPath, "comm"))
+		if err != nil {
+			// The process exited.
+			continue
+		}
+		add := func(use string) {
+			holders = append(holders, Holder{PID: pid, Command: strings.TrimSpace(string(comm)), Use: use})
+		}
+
+		for _, link := range []string{"root", "cwd", "exe"} {
+			if onDevice(filepath.Join(pidPath, link)) {
+				add(link)
+			}
+		}
+		fds, _ := ioutil.ReadDir(filepath.Join(pidPath, "fd"))
+		for _, fd := range fds {
+			if onDevice(filepath.Join(pidPath, "fd", fd.Name())) {
+				add("fd " + fd.Name())
+			}
+		}
+
+		ns, err := os.Readlink(filepath.Join(pidPath, "ns", "mnt"))
+		if err != nil || namespaces[ns] {
+			continue
+		}
+		namespaces[ns] = true
+		f, err := os.Open(filepath.Join(pidPath, "mountinfo"))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if mountPoint, ok := mountUses(scanner.Text(), dev, target, ns == ownNS); ok {
+				add("mount " + mountPoint)
+			}
+		}
+		f.Close()
+	}
+	return holders, nil
+}
@@ -0,0 +1,66 @@
+// +build linux
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func Test_mountUses(t *testing.T) {
+	dev := unix.Mkdev(8, 16)
+	type config struct {
+		line       string
+		own        bool
+		mountPoint string
+	}
+	tests := []config{
+		// The target itself is only skipped in the own namespace.
+		{"36 25 8:16 / /run/mounts/m1 rw - ext4 /dev/sdb rw", true, ""},
+		{"36 25 8:16 / /run/mounts/m1 rw - ext4 /dev/sdb rw", false, "/run/mounts/m1"},
+		// A bind mount of the device elsewhere.
+		{"40 25 8:16 /data /var/data rw - ext4 /dev/sdb rw", true, "/var/data"},
+		// A mount under the target.
+		{"41 36 0:50 / /run/mounts/m1/proc rw - proc proc rw", true, "/run/mounts/m1/proc"},
+		// An overlay with its upper directory on the target.
+		{"42 25 0:51 / /run/gcs/c/1/rootfs rw - overlay overlay rw,lowerdir=/l1:/l2,upperdir=/run/mounts/m1/upper,workdir=/run/mounts/m1/work", true, "/run/gcs/c/1/rootfs"},
+		// Unrelated mounts.
+		{"43 25 8:32 / /run/mounts/m10 rw - ext4 /dev/sdc rw", true, ""},
+		{"44 25 0:52 / /run/gcs/c/2/rootfs rw - overlay overlay rw,lowerdir=/run/mounts/m10/layer", true, ""},
+	}
+	for _, test := range tests {
+		mountPoint, ok := mountUses(test.line, dev, "/run/mounts/m1", test.own)
+		if ok != (test.mountPoint != "") || mountPoint != test.mountPoint {
+			t.Fatalf("%q: expected mount point %q got %q", test.line, test.mountPoint, mountPoint)
+		}
+	}
+}
+
+func Test_FindHolders_Open_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := os.Create(filepath.Join(dir, "held"))
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer f.Close()
+
+	holders, err := FindHolders(dir)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	for _, h := range holders {
+		if h.PID == os.Getpid() && h.Use == "fd "+strconv.Itoa(int(f.Fd())) {
+			return
+		}
+	}
+	t.Fatalf("expected open fd %d of this process in holders: %v", f.Fd(), holders)
+}
@@ -0,0 +1,156 @@
+// +build linux
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Test dependencies
+var (
+	overlayParametersDir = "/sys/module/overlay/parameters"
+	kernelRelease        = func() (string, error) {
+		var uts unix.Utsname
+		if err := unix.Uname(&uts); err != nil {
+			return "", err
+		}
+		return unix.ByteSliceToString(uts.Release[:]), nil
+	}
+)
+
+// Names of the optional overlay features.
+const (
+	FeatureIndex       = "index"
+	FeatureMetacopy    = "metacopy"
+	FeatureRedirectDir = "redirect_dir"
+	FeatureVolatile    = "volatile"
+)
+
+// Options are the optional features of an overlay mount. Empty values leave
+// the kernel defaults in place.
+type Options struct {
+	// Index is "on" or "off".
+	Index string
+	// Metacopy is "on" or "off".
+	Metacopy string
+	// RedirectDir is "on", "follow", "nofollow" or "off".
+	RedirectDir string
+	// Volatile skips all syncs of the upper directory. A volatile overlay
+	// cannot be reliably remounted after a crash.
+	Volatile bool
+}
+
+// Validate returns an error if any of the values of `o` are invalid.
+func (o *Options) Validate() error {
+	check := func(name, value string, valid ...string) error {
+		if value == "" {
+			return nil
+		}
+		for _, v := range valid {
+			if value == v {
+				return nil
+			}
+		}
+		return errors.Errorf("invalid overlay option %s=%s, must be one of: %s", name, value, strings.Join(valid, ", "))
+	}
+	if err := check(FeatureIndex, o.Index, "on", "off"); err != nil {
+		return err
+	}
+	if err := check(FeatureMetacopy, o.Metacopy, "on", "off"); err != nil {
+		return err
+	}
+	return check(FeatureRedirectDir, o.RedirectDir, "on", "follow", "nofollow", "off")
+}
+
+// mountOptions returns `o` as overlay mount options.
+func (o *Options) mountOptions() []string {
+	var options []string
+	if o.Index != "" {
+		options = append(options, FeatureIndex+"="+o.Index)
+	}
+	if o.Metacopy != "" {
+		options = append(options, FeatureMetacopy+"="+o.Metacopy)
+	}
+	if o.RedirectDir != "" {
+		options = append(options, FeatureRedirectDir+"="+o.RedirectDir)
+	}
+	if o.Volatile {
+		options = append(options, FeatureVolatile)
+	}
+	return options
+}
+
+// Features are the optional overlay features supported by the kernel.
+type Features struct {
+	Index       bool
+	Metacopy    bool
+	RedirectDir bool
+	Volatile    bool
+}
+
+// DetectFeatures returns the optional overlay features supported by the
+// kernel. Features with a module parameter are supported when the parameter
+// exists. Volatile has no parameter and is supported since Linux 5.10.
+func DetectFeatures() Features {
+	hasParameter := func(name string) bool {
+		_, err := os.Stat(filepath.Join(overlayParametersDir, name))
+		return err == nil
+	}
+	features := Features{
+		Index:       hasParameter(FeatureIndex),
+		Metacopy:    hasParameter(FeatureMetacopy),
+		RedirectDir: hasParameter(FeatureRedirectDir),
+	}
+	if release, err := kernelRelease(); err == nil {
+		var major, minor int
+		if _, err := fmt.Sscanf(release, "%d.%d", &major, &minor); err == nil {
+			features.Volatile = major > 5 || (major == 5 && minor >= 10)
+		}
+	}
+	return features
+}
+
+// Names returns the names of the supported features.
+func (f Features) Names() []string {
+	var names []string
+	if f.Index {
+		names = append(names, FeatureIndex)
+	}
+	if f.Metacopy {
+		names = append(names, FeatureMetacopy)
+	}
+	if f.RedirectDir {
+		names = append(names, FeatureRedirectDir)
+	}
+	if f.Volatile {
+		names = append(names, FeatureVolatile)
+	}
+	return names
+}
+
+// Check returns an error if `o` uses a feature that is not supported.
+func (f Features) Check(o *Options) error {
+	var unsupported []string
+	if o.Index != "" && !f.Index {
+		unsupported = append(unsupported, FeatureIndex)
+	}
+	if o.Metacopy != "" && !f.Metacopy {
+		unsupported = append(unsupported, FeatureMetacopy)
+	}
+	if o.RedirectDir != "" && !f.RedirectDir {
+		unsupported = append(unsupported, FeatureRedirectDir)
+	}
+	if o.Volatile && !f.Volatile {
+		unsupported = append(unsupported, FeatureVolatile)
+	}
+	if len(unsupported) > 0 {
+		return errors.Errorf("overlay features not supported by the kernel: %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// +build linux
+
+package overlay
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_DetectFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"index", "redirect_dir", "xino_auto"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatalf("failed to write parameter: %v", err)
+		}
+	}
+
+	oldDir, oldRelease := overlayParametersDir, kernelRelease
+	defer func() {
+		overlayParametersDir, kernelRelease = oldDir, oldRelease
+	}()
+	overlayParametersDir = dir
+
+	type config struct {
+		release  string
+		expected []string
+	}
+	tests := []config{
+		{"4.19.112-microsoft-standard", []string{"index", "redirect_dir"}},
+		{"5.10.16.3-microsoft-standard", []string{"index", "redirect_dir", "volatile"}},
+		{"6.1.0", []string{"index", "redirect_dir", "volatile"}},
+	}
+	for _, test := range tests {
+		release := test.release
+		kernelRelease = func() (string, error) {
+			return release, nil
+		}
+		if names := DetectFeatures().Names(); !reflect.DeepEqual(names, test.expected) {
+			t.Fatalf("%s: expected features: %v got: %v", test.release, test.expected, names)
+		}
+	}
+}
+
+func Test_Mount_Options(t *testing.T) {
+	undo := captureTestMethods()
+	defer undo.Close()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	var data string
+	unixMount = func(source string, target string, fstype string, flags uintptr, d string) error {
+		data = d
+		return nil
+	}
+
+	options := &Options{Index: "off", Metacopy: "on", Volatile: true}
+	err := Mount(context.Background(), []string{"/layer1"}, "/upper", "/work", "/root", false, options)
+	if err != nil {
+		t.Fatalf("expected no error got: %v", err)
+	}
+	expected := "lowerdir=/layer1,upperdir=/upper,workdir=/work,index=off,metacopy=on,volatile"
+	if data != expected {
+		t.Fatalf("expected data: %q got: %q", expected, data)
+	}
+
+	if err := Mount(context.Background(), []string{"/layer1"}, "", "", "/root", true, &Options{Volatile: true}); err == nil {
+		t.Fatal("expected error for volatile without an upperdirPath")
+	}
+	if err := Mount(context.Background(), []string{"/layer1"}, "", "", "/root", true, &Options{RedirectDir: "always"}); err == nil {
+		t.Fatal("expected error for an invalid redirect_dir")
+	}
+}
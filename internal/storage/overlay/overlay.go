@@ -4,10 +4,14 @@ package overlay
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"golang.org/x/sys/unix"
@@ -15,11 +19,102 @@ import (
 
 // Test dependencies
 var (
-	osMkdirAll  = os.MkdirAll
-	osRemoveAll = os.RemoveAll
-	unixMount   = unix.Mount
+	osMkdirAll         = os.MkdirAll
+	osRemoveAll        = os.RemoveAll
+	unixMount          = unix.Mount
+	ioutilReadDir      = ioutil.ReadDir
+	storageUnmountPath = storage.UnmountPath
+
+	// mountDataLimit is the maximum length of the data of a mount including
+	// its terminating NUL. The kernel copies at most a page of it.
+	mountDataLimit = os.Getpagesize()
 )
 
+// maxLayersPerMount is the maximum number of lower layers of a single overlay
+// mount (OVL_MAX_STACK).
+const maxLayersPerMount = 500
+
+// layerGroupsPath returns the directory the intermediate overlays of the
+// overlay at `rootfsPath` are mounted in.
+func layerGroupsPath(rootfsPath string) string {
+	return filepath.Clean(rootfsPath) + "-layers"
+}
+
+// mountData returns the data of an overlay mount of `lowerdirs` with the
+// additional `options`.
+func mountData(lowerdirs []string, options []string) string {
+	return strings.Join(append([]string{"lowerdir=" + strings.Join(lowerdirs, ":")}, options...), ",")
+}
+
+// fitsMountData returns true if an overlay mount of `lowerdirs` with the
+// additional `options` is within the limits of the kernel.
+func fitsMountData(lowerdirs []string, options []string) bool {
+	return len(lowerdirs) <= maxLayersPerMount && len(mountData(lowerdirs, options)) < mountDataLimit
+}
+
+// mountLayerGroups splits `layerPaths` into groups that fit in a single
+// overlay mount and mounts each group as a readonly overlay in `groupsPath`.
+// Returns the paths that replace `layerPaths`, in the same order, as the lower
+// layers of an overlay. On failure all created groups are cleaned up.
+//
+// The kernel limits overlays to a stacking depth of 2 so the groups cannot be
+// nested further.
+func mountLayerGroups(ctx context.Context, layerPaths []string, groupsPath string) (_ []string, err error) {
+	var groups [][]string
+	var current []string
+	for _, p := range layerPaths {
+		if len(current) > 0 && !fitsMountData(append(current[:len(current):len(current)], p), nil) {
+			groups = append(groups, current)
+			current = nil
+		}
+		current = append(current, p)
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+
+	defer func() {
+		if err != nil {
+			unmountLayerGroups(ctx, groupsPath)
+		}
+	}()
+	lowerdirs := make([]string, len(groups))
+	for i, group := range groups {
+		// A single layer needs no overlay.
+		if len(group) == 1 {
+			lowerdirs[i] = group[0]
+			continue
+		}
+		target := filepath.Join(groupsPath, strconv.Itoa(i))
+		if err := osMkdirAll(target, 0755); err != nil {
+			return nil, errors.Wrapf(err, "failed to create directory for layer group %s", target)
+		}
+		if err := unixMount("overlay", target, "overlay", unix.MS_RDONLY, mountData(group, nil)); err != nil {
+			return nil, errors.Wrapf(err, "failed to mount layer group using overlayfs %s", target)
+		}
+		lowerdirs[i] = target
+	}
+	return lowerdirs, nil
+}
+
+// unmountLayerGroups unmounts and removes all the intermediate overlays in
+// `groupsPath`.
+func unmountLayerGroups(ctx context.Context, groupsPath string) error {
+	groups, err := ioutilReadDir(groupsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, group := range groups {
+		if err := storageUnmountPath(ctx, filepath.Join(groupsPath, group.Name()), true); err != nil {
+			return err
+		}
+	}
+	return osRemoveAll(groupsPath)
+}
+
 // Mount creates an overlay mount with `layerPaths` at `rootfsPath`.
 //
 // If `upperdirPath != ""` the path will be created. On mount failure the
@@ -30,8 +125,14 @@ var (
 //
 // Always creates `rootfsPath`. On mount failure the created `rootfsPath` will
 // be automatically cleaned up.
-func Mount(ctx context.Context, layerPaths []string, upperdirPath, workdirPath, rootfsPath string, readonly bool) (err error) {
-	_, span := trace.StartSpan(ctx, "overlay::Mount")
+//
+// If `layerPaths` are too many for a single overlay mount they are mounted in
+// groups as readonly overlays that become the lower layers of `rootfsPath`.
+// Use `Unmount` to unmount all of them.
+//
+// If `options != nil` its features are added to the mount of `rootfsPath`.
+func Mount(ctx context.Context, layerPaths []string, upperdirPath, workdirPath, rootfsPath string, readonly bool, options *Options) (err error) {
+	ctx, span := trace.StartSpan(ctx, "overlay::Mount")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 
@@ -51,7 +152,43 @@ func Mount(ctx context.Context, layerPaths []string, upperdirPath, workdirPath,
 		return errors.Errorf("upperdirPath: %q, and workdirPath: %q must be empty when readonly==true", upperdirPath, workdirPath)
 	}
 
-	options := []string{"lowerdir=" + lowerdir}
+	var featureOptions []string
+	if options != nil {
+		if err := options.Validate(); err != nil {
+			return err
+		}
+		if options.Volatile && upperdirPath == "" {
+			return errors.New("volatile requires an upperdirPath")
+		}
+		featureOptions = options.mountOptions()
+	}
+	var extraOptions []string
+	if upperdirPath != "" {
+		extraOptions = append(extraOptions, "upperdir="+upperdirPath)
+	}
+	if workdirPath != "" {
+		extraOptions = append(extraOptions, "workdir="+workdirPath)
+	}
+	extraOptions = append(extraOptions, featureOptions...)
+	if !fitsMountData(layerPaths, extraOptions) {
+		groupsPath := layerGroupsPath(rootfsPath)
+		var lowerdirs []string
+		lowerdirs, err = mountLayerGroups(ctx, layerPaths, groupsPath)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				unmountLayerGroups(ctx, groupsPath)
+			}
+		}()
+		if !fitsMountData(lowerdirs, extraOptions) {
+			return errors.Errorf("too many layers to mount: %d", len(layerPaths))
+		}
+		lowerdir = strings.Join(lowerdirs, ":")
+	}
+
+	mountOptions := []string{"lowerdir=" + lowerdir}
 	if upperdirPath != "" {
 		if err := osMkdirAll(upperdirPath, 0755); err != nil {
 			return errors.Wrap(err, "failed to create upper directory in scratch space")
@@ -61,7 +198,7 @@ func Mount(ctx context.Context, layerPaths []string, upperdirPath, workdirPath,
 				osRemoveAll(upperdirPath)
 			}
 		}()
-		options = append(options, "upperdir="+upperdirPath)
+		mountOptions = append(mountOptions, "upperdir="+upperdirPath)
 	}
 	if workdirPath != "" {
 		if err := osMkdirAll(workdirPath, 0755); err != nil {
@@ -72,8 +209,9 @@ func Mount(ctx context.Context, layerPaths []string, upperdirPath, workdirPath,
 				osRemoveAll(workdirPath)
 			}
 		}()
-		options = append(options, "workdir="+workdirPath)
+		mountOptions = append(mountOptions, "workdir="+workdirPath)
 	}
+	mountOptions = append(mountOptions, featureOptions...)
 	if err := osMkdirAll(rootfsPath, 0755); err != nil {
 		return errors.Wrapf(err, "failed to create directory for container root filesystem %s", rootfsPath)
 	}
@@ -86,8 +224,23 @@ func Mount(ctx context.Context, layerPaths []string, upperdirPath, workdirPath,
 	if readonly {
 		flags |= unix.MS_RDONLY
 	}
-	if err := unixMount("overlay", rootfsPath, "overlay", flags, strings.Join(options, ",")); err != nil {
+	if err := unixMount("overlay", rootfsPath, "overlay", flags, strings.Join(mountOptions, ",")); err != nil {
 		return errors.Wrapf(err, "failed to mount container root filesystem using overlayfs %s", rootfsPath)
 	}
 	return nil
 }
+
+// Unmount unmounts the overlay at `rootfsPath` and any intermediate overlays
+// of its layers, and removes their directories.
+func Unmount(ctx context.Context, rootfsPath string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "overlay::Unmount")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(trace.StringAttribute("rootfsPath", rootfsPath))
+
+	if err := storageUnmountPath(ctx, rootfsPath, true); err != nil {
+		return err
+	}
+	return unmountLayerGroups(ctx, layerGroupsPath(rootfsPath))
+}
@@ -5,19 +5,26 @@ package overlay
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
+	"reflect"
 	"testing"
 )
 
 type undo struct {
-	osMkdirAll  func(string, os.FileMode) error
-	osRemoveAll func(string) error
-	unixMount   func(string, string, string, uintptr, string) error
+	osMkdirAll         func(string, os.FileMode) error
+	osRemoveAll        func(string) error
+	unixMount          func(string, string, string, uintptr, string) error
+	ioutilReadDir      func(string) ([]os.FileInfo, error)
+	storageUnmountPath func(context.Context, string, bool) error
 }
 
 func (u *undo) Close() {
 	osMkdirAll = u.osMkdirAll
+	osRemoveAll = u.osRemoveAll
 	unixMount = u.unixMount
+	ioutilReadDir = u.ioutilReadDir
+	storageUnmountPath = u.storageUnmountPath
 }
 
 // Captures the actual product function context and returns them on `Close()`.
@@ -25,13 +32,17 @@ func (u *undo) Close() {
 // function will cause the test to panic.
 func captureTestMethods() *undo {
 	u := &undo{
-		osMkdirAll:  osMkdirAll,
-		osRemoveAll: osRemoveAll,
-		unixMount:   unixMount,
+		osMkdirAll:         osMkdirAll,
+		osRemoveAll:        osRemoveAll,
+		unixMount:          unixMount,
+		ioutilReadDir:      ioutilReadDir,
+		storageUnmountPath: storageUnmountPath,
 	}
 	osMkdirAll = nil
 	osRemoveAll = nil
 	unixMount = nil
+	ioutilReadDir = nil
+	storageUnmountPath = nil
 	return u
 }
 
@@ -76,7 +87,7 @@ func Test_Mount_Success(t *testing.T) {
 		return nil
 	}
 
-	err := Mount(context.Background(), []string{"/layer1", "/layer2"}, "/upper", "/work", "/root", false)
+	err := Mount(context.Background(), []string{"/layer1", "/layer2"}, "/upper", "/work", "/root", false, nil)
 	if err != nil {
 		t.Fatalf("expected no error got: %v", err)
 	}
@@ -120,7 +131,7 @@ func Test_Mount_Readonly_Success(t *testing.T) {
 		return nil
 	}
 
-	err := Mount(context.Background(), []string{"/layer1", "/layer2"}, "", "", "/root", false)
+	err := Mount(context.Background(), []string{"/layer1", "/layer2"}, "", "", "/root", false, nil)
 	if err != nil {
 		t.Fatalf("expected no error got: %v", err)
 	}
@@ -128,3 +139,81 @@ func Test_Mount_Readonly_Success(t *testing.T) {
 		t.Fatal("expected root to be created")
 	}
 }
+
+func Test_Mount_Layer_Groups_Success(t *testing.T) {
+	undo := captureTestMethods()
+	defer undo.Close()
+
+	limit := mountDataLimit
+	defer func() {
+		mountDataLimit = limit
+	}()
+	// Fits "lowerdir=" and at most 4 layers.
+	mountDataLimit = 48
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	mounts := make(map[string]string)
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		mounts[target] = data
+		return nil
+	}
+
+	var layers []string
+	for i := 1; i <= 9; i++ {
+		layers = append(layers, fmt.Sprintf("/layer%d", i))
+	}
+	err := Mount(context.Background(), layers, "", "", "/root", true, nil)
+	if err != nil {
+		t.Fatalf("expected no error got: %v", err)
+	}
+	expected := map[string]string{
+		"/root-layers/0": "lowerdir=/layer1:/layer2:/layer3:/layer4",
+		"/root-layers/1": "lowerdir=/layer5:/layer6:/layer7:/layer8",
+		"/root":          "lowerdir=/root-layers/0:/root-layers/1:/layer9",
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("expected mounts: %v got: %v", expected, mounts)
+	}
+}
+
+func Test_Mount_Layer_Groups_Failure_Cleanup(t *testing.T) {
+	undo := captureTestMethods()
+	defer undo.Close()
+
+	limit := mountDataLimit
+	defer func() {
+		mountDataLimit = limit
+	}()
+	mountDataLimit = 48
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if target == "/root" {
+			return errors.New("mount failed")
+		}
+		return nil
+	}
+	var removed []string
+	osRemoveAll = func(path string) error {
+		removed = append(removed, path)
+		return nil
+	}
+	ioutilReadDir = func(path string) ([]os.FileInfo, error) {
+		if path != "/root-layers" {
+			t.Errorf("expected ReadDir of '/root-layers' got: %v", path)
+		}
+		return nil, nil
+	}
+
+	err := Mount(context.Background(), []string{"/layer1", "/layer2", "/layer3", "/layer4", "/layer5"}, "", "", "/root", true, nil)
+	if err == nil {
+		t.Fatal("expected mount error")
+	}
+	if !reflect.DeepEqual(removed, []string{"/root", "/root-layers"}) {
+		t.Fatalf("expected root and layer groups to be removed got: %v", removed)
+	}
+}
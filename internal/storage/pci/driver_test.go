@@ -0,0 +1,105 @@
+// +build linux
+
+package pci
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupFakeSysfs creates a pci sysfs tree with the device `busLocation` bound
+// to `driver` and the drivers `drivers`. It returns a function that restores
+// the real paths.
+func setupFakeSysfs(t *testing.T, busLocation, driver string, drivers ...string) func() {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	oldDevices, oldDrivers, oldProbe := pciDevicesPath, pciDriversPath, pciDriversProbePath
+	pciDevicesPath = filepath.Join(dir, "devices")
+	pciDriversPath = filepath.Join(dir, "drivers")
+	pciDriversProbePath = filepath.Join(dir, "drivers_probe")
+
+	for _, d := range drivers {
+		if err := os.MkdirAll(filepath.Join(pciDriversPath, d), 0755); err != nil {
+			t.Fatalf("failed to create driver: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(pciDriversPath, d, "unbind"), nil, 0600); err != nil {
+			t.Fatalf("failed to create unbind: %v", err)
+		}
+	}
+	devicePath := filepath.Join(pciDevicesPath, busLocation)
+	if err := os.MkdirAll(devicePath, 0755); err != nil {
+		t.Fatalf("failed to create device: %v", err)
+	}
+	if driver != "" {
+		if err := os.Symlink(filepath.Join(pciDriversPath, driver), filepath.Join(devicePath, "driver")); err != nil {
+			t.Fatalf("failed to link driver: %v", err)
+		}
+	}
+	return func() {
+		pciDevicesPath, pciDriversPath, pciDriversProbePath = oldDevices, oldDrivers, oldProbe
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_BindDriver_Already_Bound(t *testing.T) {
+	defer setupFakeSysfs(t, "1234:00:00.0", "vfio-pci", "vfio-pci")()
+
+	if err := BindDriver(context.Background(), "1234:00:00.0", "vfio-pci"); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if _, err := os.Stat(pciDriversProbePath); !os.IsNotExist(err) {
+		t.Fatal("expected the device not to be probed")
+	}
+}
+
+func Test_BindDriver_Missing_Driver(t *testing.T) {
+	defer setupFakeSysfs(t, "1234:00:00.0", "nvidia", "nvidia")()
+
+	if err := BindDriver(context.Background(), "1234:00:00.0", "vfio-pci"); err == nil {
+		t.Fatal("expected error binding to a driver that is not available")
+	}
+}
+
+func Test_BindDriver_Rebinds(t *testing.T) {
+	defer setupFakeSysfs(t, "1234:00:00.0", "nvidia", "nvidia", "vfio-pci")()
+
+	// The fake device is never rebound so the bind must fail its check after
+	// overriding, unbinding and probing the device.
+	if err := BindDriver(context.Background(), "1234:00:00.0", "vfio-pci"); err == nil {
+		t.Fatal("expected error when the device is not bound after probing")
+	}
+	for path, expected := range map[string]string{
+		filepath.Join(pciDevicesPath, "1234:00:00.0", "driver_override"): "vfio-pci",
+		filepath.Join(pciDriversPath, "nvidia", "unbind"):                "1234:00:00.0",
+		pciDriversProbePath: "1234:00:00.0",
+	} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if string(b) != expected {
+			t.Fatalf("expected %s to contain %q got %q", path, expected, string(b))
+		}
+	}
+}
+
+func Test_UnbindDriver(t *testing.T) {
+	defer setupFakeSysfs(t, "1234:00:00.0", "vfio-pci", "vfio-pci")()
+
+	if err := UnbindDriver(context.Background(), "1234:00:00.0"); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(pciDriversPath, "vfio-pci", "unbind"))
+	if err != nil || string(b) != "1234:00:00.0" {
+		t.Fatalf("expected device to be unbound got: %q, %v", string(b), err)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(pciDevicesPath, "1234:00:00.0", "driver_override"))
+	if err != nil || string(b) != "\n" {
+		t.Fatalf("expected driver override to be cleared got: %q, %v", string(b), err)
+	}
+}
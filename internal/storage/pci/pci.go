@@ -5,16 +5,28 @@ package pci
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/Microsoft/opengcs/internal/oc"
 	"github.com/Microsoft/opengcs/internal/storage"
 	"github.com/Microsoft/opengcs/internal/storage/vmbus"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
 )
 
 var storageWaitForFileMatchingPattern = storage.WaitForFileMatchingPattern
 var vmbusWaitForDevicePath = vmbus.WaitForDevicePath
 
+// Test dependencies
+var (
+	pciDevicesPath      = "/sys/bus/pci/devices"
+	pciDriversPath      = "/sys/bus/pci/drivers"
+	pciDriversProbePath = "/sys/bus/pci/drivers_probe"
+)
+
 // WaitForPCIDeviceFromVMBusGUID waits for bus location path of the device to be present
 func WaitForPCIDeviceFromVMBusGUID(ctx context.Context, vmBusGUID string) error {
 	_, err := FindDeviceBusLocationFromVMBusGUID(ctx, vmBusGUID)
@@ -62,3 +74,86 @@ func findVMBusPCIDevice(ctx context.Context, pciDirFullPath string) (string, err
 	_, busFile := filepath.Split(busFileFullPath)
 	return busFile, nil
 }
+
+// Driver returns the name of the driver bound to the pci device at
+// `busLocation` or "" if no driver is bound.
+func Driver(busLocation string) (string, error) {
+	link, err := os.Readlink(filepath.Join(pciDevicesPath, busLocation, "driver"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return filepath.Base(link), nil
+}
+
+// BindDriver binds the pci device at `busLocation` to the driver `driver`,
+// such as `vfio-pci`, unbinding it from its current driver first. The device
+// stays bound to `driver` through driver_override until `UnbindDriver`.
+func BindDriver(ctx context.Context, busLocation, driver string) (err error) {
+	_, span := trace.StartSpan(ctx, "pci::BindDriver")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("busLocation", busLocation),
+		trace.StringAttribute("driver", driver))
+
+	if _, err := os.Stat(filepath.Join(pciDriversPath, driver)); err != nil {
+		return errors.Wrapf(err, "pci driver %s is not available", driver)
+	}
+	current, err := Driver(busLocation)
+	if err != nil {
+		return err
+	}
+	if current == driver {
+		return nil
+	}
+	devicePath := filepath.Join(pciDevicesPath, busLocation)
+	if err := ioutil.WriteFile(filepath.Join(devicePath, "driver_override"), []byte(driver), 0); err != nil {
+		return errors.Wrapf(err, "failed to set driver override of pci device %s", busLocation)
+	}
+	if current != "" {
+		if err := ioutil.WriteFile(filepath.Join(devicePath, "driver", "unbind"), []byte(busLocation), 0); err != nil {
+			return errors.Wrapf(err, "failed to unbind pci device %s from %s", busLocation, current)
+		}
+	}
+	if err := ioutil.WriteFile(pciDriversProbePath, []byte(busLocation), 0); err != nil {
+		return errors.Wrapf(err, "failed to probe pci device %s", busLocation)
+	}
+	bound, err := Driver(busLocation)
+	if err != nil {
+		return err
+	}
+	if bound != driver {
+		return errors.Errorf("pci device %s is bound to %q instead of %s", busLocation, bound, driver)
+	}
+	return nil
+}
+
+// UnbindDriver unbinds the pci device at `busLocation` from its driver and
+// clears its driver_override.
+func UnbindDriver(ctx context.Context, busLocation string) (err error) {
+	_, span := trace.StartSpan(ctx, "pci::UnbindDriver")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(trace.StringAttribute("busLocation", busLocation))
+
+	current, err := Driver(busLocation)
+	if err != nil {
+		return err
+	}
+	devicePath := filepath.Join(pciDevicesPath, busLocation)
+	if current != "" {
+		if err := ioutil.WriteFile(filepath.Join(devicePath, "driver", "unbind"), []byte(busLocation), 0); err != nil {
+			return errors.Wrapf(err, "failed to unbind pci device %s from %s", busLocation, current)
+		}
+	}
+	// Writing a newline clears the override.
+	if err := ioutil.WriteFile(filepath.Join(devicePath, "driver_override"), []byte("\n"), 0); err != nil {
+		return errors.Wrapf(err, "failed to clear driver override of pci device %s", busLocation)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"syscall"
 
 	"github.com/Microsoft/opengcs/internal/oc"
@@ -15,7 +16,76 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-const packetPayloadBytes = 65536
+const (
+	packetPayloadBytes = 65536
+
+	// minMsize and maxMsize are the limits of the msize of the fd transport.
+	minMsize = 4096
+	maxMsize = 1024 * 1024
+)
+
+// Cache modes of a Plan9 mount.
+const (
+	CacheNone    = "none"
+	CacheLoose   = "loose"
+	CacheFscache = "fscache"
+	CacheMmap    = "mmap"
+)
+
+// Options are the tunable parameters of a Plan9 mount. Zero values use the
+// defaults.
+type Options struct {
+	// Msize is the maximum 9p message size and the size of the socket
+	// buffers. Defaults to 65536.
+	Msize uint32
+	// Cache is the cache mode: "none", "loose", "fscache" or "mmap".
+	Cache string
+	// Access is the access mode: "user", "any", "client" or a numeric uid
+	// that is the only user allowed access.
+	Access string
+	// DefaultUID and DefaultGID are the owner of files whose owner the server
+	// does not report.
+	DefaultUID *uint32
+	DefaultGID *uint32
+}
+
+// Validate returns an error if any of the values of `o` are invalid.
+func (o *Options) Validate() error {
+	if o.Msize != 0 && (o.Msize < minMsize || o.Msize > maxMsize) {
+		return errors.Errorf("invalid msize %d, must be between %d and %d", o.Msize, minMsize, maxMsize)
+	}
+	switch o.Cache {
+	case "", CacheNone, CacheLoose, CacheFscache, CacheMmap:
+	default:
+		return errors.Errorf("invalid cache mode %q, must be one of: %s, %s, %s, %s", o.Cache, CacheNone, CacheLoose, CacheFscache, CacheMmap)
+	}
+	switch o.Access {
+	case "", "user", "any", "client":
+	default:
+		if _, err := strconv.ParseUint(o.Access, 10, 32); err != nil {
+			return errors.Errorf("invalid access mode %q, must be user, any, client or a uid", o.Access)
+		}
+	}
+	return nil
+}
+
+// mountData returns the mount options of `o`, besides msize.
+func (o *Options) mountData() string {
+	var data string
+	if o.Cache != "" {
+		data += ",cache=" + o.Cache
+	}
+	if o.Access != "" {
+		data += ",access=" + o.Access
+	}
+	if o.DefaultUID != nil {
+		data += fmt.Sprintf(",dfltuid=%d", *o.DefaultUID)
+	}
+	if o.DefaultGID != nil {
+		data += fmt.Sprintf(",dfltgid=%d", *o.DefaultGID)
+	}
+	return data
+}
 
 // Test dependencies
 var (
@@ -28,7 +98,9 @@ var (
 //
 // `target` will be created. On mount failure the created `target` will be
 // automatically cleaned up.
-func Mount(ctx context.Context, vsock transport.Transport, target, share string, port uint32, readonly bool) (err error) {
+//
+// If `options != nil` it overrides the default mount parameters.
+func Mount(ctx context.Context, vsock transport.Transport, target, share string, port uint32, readonly bool, options *Options) (err error) {
 	_, span := trace.StartSpan(ctx, "plan9::Mount")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
@@ -39,6 +111,17 @@ func Mount(ctx context.Context, vsock transport.Transport, target, share string,
 		trace.Int64Attribute("port", int64(port)),
 		trace.BoolAttribute("readonly", readonly))
 
+	if options == nil {
+		options = &Options{}
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	msize := packetPayloadBytes
+	if options.Msize != 0 {
+		msize = int(options.Msize)
+	}
+
 	if err := osMkdirAll(target, 0700); err != nil {
 		return err
 	}
@@ -59,7 +142,7 @@ func Mount(ctx context.Context, vsock transport.Transport, target, share string,
 	defer f.Close()
 
 	var mountOptions uintptr
-	data := fmt.Sprintf("trans=fd,rfdno=%d,wfdno=%d,msize=%d", f.Fd(), f.Fd(), packetPayloadBytes)
+	data := fmt.Sprintf("trans=fd,rfdno=%d,wfdno=%d,msize=%d", f.Fd(), f.Fd(), msize) + options.mountData()
 	if readonly {
 		mountOptions |= unix.MS_RDONLY
 		data += ",noload"
@@ -69,13 +152,13 @@ func Mount(ctx context.Context, vsock transport.Transport, target, share string,
 	}
 
 	// set socket options to maximize bandwidth
-	err = syscall.SetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVBUF, packetPayloadBytes)
+	err = syscall.SetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVBUF, msize)
 	if err != nil {
-		return errors.Wrapf(err, "failed to set sock option syscall.SO_RCVBUF to %v on fd %v", packetPayloadBytes, f.Fd())
+		return errors.Wrapf(err, "failed to set sock option syscall.SO_RCVBUF to %v on fd %v", msize, f.Fd())
 	}
-	err = syscall.SetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_SNDBUF, packetPayloadBytes)
+	err = syscall.SetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_SNDBUF, msize)
 	if err != nil {
-		return errors.Wrapf(err, "failed to set sock option syscall.SO_SNDBUF to %v on fd %v", packetPayloadBytes, f.Fd())
+		return errors.Wrapf(err, "failed to set sock option syscall.SO_SNDBUF to %v on fd %v", msize, f.Fd())
 	}
 	if err := unixMount(target, target, "9p", mountOptions, data); err != nil {
 		return errors.Wrapf(err, "failed to mount directory for mapped directory %s", target)
@@ -0,0 +1,50 @@
+// +build linux
+
+package plan9
+
+import (
+	"testing"
+)
+
+func Test_Options_Validate(t *testing.T) {
+	valid := []Options{
+		{},
+		{Msize: minMsize, Cache: CacheLoose},
+		{Msize: maxMsize, Cache: CacheMmap, Access: "client"},
+		{Access: "1000"},
+	}
+	for _, o := range valid {
+		if err := o.Validate(); err != nil {
+			t.Fatalf("%+v: expected nil error got: %v", o, err)
+		}
+	}
+	invalid := []Options{
+		{Msize: minMsize - 1},
+		{Msize: maxMsize + 1},
+		{Cache: "always"},
+		{Access: "root"},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Fatalf("%+v: expected error", o)
+		}
+	}
+}
+
+func Test_Options_mountData(t *testing.T) {
+	uid, gid := uint32(1000), uint32(0)
+	o := Options{
+		Msize:      262144,
+		Cache:      CacheFscache,
+		Access:     "user",
+		DefaultUID: &uid,
+		DefaultGID: &gid,
+	}
+	expected := ",cache=fscache,access=user,dfltuid=1000,dfltgid=0"
+	if data := o.mountData(); data != expected {
+		t.Fatalf("expected data: %q got: %q", expected, data)
+	}
+	if data := (&Options{}).mountData(); data != "" {
+		t.Fatalf("expected no data got: %q", data)
+	}
+}
@@ -22,6 +22,9 @@ var (
 	osMkdirAll  = os.MkdirAll
 	osRemoveAll = os.RemoveAll
 	unixMount   = unix.Mount
+
+	// detectFilesystem is stubbed to avoid reading a real device.
+	detectFilesystem = storage.DetectFilesystem
 )
 
 const (
@@ -30,8 +33,9 @@ const (
 	verityDeviceFmt = "dm-verity-pmem%d-%s"
 )
 
-// mountInternal mounts source to target via unix.Mount
-func mountInternal(ctx context.Context, source, target string) (err error) {
+// mountInternal mounts source to target via unix.Mount. If `fsType` is empty
+// the filesystem is detected from the superblock of `source`.
+func mountInternal(ctx context.Context, source, target, fsType string) (err error) {
 	if err := osMkdirAll(target, 0700); err != nil {
 		return err
 	}
@@ -43,8 +47,16 @@ func mountInternal(ctx context.Context, source, target string) (err error) {
 		}
 	}()
 
-	flags := uintptr(unix.MS_RDONLY)
-	if err := unixMount(source, target, "ext4", flags, "noload"); err != nil {
+	if fsType == "" {
+		if fsType, err = detectFilesystem(source); err != nil {
+			return errors.Wrapf(err, "failed to detect filesystem of %s", source)
+		}
+	}
+	flags, data, err := storage.FilesystemMountOptions(fsType, true)
+	if err != nil {
+		return err
+	}
+	if err := unixMount(source, target, fsType, flags, data); err != nil {
 		return errors.Wrapf(err, "failed to mount %s onto %s", source, target)
 	}
 	return nil
@@ -58,19 +70,28 @@ func mountInternal(ctx context.Context, source, target string) (err error) {
 // `target` will be created. On mount failure the created `target` will be
 // automatically cleaned up.
 //
-// Note: For now the platform only supports readonly pmem that is assumed to be
-// `ext4`.
+// `fsType` is the filesystem on the device. If empty it is detected from the
+// superblock of the device.
+//
+// Note: For now the platform only supports readonly pmem.
 //
 // Note: both mappingInfo and verityInfo can be non-nil at the same time, in that case
 // linear target is created first and it becomes the data/hash device for verity target.
-func Mount(ctx context.Context, device uint32, target string, mappingInfo *prot.DeviceMappingInfo, verityInfo *prot.DeviceVerityInfo) (err error) {
+func Mount(ctx context.Context, device uint32, target, fsType string, mappingInfo *prot.DeviceMappingInfo, verityInfo *prot.DeviceVerityInfo) (err error) {
 	mCtx, span := trace.StartSpan(ctx, "pmem::Mount")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 
 	span.AddAttributes(
 		trace.Int64Attribute("deviceNumber", int64(device)),
-		trace.StringAttribute("target", target))
+		trace.StringAttribute("target", target),
+		trace.StringAttribute("fsType", fsType))
+
+	if fsType != "" {
+		if err := storage.ValidateFilesystem(fsType); err != nil {
+			return err
+		}
+	}
 
 	devicePath := fmt.Sprintf(pMemFmt, device)
 	// dm linear target has to be created first. when verity info is also present, the linear target becomes the data
@@ -93,7 +114,7 @@ func Mount(ctx context.Context, device uint32, target string, mappingInfo *prot.
 
 	if verityInfo != nil {
 		dmVerityName := fmt.Sprintf(verityDeviceFmt, device, verityInfo.RootDigest)
-		if dmVerityPath, err := createDMVerityTarget(mCtx, devicePath, dmVerityName, target, verityInfo); err != nil {
+		if dmVerityPath, err := storage.CreateVerityTarget(mCtx, devicePath, dmVerityName, verityInfo); err != nil {
 			return err
 		} else {
 			devicePath = dmVerityPath
@@ -107,7 +128,7 @@ func Mount(ctx context.Context, device uint32, target string, mappingInfo *prot.
 		}()
 	}
 
-	return mountInternal(mCtx, devicePath, target)
+	return mountInternal(mCtx, devicePath, target, fsType)
 }
 
 // createDMLinearTarget creates dm-linear target from a given `device` slot location and `mappingInfo`
@@ -133,50 +154,6 @@ func createDMLinearTarget(ctx context.Context, devPath, devName string, target s
 	return devMapperPath, nil
 }
 
-// createDMVerityTarget creates a dm-verity target for a given device and mounts that target instead of the device itself
-//
-// verity target table
-// 0 417792 verity 1 /dev/sdb /dev/sdc 4096 4096 52224 1 sha256 2aa4f7b7b6...f4952060e8 762307f4bc8...d2a6b7595d8..
-// |    |     |    |     |     |        |    |    |    |    |              |                        |
-// start|     |    |  data_dev |  data_block | #blocks | hash_alg      root_digest                salt
-//     size   |  version    hash_dev         |     hash_offset
-//          target                       hash_block
-func createDMVerityTarget(ctx context.Context, devPath, devName, target string, verityInfo *prot.DeviceVerityInfo) (_ string, err error) {
-	_, span := trace.StartSpan(ctx, "pmem::createDMVerityTarget")
-	defer span.End()
-	defer func() { oc.SetSpanStatus(span, err) }()
-
-	dmBlocks := verityInfo.Ext4SizeInBytes / dm.BlockSize
-	dataBlocks := verityInfo.Ext4SizeInBytes / int64(verityInfo.BlockSize)
-	hashOffsetBlocks := dataBlocks
-	if verityInfo.SuperBlock {
-		hashOffsetBlocks++
-	}
-	hashes := fmt.Sprintf("%s %s %s", verityInfo.Algorithm, verityInfo.RootDigest, verityInfo.Salt)
-	blkInfo := fmt.Sprintf("%d %d %d %d", verityInfo.BlockSize, verityInfo.BlockSize, dataBlocks, hashOffsetBlocks)
-	devices := fmt.Sprintf("%s %s", devPath, devPath)
-
-	verityTarget := dm.Target{
-		SectorStart:    0,
-		LengthInBlocks: dmBlocks,
-		Type:           "verity",
-		Params:         fmt.Sprintf("%d %s %s %s", verityInfo.Version, devices, blkInfo, hashes),
-	}
-
-	span.AddAttributes(
-		trace.StringAttribute("devicePath", devPath),
-		trace.StringAttribute("target", target),
-		trace.Int64Attribute("sectorSize", dmBlocks),
-		trace.StringAttribute("verityTable", verityTarget.Params))
-
-	mapperPath, err := dm.CreateDevice(devName, dm.CreateReadOnly, []dm.Target{verityTarget})
-	if err != nil {
-		return "", errors.Wrapf(err, "failed to create dm-verity target: pmem device: %s", devPath)
-	}
-
-	return mapperPath, nil
-}
-
 // Unmount unmounts `target` and removes corresponding linear and verity targets when needed
 func Unmount(ctx context.Context, devNumber uint32, target string, mappingInfo *prot.DeviceMappingInfo, verityInfo *prot.DeviceVerityInfo) (err error) {
 	_, span := trace.StartSpan(ctx, "pmem::Unmount")
@@ -193,8 +170,8 @@ func Unmount(ctx context.Context, devNumber uint32, target string, mappingInfo *
 
 	if verityInfo != nil {
 		dmVerityName := fmt.Sprintf(verityDeviceFmt, devNumber, verityInfo.RootDigest)
-		if err := dm.RemoveDevice(dmVerityName); err != nil {
-			return errors.Wrapf(err, "failed to remove dm verity target: %s", dmVerityName)
+		if err := storage.RemoveVerityTarget(ctx, dmVerityName); err != nil {
+			return err
 		}
 	}
 
@@ -16,6 +16,7 @@ func clearTestDependencies() {
 	osMkdirAll = nil
 	osRemoveAll = nil
 	unixMount = nil
+	detectFilesystem = nil
 }
 
 func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
@@ -25,7 +26,7 @@ func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
 	osMkdirAll = func(path string, perm os.FileMode) error {
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, "", nil, nil)
+	err := Mount(context.Background(), 0, "", "ext4", nil, nil)
 	if errors.Cause(err) != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -49,7 +50,7 @@ func Test_Mount_Mkdir_ExpectedPath(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, target, nil, nil)
+	err := Mount(context.Background(), 0, target, "ext4", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -73,7 +74,7 @@ func Test_Mount_Mkdir_ExpectedPerm(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, target, nil, nil)
+	err := Mount(context.Background(), 0, target, "ext4", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -100,7 +101,7 @@ func Test_Mount_Calls_RemoveAll_OnMountFailure(t *testing.T) {
 		// Fake the mount failure to test remove is called
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, target, nil, nil)
+	err := Mount(context.Background(), 0, target, "ext4", nil, nil)
 	if errors.Cause(err) != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -127,7 +128,7 @@ func Test_Mount_Valid_Source(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), device, "/fake/path", nil, nil)
+	err := Mount(context.Background(), device, "/fake/path", "ext4", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -150,7 +151,7 @@ func Test_Mount_Valid_Target(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, expectedTarget, nil, nil)
+	err := Mount(context.Background(), 0, expectedTarget, "ext4", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -173,7 +174,7 @@ func Test_Mount_Valid_FSType(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, "/fake/path", nil, nil)
+	err := Mount(context.Background(), 0, "/fake/path", "ext4", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -196,7 +197,7 @@ func Test_Mount_Valid_Flags(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, "/fake/path", nil, nil)
+	err := Mount(context.Background(), 0, "/fake/path", "ext4", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -219,7 +220,36 @@ func Test_Mount_Valid_Data(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, "/fake/path", nil, nil)
+	err := Mount(context.Background(), 0, "/fake/path", "ext4", nil, nil)
+	if err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+}
+
+func Test_Mount_Detects_Filesystem(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set osRemoveAll because the mount succeeds. Expect it not to
+	// be called.
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	detectFilesystem = func(source string) (string, error) {
+		return "erofs", nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if fstype != "erofs" {
+			t.Errorf("expected fstype: erofs, got: %s", fstype)
+			return errors.New("unexpected fstype")
+		}
+		if flags != uintptr(unix.MS_RDONLY) || data != "" {
+			t.Errorf("expected flags: %v and empty data, got flags: %v data: %s", uintptr(unix.MS_RDONLY), flags, data)
+			return errors.New("unexpected options")
+		}
+		return nil
+	}
+	err := Mount(context.Background(), 0, "/fake/path", "", nil, nil)
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -0,0 +1,388 @@
+// +build linux
+
+package quota
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+// Test dependencies
+var (
+	procMountsFile = "/proc/mounts"
+)
+
+const (
+	// imageName is the name of the sparse file backing a loop mounted
+	// scratch.
+	imageName = "scratch.img"
+	// loopMountName is the name of the directory a loop backed scratch is
+	// mounted at.
+	loopMountName = "limited"
+	// loopAttachRetries is the number of times a free loop device is
+	// requested when another user takes the device first.
+	loopAttachRetries = 10
+
+	_FS_IOC_FSGETXATTR    = 0x801c581f
+	_FS_IOC_FSSETXATTR    = 0x401c5820
+	_FS_XFLAG_PROJINHERIT = 0x200
+
+	_PRJQUOTA    = 2
+	_Q_GETQUOTA  = 0x800007
+	_Q_SETQUOTA  = 0x800008
+	_QIF_BLIMITS = 1
+)
+
+// fsxattr is `struct fsxattr` used by the FS_IOC_FS[GS]ETXATTR ioctls.
+type fsxattr struct {
+	XFlags     uint32
+	ExtSize    uint32
+	NExtents   uint32
+	ProjID     uint32
+	CowExtSize uint32
+	_          [8]byte
+}
+
+// dqblk is `struct if_dqblk` used by the Q_[GS]ETQUOTA quotactls.
+type dqblk struct {
+	BHardLimit uint64
+	BSoftLimit uint64
+	CurSpace   uint64
+	IHardLimit uint64
+	ISoftLimit uint64
+	CurInodes  uint64
+	BTime      uint64
+	ITime      uint64
+	Valid      uint32
+	_          uint32
+}
+
+// lastProjectID is the last project ID given to a scratch. IDs are never
+// reused so that a new scratch never inherits the usage of an old one.
+var lastProjectID uint32 = 1000
+
+// Scratch is a directory on a scratch disk whose size is limited. The limit is
+// enforced with a project quota when the filesystem of the scratch disk is
+// mounted with project quotas enabled, and otherwise by a loop mounted sparse
+// file of the limit size. A scratch without a disk is a size limited tmpfs.
+type Scratch struct {
+	// Path is the directory whose size is limited.
+	Path string
+	// Limit is the size limit in bytes.
+	Limit uint64
+
+	// device and projectID are set when the limit is a project quota.
+	device    string
+	projectID uint32
+	// image is set when the limit is a loop mounted file.
+	image string
+	// tmpfs is set when the scratch is a tmpfs.
+	tmpfs bool
+}
+
+// findMount returns the source, filesystem type and options of the mount
+// containing `path`.
+func findMount(path string) (source, fsType string, options []string, err error) {
+	f, err := os.Open(procMountsFile)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer f.Close()
+
+	var target string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		mp := fields[1]
+		if path != mp && !strings.HasPrefix(path, strings.TrimSuffix(mp, "/")+"/") {
+			continue
+		}
+		if len(mp) >= len(target) {
+			target = mp
+			source, fsType, options = fields[0], fields[2], strings.Split(fields[3], ",")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", nil, err
+	}
+	if target == "" {
+		return "", "", nil, errors.Errorf("no mount found for %s", path)
+	}
+	return source, fsType, options, nil
+}
+
+// supportsProjectQuota returns true if a filesystem of type `fsType` mounted
+// with `options` enforces project quotas.
+func supportsProjectQuota(fsType string, options []string) bool {
+	if fsType != storage.FsTypeExt4 && fsType != storage.FsTypeXfs {
+		return false
+	}
+	for _, o := range options {
+		if o == "prjquota" || o == "pquota" {
+			return true
+		}
+	}
+	return false
+}
+
+func quotactl(cmd int, device string, id uint32, dq *dqblk) error {
+	p, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+	qcmd := cmd<<8 | _PRJQUOTA
+	if _, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, uintptr(qcmd), uintptr(unsafe.Pointer(p)), uintptr(id), uintptr(unsafe.Pointer(dq)), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setProject makes `dir` and everything created under it part of the project
+// `id`.
+func setProject(dir string, id uint32) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), _FS_IOC_FSGETXATTR, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errors.Wrapf(errno, "failed to get attributes of %s", dir)
+	}
+	attr.ProjID = id
+	attr.XFlags |= _FS_XFLAG_PROJINHERIT
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), _FS_IOC_FSSETXATTR, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errors.Wrapf(errno, "failed to set project of %s", dir)
+	}
+	return nil
+}
+
+// setProjectLimit sets the block limit of the project `id` on `device` to
+// `limit` bytes. A limit of 0 removes the limit.
+func setProjectLimit(device string, id uint32, limit uint64) error {
+	// Quota block limits are in 1KiB blocks.
+	dq := dqblk{
+		BHardLimit: (limit + 1023) / 1024,
+		BSoftLimit: (limit + 1023) / 1024,
+		Valid:      _QIF_BLIMITS,
+	}
+	if err := quotactl(_Q_SETQUOTA, device, id, &dq); err != nil {
+		return errors.Wrapf(err, "failed to set quota of project %d on %s", id, device)
+	}
+	return nil
+}
+
+// attachLoop attaches `image` to a free loop device that is detached
+// automatically once it is no longer used and returns it opened. The device
+// must stay open until it is mounted or it is detached immediately.
+func attachLoop(image string) (*os.File, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+	img, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	for i := 0; i < loopAttachRetries; i++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to find a free loop device")
+		}
+		path := fmt.Sprintf("/dev/loop%d", n)
+		loop, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(img.Fd())); err != nil {
+			loop.Close()
+			// Another user took the device since it was found free.
+			if err == unix.EBUSY {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to attach %s to %s", image, path)
+		}
+		info := unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR}
+		copy(info.File_name[:], image)
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, loop.Fd(), unix.LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return nil, errors.Wrapf(errno, "failed to set status of %s", path)
+		}
+		return loop, nil
+	}
+	return nil, errors.Errorf("failed to find a free loop device after %d attempts", loopAttachRetries)
+}
+
+// NewScratch limits the size of the directory `scratchPath` to `limit` bytes
+// and returns the limited scratch. Files must be created under the returned
+// `Scratch.Path` for the limit to apply, which is `scratchPath` itself when
+// project quotas are used.
+func NewScratch(ctx context.Context, scratchPath string, limit uint64) (_ *Scratch, err error) {
+	ctx, span := trace.StartSpan(ctx, "quota::NewScratch")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("scratchPath", scratchPath),
+		trace.Int64Attribute("limit", int64(limit)))
+
+	if limit == 0 {
+		return nil, errors.New("scratch size limit must be greater than 0")
+	}
+	if err := os.MkdirAll(scratchPath, 0755); err != nil {
+		return nil, err
+	}
+	source, fsType, options, err := findMount(scratchPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if supportsProjectQuota(fsType, options) {
+		s := &Scratch{
+			Path:      scratchPath,
+			Limit:     limit,
+			device:    source,
+			projectID: atomic.AddUint32(&lastProjectID, 1),
+		}
+		if err := setProject(scratchPath, s.projectID); err != nil {
+			return nil, err
+		}
+		if err := setProjectLimit(s.device, s.projectID, limit); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	log.G(ctx).WithField("fsType", fsType).Debug("project quotas unavailable, limiting scratch with a loop device")
+	s := &Scratch{
+		Path:  filepath.Join(scratchPath, loopMountName),
+		Limit: limit,
+		image: filepath.Join(scratchPath, imageName),
+	}
+	f, err := os.OpenFile(s.image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(s.image)
+		}
+	}()
+	err = f.Truncate(int64(limit))
+	f.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to size %s", s.image)
+	}
+	if err := storage.FormatFilesystem(ctx, s.image, storage.FsTypeExt4); err != nil {
+		return nil, err
+	}
+	loop, err := attachLoop(s.image)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the loop device once it is mounted, or on failure, detaches it
+	// when it is unmounted.
+	defer loop.Close()
+	if err := os.MkdirAll(s.Path, 0755); err != nil {
+		return nil, err
+	}
+	if err := unix.Mount(loop.Name(), s.Path, storage.FsTypeExt4, 0, ""); err != nil {
+		os.Remove(s.Path)
+		return nil, errors.Wrapf(err, "failed to mount %s onto %s", loop.Name(), s.Path)
+	}
+	return s, nil
+}
+
+// NewTmpfsScratch mounts a tmpfs of at most `limit` bytes at `scratchPath` and
+// returns it as a scratch.
+//
+// Pages of a tmpfs are charged to the memory cgroup of the process that writes
+// them, so the contents of the scratch count against the memory limit of the
+// container writing to it rather than against the GCS.
+func NewTmpfsScratch(ctx context.Context, scratchPath string, limit uint64) (_ *Scratch, err error) {
+	ctx, span := trace.StartSpan(ctx, "quota::NewTmpfsScratch")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("scratchPath", scratchPath),
+		trace.Int64Attribute("limit", int64(limit)))
+
+	if limit == 0 {
+		return nil, errors.New("scratch size limit must be greater than 0")
+	}
+	if err := os.MkdirAll(scratchPath, 0755); err != nil {
+		return nil, err
+	}
+	data := fmt.Sprintf("size=%d,mode=0755", limit)
+	if err := unix.Mount("tmpfs", scratchPath, "tmpfs", unix.MS_NODEV, data); err != nil {
+		os.Remove(scratchPath)
+		return nil, errors.Wrapf(err, "failed to mount tmpfs onto %s", scratchPath)
+	}
+	return &Scratch{
+		Path:  scratchPath,
+		Limit: limit,
+		tmpfs: true,
+	}, nil
+}
+
+// Usage returns the number of bytes used in the scratch.
+func (s *Scratch) Usage() (uint64, error) {
+	if s.image == "" && !s.tmpfs {
+		var dq dqblk
+		if err := quotactl(_Q_GETQUOTA, s.device, s.projectID, &dq); err != nil {
+			return 0, errors.Wrapf(err, "failed to get quota of project %d on %s", s.projectID, s.device)
+		}
+		return dq.CurSpace, nil
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(s.Path, &st); err != nil {
+		return 0, errors.Wrapf(err, "failed to statfs %s", s.Path)
+	}
+	return (st.Blocks - st.Bfree) * uint64(st.Bsize), nil
+}
+
+// Remove removes the size limit of the scratch. A loop mounted or tmpfs
+// scratch is unmounted and its contents are deleted.
+func (s *Scratch) Remove(ctx context.Context) (err error) {
+	ctx, span := trace.StartSpan(ctx, "quota::Remove")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(trace.StringAttribute("path", s.Path))
+
+	if s.image == "" && !s.tmpfs {
+		return setProjectLimit(s.device, s.projectID, 0)
+	}
+	if err := storage.UnmountPath(ctx, s.Path, true); err != nil {
+		return err
+	}
+	if s.tmpfs {
+		return nil
+	}
+	if err := os.Remove(s.image); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// +build linux
+
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testMounts = `/dev/sda / ext4 rw,relatime 0 0
+tmpfs /run tmpfs rw,nosuid,nodev 0 0
+/dev/sdb /run/gcs/c/scratch ext4 rw,relatime,prjquota 0 0
+/dev/sdc /run/gcs/c/scratch2 xfs rw,relatime 0 0
+`
+
+func Test_findMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	procMountsFile = filepath.Join(dir, "mounts")
+	defer func() {
+		procMountsFile = "/proc/mounts"
+	}()
+	if err := ioutil.WriteFile(procMountsFile, []byte(testMounts), 0600); err != nil {
+		t.Fatalf("failed to write mounts: %v", err)
+	}
+
+	type config struct {
+		path         string
+		source       string
+		projectQuota bool
+	}
+	tests := []config{
+		{"/run/gcs/c/scratch/upper", "/dev/sdb", true},
+		{"/run/gcs/c/scratch", "/dev/sdb", true},
+		{"/run/gcs/c/scratch2/upper", "/dev/sdc", false},
+		{"/run/gcs/c/scratch3", "tmpfs", false},
+		{"/var/lib", "/dev/sda", false},
+	}
+	for _, test := range tests {
+		source, fsType, options, err := findMount(test.path)
+		if err != nil {
+			t.Fatalf("%s: expected nil error got: %v", test.path, err)
+		}
+		if source != test.source {
+			t.Fatalf("%s: expected source %s got %s", test.path, test.source, source)
+		}
+		if supportsProjectQuota(fsType, options) != test.projectQuota {
+			t.Fatalf("%s: expected project quota support %v", test.path, test.projectQuota)
+		}
+	}
+}
@@ -4,15 +4,20 @@ package scsi
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Microsoft/opengcs/internal/log"
 	"github.com/Microsoft/opengcs/internal/oc"
 	"github.com/Microsoft/opengcs/internal/storage"
+	dm "github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
 	"github.com/pkg/errors"
 	"go.opencensus.io/trace"
 	"golang.org/x/sys/unix"
@@ -24,26 +29,134 @@ var (
 	osRemoveAll = os.RemoveAll
 	unixMount   = unix.Mount
 
+	// detectFilesystem is stubbed to avoid reading a real device.
+	detectFilesystem = storage.DetectFilesystem
 	// controllerLunToName is stubbed to make testing `Mount` easier.
 	controllerLunToName = ControllerLunToName
+
+	isBlankDevice      = storage.IsBlankDevice
+	formatFilesystem   = storage.FormatFilesystem
+	checkFilesystem    = storage.CheckFilesystem
+	blockDeviceSize    = storage.BlockDeviceSize
+	growFilesystem     = storage.GrowFilesystem
+	dmReloadDevice     = dm.ReloadDevice
+	storageUnmountPath = storage.UnmountPath
+	storageFindHolders = storage.FindHolders
+	unixUnmount        = unix.Unmount
+	unixKill           = unix.Kill
+	scsiDevicesPath    = "/sys/bus/scsi/devices"
+)
+
+const (
+	cryptDeviceFmt  = "dm-crypt-scsi%d-%d"
+	verityDeviceFmt = "dm-verity-scsi%d-%d-%s"
+	// defaultCipher is the dm-crypt cipher used when none is requested.
+	defaultCipher = "aes-xts-plain64"
+	// ephemeralKeySize is the size in bytes of a key generated in the guest,
+	// two AES-256 keys for `aes-xts-plain64`.
+	ephemeralKeySize = 64
 )
 
+// MountOptions are the options of a SCSI device mount.
+type MountOptions struct {
+	// FsType is the filesystem on the device. If empty it is detected from
+	// the superblock of the device.
+	FsType string
+	// Options are applied to the initial mount of the device together with
+	// the read-only options of the filesystem. Propagation flags are applied
+	// by a remount of the target, see `ValidateMountOptions`. Filesystem
+	// specific options must be supported by the filesystem, see
+	// `storage.ValidateMountData`.
+	Options []string
+	// Encryption mounts the device through a dm-crypt target, see
+	// `ValidateEncryption`. A blank encrypted device is formatted as
+	// `FsType`, or ext4 if `FsType` is empty.
+	Encryption *prot.DeviceEncryptionInfo
+	// VerityInfo mounts the device through a dm-verity target. It requires a
+	// readonly mount. When combined with `Encryption` the verity target is
+	// created on top of the crypt target.
+	VerityInfo *prot.DeviceVerityInfo
+	// FormatIfBlank formats the device as `FsType`, or ext4 if `FsType` is
+	// empty, before it is mounted if the device is blank. It requires a
+	// writable mount, see `ValidateFormatIfBlank`.
+	FormatIfBlank bool
+	// CheckFilesystem replays the journal of the filesystem and repairs any
+	// errors before it is mounted. It requires a writable mount, see
+	// `ValidateCheckFilesystem`.
+	CheckFilesystem bool
+}
+
+// InvalidOptionsError is returned by `Mount` when its options are invalid.
+// Nothing was mounted.
+type InvalidOptionsError struct {
+	Err error
+}
+
+func (e *InvalidOptionsError) Error() string {
+	return e.Err.Error()
+}
+
+// Validate returns an error if `o` cannot be used for a mount that is
+// `readonly`.
+func (o *MountOptions) Validate(readonly bool) error {
+	if o.FsType != "" {
+		if err := storage.ValidateFilesystem(o.FsType); err != nil {
+			return err
+		}
+	}
+	if err := ValidateMountOptions(readonly, o.Options); err != nil {
+		return err
+	}
+	// Without a filesystem type the options are validated once the
+	// filesystem is detected, see `mountDevice`.
+	if o.FsType != "" {
+		_, _, data := storage.ParseMountOptions(o.Options)
+		if err := storage.ValidateMountData(o.FsType, data); err != nil {
+			return err
+		}
+	}
+	if err := ValidateEncryption(readonly, o.Encryption); err != nil {
+		return err
+	}
+	if err := ValidateVerity(readonly, o.VerityInfo); err != nil {
+		return err
+	}
+	if err := ValidateFormatIfBlank(readonly, o.FormatIfBlank); err != nil {
+		return err
+	}
+	return ValidateCheckFilesystem(readonly, o.CheckFilesystem, o.FsType)
+}
+
 // Mount creates a mount from the SCSI device on `controller` index `lun` to
-// `target`
+// `target` with the options `opts`. Invalid options are rejected with an
+// `*InvalidOptionsError` before anything is mounted, see
+// `MountOptions.Validate`.
+//
+// The result of the filesystem check is returned if `opts.CheckFilesystem` is
+// set.
 //
 // `target` will be created. On mount failure the created `target` will be
 // automatically cleaned up.
-func Mount(ctx context.Context, controller, lun uint8, target string, readonly bool, options []string) (err error) {
+func Mount(ctx context.Context, controller, lun uint8, target string, readonly bool, opts MountOptions) (_ *storage.FilesystemCheckResult, err error) {
 	ctx, span := trace.StartSpan(ctx, "scsi::Mount")
 	defer span.End()
 	defer func() { oc.SetSpanStatus(span, err) }()
 
 	span.AddAttributes(
 		trace.Int64Attribute("controller", int64(controller)),
-		trace.Int64Attribute("lun", int64(lun)))
+		trace.Int64Attribute("lun", int64(lun)),
+		trace.StringAttribute("fsType", opts.FsType))
+
+	if err := opts.Validate(readonly); err != nil {
+		return nil, &InvalidOptionsError{Err: err}
+	}
+	flagOpts, pgFlags, data := storage.ParseMountOptions(opts.Options)
+	// The filesystem type changes if the device is formatted or detected
+	// before it is mounted.
+	fsType := opts.FsType
 
 	if err := osMkdirAll(target, 0700); err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		if err != nil {
@@ -52,48 +165,432 @@ func Mount(ctx context.Context, controller, lun uint8, target string, readonly b
 	}()
 	source, err := controllerLunToName(ctx, controller, lun)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// we only care about readonly mount option when mounting the device
-	var flags uintptr
-	data := ""
-	if readonly {
-		flags |= unix.MS_RDONLY
-		data = "noload"
+	// An encrypted device is always formatted when blank, see
+	// `createCryptDevice`.
+	if opts.FormatIfBlank && opts.Encryption == nil {
+		if fsType, err = formatBlankDevice(ctx, source, fsType); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Encryption != nil {
+		cryptName := fmt.Sprintf(cryptDeviceFmt, controller, lun)
+		if source, fsType, err = createCryptDevice(ctx, source, cryptName, readonly, fsType, opts.Encryption); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				if err := dm.RemoveDevice(cryptName); err != nil {
+					log.G(ctx).WithError(err).Debugf("failed to cleanup crypt target: %s", cryptName)
+				}
+			}
+		}()
 	}
+
+	if opts.VerityInfo != nil {
+		if err := waitForDevice(ctx, source); err != nil {
+			return nil, err
+		}
+		dmVerityName := fmt.Sprintf(verityDeviceFmt, controller, lun, opts.VerityInfo.RootDigest)
+		if source, err = storage.CreateVerityTarget(ctx, source, dmVerityName, opts.VerityInfo); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				if err := dm.RemoveDevice(dmVerityName); err != nil {
+					log.G(ctx).WithError(err).Debugf("failed to cleanup verity target: %s", dmVerityName)
+				}
+			}
+		}()
+	}
+
+	var result *storage.FilesystemCheckResult
+	if opts.CheckFilesystem {
+		if result, fsType, err = checkDevice(ctx, source, fsType); err != nil {
+			return nil, err
+		}
+	}
+
 	for {
-		if err := unixMount(source, target, "ext4", flags, data); err != nil {
+		if err := mountDevice(source, target, readonly, fsType, flagOpts, data); err != nil {
 			// The `source` found by controllerLunToName can take some time
 			// before its actually available under `/dev/sd*`. Retry while we
 			// wait for `source` to show up.
-			if err == unix.ENOENT {
+			if os.IsNotExist(errors.Cause(err)) {
 				select {
 				case <-ctx.Done():
-					return ctx.Err()
+					return nil, ctx.Err()
 				default:
 					time.Sleep(10 * time.Millisecond)
 					continue
 				}
 			}
-			return err
+			return nil, err
 		}
 		break
 	}
 
 	// remount the target to account for propagation flags
-	_, pgFlags, _ := storage.ParseMountOptions(options)
 	if len(pgFlags) != 0 {
 		for _, pg := range pgFlags {
 			if err := unixMount(target, target, "", pg, ""); err != nil {
-				return err
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ValidateMountOptions returns an error if `options` cannot be used to mount a
+// SCSI device. Every option must be a single flag or filesystem specific
+// `key[=value]`, options that create bind mounts or remount are not allowed,
+// and `rw` conflicts with a `readonly` mount.
+func ValidateMountOptions(readonly bool, options []string) error {
+	for _, o := range options {
+		if o == "" || strings.ContainsAny(o, ", \t\n\x00") {
+			return errors.Errorf("invalid mount option '%s'", o)
+		}
+		switch o {
+		case "bind", "rbind", "remount":
+			return errors.Errorf("mount option '%s' is not supported for SCSI devices", o)
+		case "rw":
+			if readonly {
+				return errors.New("mount option 'rw' conflicts with a readonly mount")
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateFormatIfBlank returns an error if a device that is formatted when
+// blank would be mounted `readonly`.
+func ValidateFormatIfBlank(readonly, formatIfBlank bool) error {
+	if formatIfBlank && readonly {
+		return errors.New("format if blank conflicts with a readonly mount")
+	}
+	return nil
+}
+
+// formatBlankDevice formats `source` as `fsType`, or ext4 if `fsType` is
+// empty, if it is blank. Returns the type of the created filesystem or
+// `fsType` if `source` was not blank.
+func formatBlankDevice(ctx context.Context, source, fsType string) (string, error) {
+	if err := waitForDevice(ctx, source); err != nil {
+		return "", err
+	}
+	blank, err := isBlankDevice(source)
+	if err != nil {
+		return "", err
+	}
+	if !blank {
+		return fsType, nil
+	}
+	if fsType == "" {
+		fsType = storage.FsTypeExt4
+	}
+	log.G(ctx).WithField("source", source).WithField("fsType", fsType).Info("formatting blank device")
+	if err := formatFilesystem(ctx, source, fsType); err != nil {
+		return "", err
+	}
+	return fsType, nil
+}
+
+// ValidateCheckFilesystem returns an error if the filesystem of a device
+// cannot be checked before it is mounted. Repairs write to the device so a
+// `readonly` mount cannot be checked.
+func ValidateCheckFilesystem(readonly, checkFs bool, fsType string) error {
+	if !checkFs {
+		return nil
+	}
+	if readonly {
+		return errors.New("checking the filesystem conflicts with a readonly mount")
+	}
+	return storage.ValidateCheckFilesystem(fsType)
+}
+
+// checkDevice replays the journal of the filesystem on `source` and repairs
+// any errors found. The filesystem is detected if `fsType` is empty. Returns
+// the result of the check and the type of the checked filesystem.
+func checkDevice(ctx context.Context, source, fsType string) (*storage.FilesystemCheckResult, string, error) {
+	if err := waitForDevice(ctx, source); err != nil {
+		return nil, "", err
+	}
+	if fsType == "" {
+		var err error
+		if fsType, err = detectFilesystem(source); err != nil {
+			return nil, "", err
+		}
+	}
+	result, err := checkFilesystem(ctx, source, fsType)
+	if err != nil {
+		return nil, "", err
+	}
+	if result.Repaired {
+		log.G(ctx).WithField("source", source).WithField("output", result.Output).Warning("repaired filesystem errors")
+	}
+	return result, fsType, nil
+}
+
+// ValidateEncryption returns an error if `encryption` cannot be used to encrypt
+// a SCSI device. A host provided key must be hex encoded, and a `readonly`
+// device cannot use an ephemeral key because it could never hold any data.
+func ValidateEncryption(readonly bool, encryption *prot.DeviceEncryptionInfo) error {
+	if encryption == nil {
+		return nil
+	}
+	if strings.ContainsAny(encryption.Cipher, " \t\n\x00") {
+		return errors.Errorf("invalid cipher '%s'", encryption.Cipher)
+	}
+	if encryption.Key == "" {
+		if readonly {
+			return errors.New("an ephemeral key cannot be used with a readonly device")
+		}
+		return nil
+	}
+	if _, err := hex.DecodeString(encryption.Key); err != nil {
+		return errors.Wrap(err, "encryption key is not hex encoded")
+	}
+	return nil
+}
+
+// ValidateVerity returns an error if `verityInfo` cannot be used to protect a
+// SCSI device. dm-verity devices are read-only so the mount must be
+// `readonly`.
+func ValidateVerity(readonly bool, verityInfo *prot.DeviceVerityInfo) error {
+	if verityInfo == nil {
+		return nil
+	}
+	if !readonly {
+		return errors.New("verity protected devices must be mounted readonly")
+	}
+	return storage.ValidateVerityInfo(verityInfo)
+}
+
+// waitForDevice waits for the device `source` found by controllerLunToName to
+// show up under `/dev/sd*`, which can take some time.
+func waitForDevice(ctx context.Context, source string) error {
+	for {
+		if _, err := os.Stat(source); err != nil {
+			if os.IsNotExist(err) {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				default:
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// createCryptDevice creates the dm-crypt target `name` on top of `source` and
+// returns its path. If the key is ephemeral or `source` is blank the target is
+// formatted and the created filesystem type is returned, otherwise `fsType` is
+// returned unchanged.
+func createCryptDevice(ctx context.Context, source, name string, readonly bool, fsType string, encryption *prot.DeviceEncryptionInfo) (_ string, _ string, err error) {
+	ctx, span := trace.StartSpan(ctx, "scsi::createCryptDevice")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("source", source),
+		trace.StringAttribute("name", name),
+		trace.BoolAttribute("ephemeralKey", encryption.Key == ""))
+
+	if err := waitForDevice(ctx, source); err != nil {
+		return "", "", err
+	}
+
+	key := encryption.Key
+	format := key == ""
+	if format {
+		b := make([]byte, ephemeralKeySize)
+		if _, err := rand.Read(b); err != nil {
+			return "", "", errors.Wrap(err, "failed to generate encryption key")
+		}
+		key = hex.EncodeToString(b)
+	} else if format, err = storage.IsBlankDevice(source); err != nil {
+		return "", "", err
+	}
+	if format && readonly {
+		return "", "", errors.Errorf("cannot format blank readonly device %s", source)
+	}
+
+	size, err := storage.BlockDeviceSize(source)
+	if err != nil {
+		return "", "", err
+	}
+	cipher := encryption.Cipher
+	if cipher == "" {
+		cipher = defaultCipher
+	}
+	var flags dm.CreateFlags
+	if readonly {
+		flags |= dm.CreateReadOnly
+	}
+	// The table contains the key so it must never be logged.
+	cryptTarget := dm.CryptTarget(0, size/dm.BlockSize, cipher, key, 0, source, 0)
+	devicePath, err := dm.CreateDevice(name, flags, []dm.Target{cryptTarget})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to create dm-crypt target: scsi device: %s", source)
+	}
+
+	if format {
+		if fsType == "" {
+			fsType = storage.FsTypeExt4
+		}
+		if err := storage.FormatFilesystem(ctx, devicePath, fsType); err != nil {
+			if err := dm.RemoveDevice(name); err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to cleanup crypt target: %s", name)
 			}
+			return "", "", err
 		}
 	}
+	return devicePath, fsType, nil
+}
+
+// ValidateBusyPolicy returns an error if `policy` is not a valid busy policy
+// for a device with `encryption` and `verityInfo`. A lazily detached mount
+// keeps its device open so it cannot be used with verity or crypt targets,
+// which must be removed before the device is unplugged.
+func ValidateBusyPolicy(policy prot.BusyPolicy, encryption *prot.DeviceEncryptionInfo, verityInfo *prot.DeviceVerityInfo) error {
+	switch policy {
+	case "", prot.BpFail, prot.BpKill:
+		return nil
+	case prot.BpDetach:
+		if encryption != nil || verityInfo != nil {
+			return errors.New("busy policy Detach cannot be used with encryption or verity")
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid busy policy: %s", policy)
+	}
+}
+
+// unmountTarget unmounts and removes `target`. If `target` is busy the
+// processes using it are returned in a `*storage.BusyError` unless `policy`
+// is `prot.BpKill`, which kills them and retries until `ctx` is done, or
+// `prot.BpDetach`, which lazily detaches the mount.
+func unmountTarget(ctx context.Context, target string, policy prot.BusyPolicy) error {
+	err := storageUnmountPath(ctx, target, true)
+	if err == nil {
+		return nil
+	}
+	if errors.Cause(err) != unix.EBUSY {
+		return errors.Wrapf(err, "failed to unmount target: %s", target)
+	}
+	holders, herr := storageFindHolders(target)
+	if herr != nil {
+		log.G(ctx).WithError(herr).Warning("failed to find processes using busy target")
+	}
+	switch policy {
+	case prot.BpKill:
+		for {
+			for _, h := range holders {
+				// Never kill the GCS or init.
+				if h.PID == os.Getpid() || h.PID == 1 {
+					continue
+				}
+				log.G(ctx).WithField("holder", h.String()).Info("killing process using busy target")
+				if err := unixKill(h.PID, unix.SIGKILL); err != nil && err != unix.ESRCH {
+					log.G(ctx).WithError(err).Warningf("failed to kill process %d", h.PID)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return &storage.BusyError{Target: target, Holders: holders}
+			case <-time.After(time.Millisecond * 10):
+			}
+			err := storageUnmountPath(ctx, target, true)
+			if err == nil {
+				return nil
+			}
+			if errors.Cause(err) != unix.EBUSY {
+				return errors.Wrapf(err, "failed to unmount target: %s", target)
+			}
+			if holders, herr = storageFindHolders(target); herr != nil {
+				log.G(ctx).WithError(herr).Warning("failed to find processes using busy target")
+			}
+		}
+	case prot.BpDetach:
+		log.G(ctx).WithField("holders", fmt.Sprint(holders)).Info("lazily detaching busy target")
+		if err := unixUnmount(target, unix.MNT_DETACH); err != nil {
+			return errors.Wrapf(err, "failed to detach target: %s", target)
+		}
+		return osRemoveAll(target)
+	default:
+		return &storage.BusyError{Target: target, Holders: holders}
+	}
+}
+
+// Unmount unmounts `target` and removes the verity and crypt targets of the
+// SCSI device on `controller` index `lun` when `verityInfo` and `encryption`
+// are non-nil.
+//
+// If `target` is busy it is handled according to `busyPolicy`, see
+// `ValidateBusyPolicy`. By default a `*storage.BusyError` with the processes
+// using `target` is returned.
+func Unmount(ctx context.Context, controller, lun uint8, target string, encryption *prot.DeviceEncryptionInfo, verityInfo *prot.DeviceVerityInfo, busyPolicy prot.BusyPolicy) (err error) {
+	ctx, span := trace.StartSpan(ctx, "scsi::Unmount")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
 
+	span.AddAttributes(
+		trace.Int64Attribute("controller", int64(controller)),
+		trace.Int64Attribute("lun", int64(lun)),
+		trace.StringAttribute("target", target))
+
+	if err := unmountTarget(ctx, target, busyPolicy); err != nil {
+		return err
+	}
+
+	if verityInfo != nil {
+		dmVerityName := fmt.Sprintf(verityDeviceFmt, controller, lun, verityInfo.RootDigest)
+		if err := storage.RemoveVerityTarget(ctx, dmVerityName); err != nil {
+			return err
+		}
+	}
+
+	if encryption != nil {
+		cryptName := fmt.Sprintf(cryptDeviceFmt, controller, lun)
+		if err := dm.RemoveDevice(cryptName); err != nil {
+			return errors.Wrapf(err, "failed to remove dm crypt target: %s", cryptName)
+		}
+	}
 	return nil
 }
 
+// mountDevice mounts the block device `source` to `target` as `fsType`,
+// detecting the filesystem if `fsType` is empty. The read-only options of the
+// filesystem are merged with `flagOpts` and `data`. Returns an
+// `*InvalidOptionsError` if `data` is not supported by the filesystem.
+func mountDevice(source, target string, readonly bool, fsType string, flagOpts uintptr, data []string) error {
+	if fsType == "" {
+		var err error
+		if fsType, err = detectFilesystem(source); err != nil {
+			return err
+		}
+	}
+	if err := storage.ValidateMountData(fsType, data); err != nil {
+		return &InvalidOptionsError{Err: err}
+	}
+	flags, fsData, err := storage.FilesystemMountOptions(fsType, readonly || flagOpts&unix.MS_RDONLY != 0)
+	if err != nil {
+		return err
+	}
+	if fsData != "" {
+		data = append([]string{fsData}, data...)
+	}
+	return unixMount(source, target, fsType, flags|flagOpts, strings.Join(data, ","))
+}
+
 // ControllerLunToName finds the `/dev/sd*` path to the SCSI device on
 // `controller` index `lun`.
 func ControllerLunToName(ctx context.Context, controller, lun uint8) (_ string, err error) {
@@ -109,7 +606,7 @@ func ControllerLunToName(ctx context.Context, controller, lun uint8) (_ string,
 
 	// Devices matching the given SCSI code should each have a subdirectory
 	// under /sys/bus/scsi/devices/<scsiID>/block.
-	blockPath := filepath.Join("/sys/bus/scsi/devices", scsiID, "block")
+	blockPath := filepath.Join(scsiDevicesPath, scsiID, "block")
 	var deviceNames []os.FileInfo
 	for {
 		deviceNames, err = ioutil.ReadDir(blockPath)
@@ -140,8 +637,62 @@ func ControllerLunToName(ctx context.Context, controller, lun uint8) (_ string,
 	return devicePath, nil
 }
 
+// Resize rescans the capacity of the SCSI device on `controller` index `lun`
+// and grows the ext4 filesystem mounted from it at `target` to fill it.
+// Returns the new sizes in bytes of the device and of the filesystem.
+//
+// If the device is mounted with `encryption` its dm-crypt target is reloaded
+// with the new size first. This requires the key, so disks encrypted with an
+// ephemeral key cannot be resized.
+func Resize(ctx context.Context, controller, lun uint8, target string, encryption *prot.DeviceEncryptionInfo) (deviceSize, fsSize uint64, err error) {
+	ctx, span := trace.StartSpan(ctx, "scsi::Resize")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.Int64Attribute("controller", int64(controller)),
+		trace.Int64Attribute("lun", int64(lun)),
+		trace.StringAttribute("target", target))
+
+	scsiID := fmt.Sprintf("0:0:%d:%d", controller, lun)
+	rescanPath := filepath.Join(scsiDevicesPath, scsiID, "rescan")
+	if err := ioutil.WriteFile(rescanPath, []byte("1\n"), 0); err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to rescan SCSI device %s", scsiID)
+	}
+	source, err := controllerLunToName(ctx, controller, lun)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := blockDeviceSize(source)
+	if err != nil {
+		return 0, 0, err
+	}
+	if encryption != nil {
+		if encryption.Key == "" {
+			return 0, 0, errors.New("cannot resize a disk encrypted with an ephemeral key")
+		}
+		cipher := encryption.Cipher
+		if cipher == "" {
+			cipher = defaultCipher
+		}
+		cryptName := fmt.Sprintf(cryptDeviceFmt, controller, lun)
+		// The table contains the key so it must never be logged.
+		cryptTarget := dm.CryptTarget(0, size/dm.BlockSize, cipher, encryption.Key, 0, source, 0)
+		if err := dmReloadDevice(cryptName, 0, []dm.Target{cryptTarget}); err != nil {
+			return 0, 0, errors.Wrapf(err, "failed to reload dm-crypt target: %s", cryptName)
+		}
+		source = filepath.Join("/dev/mapper", cryptName)
+	}
+	fsSize, err = growFilesystem(ctx, source, target, uint64(size))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(size), fsSize, nil
+}
+
 // UnplugDevice finds the SCSI device on `controller` index `lun` and issues a
-// guest initiated unplug.
+// guest initiated unplug. It waits until the device is removed or `ctx` is
+// done.
 //
 // If the device is not attached returns no error.
 func UnplugDevice(ctx context.Context, controller, lun uint8) (err error) {
@@ -154,17 +705,39 @@ func UnplugDevice(ctx context.Context, controller, lun uint8) (err error) {
 		trace.Int64Attribute("lun", int64(lun)))
 
 	scsiID := fmt.Sprintf("0:0:%d:%d", controller, lun)
-	f, err := os.OpenFile(filepath.Join("/sys/bus/scsi/devices", scsiID, "delete"), os.O_WRONLY, 0644)
+	devicePath := filepath.Join(scsiDevicesPath, scsiID)
+	f, err := os.OpenFile(filepath.Join(devicePath, "delete"), os.O_WRONLY, 0644)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
-	defer f.Close()
+	// The block devices of the SCSI device, if any, to wait for.
+	var waitPaths []string
+	if names, err := ioutil.ReadDir(filepath.Join(devicePath, "block")); err == nil {
+		for _, n := range names {
+			waitPaths = append(waitPaths, filepath.Join("/dev", n.Name()))
+		}
+	}
+	waitPaths = append(waitPaths, devicePath)
 
-	if _, err := f.Write([]byte("1\n")); err != nil {
+	_, err = f.Write([]byte("1\n"))
+	f.Close()
+	if err != nil {
 		return err
 	}
+	for _, p := range waitPaths {
+		for {
+			if _, err := os.Stat(p); os.IsNotExist(err) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return errors.Wrapf(ctx.Err(), "timed out waiting for %s to be removed", p)
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
 	return nil
 }
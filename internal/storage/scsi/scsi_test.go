@@ -5,17 +5,39 @@ package scsi
 import (
 	"context"
 	"errors"
+	"flag"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/Microsoft/opengcs/internal/storage"
+	dm "github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	pkgerrors "github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
+var integration = flag.Bool("integration", false, "run integration tests")
+
 func clearTestDependencies() {
 	osMkdirAll = nil
 	osRemoveAll = nil
 	unixMount = nil
+	detectFilesystem = nil
 	controllerLunToName = nil
+	isBlankDevice = nil
+	formatFilesystem = nil
+	checkFilesystem = nil
+	blockDeviceSize = nil
+	growFilesystem = nil
+	dmReloadDevice = nil
+	storageUnmountPath = nil
+	storageFindHolders = nil
+	unixUnmount = nil
+	unixKill = nil
 }
 
 func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
@@ -25,7 +47,7 @@ func Test_Mount_Mkdir_Fails_Error(t *testing.T) {
 	osMkdirAll = func(path string, perm os.FileMode) error {
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, 0, "", false, nil)
+	_, err := Mount(context.Background(), 0, 0, "", false, MountOptions{FsType: "ext4"})
 	if err != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -52,7 +74,7 @@ func Test_Mount_Mkdir_ExpectedPath(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, target, false, nil)
+	_, err := Mount(context.Background(), 0, 0, target, false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -79,7 +101,7 @@ func Test_Mount_Mkdir_ExpectedPerm(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, target, false, nil)
+	_, err := Mount(context.Background(), 0, 0, target, false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -106,7 +128,7 @@ func Test_Mount_ControllerLunToName_Valid_Controller(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), expectedController, 0, "/fake/path", false, nil)
+	_, err := Mount(context.Background(), expectedController, 0, "/fake/path", false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -133,7 +155,7 @@ func Test_Mount_ControllerLunToName_Valid_Lun(t *testing.T) {
 		// Fake the mount success
 		return nil
 	}
-	err := Mount(context.Background(), 0, expectedLun, "/fake/path", false, nil)
+	_, err := Mount(context.Background(), 0, expectedLun, "/fake/path", false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil error got: %v", err)
 	}
@@ -163,7 +185,7 @@ func Test_Mount_Calls_RemoveAll_OnControllerToLunFailure(t *testing.T) {
 	// NOTE: Do NOT set unixMount because the controller to lun fails. Expect it
 	// not to be called.
 
-	err := Mount(context.Background(), 0, 0, target, false, nil)
+	_, err := Mount(context.Background(), 0, 0, target, false, MountOptions{FsType: "ext4"})
 	if err != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -196,7 +218,7 @@ func Test_Mount_Calls_RemoveAll_OnMountFailure(t *testing.T) {
 		// Fake the mount failure to test remove is called
 		return expectedErr
 	}
-	err := Mount(context.Background(), 0, 0, target, false, nil)
+	_, err := Mount(context.Background(), 0, 0, target, false, MountOptions{FsType: "ext4"})
 	if err != expectedErr {
 		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
 	}
@@ -225,7 +247,7 @@ func Test_Mount_Valid_Source(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil)
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -251,7 +273,7 @@ func Test_Mount_Valid_Target(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, expectedTarget, false, nil)
+	_, err := Mount(context.Background(), 0, 0, expectedTarget, false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -277,7 +299,7 @@ func Test_Mount_Valid_FSType(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil)
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -303,7 +325,7 @@ func Test_Mount_Valid_Flags(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil)
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -329,7 +351,7 @@ func Test_Mount_Readonly_Valid_Flags(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", true, nil)
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", true, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -354,7 +376,7 @@ func Test_Mount_Valid_Data(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", false, nil)
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: "ext4"})
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
@@ -380,8 +402,624 @@ func Test_Mount_Readonly_Valid_Data(t *testing.T) {
 		}
 		return nil
 	}
-	err := Mount(context.Background(), 0, 0, "/fake/path", true, nil)
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", true, MountOptions{FsType: "ext4"})
+	if err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+}
+
+func Test_Mount_Detects_Filesystem(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set osRemoveAll because the mount succeeds. Expect it not to
+	// be called.
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	expectedSource := "/dev/sdz"
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return expectedSource, nil
+	}
+	detectFilesystem = func(source string) (string, error) {
+		if expectedSource != source {
+			t.Errorf("expected source: %s, got: %s", expectedSource, source)
+			return "", errors.New("unexpected source")
+		}
+		return "xfs", nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if fstype != "xfs" {
+			t.Errorf("expected fstype: xfs, got: %s", fstype)
+			return errors.New("unexpected fstype")
+		}
+		if data != "norecovery" {
+			t.Errorf("expected data: norecovery, got: %s", data)
+			return errors.New("unexpected data")
+		}
+		return nil
+	}
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", true, MountOptions{})
 	if err != nil {
 		t.Fatalf("expected nil err, got: %v", err)
 	}
 }
+
+func Test_Mount_Invalid_FSType(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set any dependency because the filesystem type is validated
+	// before anything is done. Expect them not to be called.
+
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: "ntfs"})
+	if err == nil {
+		t.Fatal("expected error for unsupported filesystem type")
+	}
+}
+
+func Test_Mount_Valid_Options(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set osRemoveAll because the mount succeeds. Expect it not to
+	// be called.
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "", nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		expectedFlags := uintptr(unix.MS_RDONLY | unix.MS_NOEXEC | unix.MS_NOSUID)
+		if expectedFlags != flags {
+			t.Errorf("expected flags: %v, got: %v", expectedFlags, flags)
+			return errors.New("unexpected flags")
+		}
+		expectedData := "noload,discard,barrier=0"
+		if expectedData != data {
+			t.Errorf("expected data: %s, got: %s", expectedData, data)
+			return errors.New("unexpected data")
+		}
+		return nil
+	}
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", true, MountOptions{FsType: "ext4", Options: []string{"noexec", "nosuid", "discard", "barrier=0"}})
+	if err != nil {
+		t.Fatalf("expected nil err, got: %v", err)
+	}
+}
+
+func Test_Mount_Scratch_ProjectQuota(t *testing.T) {
+	for _, c := range []struct {
+		fsType string
+		quota  string
+	}{
+		{storage.FsTypeExt4, "prjquota"},
+		{storage.FsTypeXfs, "prjquota"},
+		{storage.FsTypeXfs, "pquota"},
+	} {
+		clearTestDependencies()
+
+		osMkdirAll = func(path string, perm os.FileMode) error {
+			return nil
+		}
+		controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+			return "/dev/sdb", nil
+		}
+		mounted := false
+		unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+			if fstype != c.fsType || flags != 0 || data != c.quota {
+				t.Errorf("unexpected mount of %s flags: %v data: %s", fstype, flags, data)
+			}
+			mounted = true
+			return nil
+		}
+		_, err := Mount(context.Background(), 0, 0, "/run/gcs/c/scratch", false, MountOptions{FsType: c.fsType, Options: []string{c.quota}})
+		if err != nil {
+			t.Fatalf("%+v: expected nil err, got: %v", c, err)
+		}
+		if !mounted {
+			t.Fatalf("%+v: expected the scratch to be mounted", c)
+		}
+	}
+}
+
+func Test_Mount_Invalid_Options(t *testing.T) {
+	for _, options := range [][]string{
+		{""},
+		{"noexec,nosuid"},
+		{"bind"},
+		{"bogus"},
+		{"inode64"},
+	} {
+		clearTestDependencies()
+
+		// NOTE: Do NOT set any dependency because the options are validated
+		// before anything is done. Expect them not to be called.
+
+		_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: "ext4", Options: options})
+		if err == nil {
+			t.Fatalf("expected error for options: %v", options)
+		}
+	}
+}
+
+func Test_Mount_Detected_Filesystem_Invalid_Options(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	osRemoveAll = func(path string) error {
+		return nil
+	}
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "/dev/sdz", nil
+	}
+	detectFilesystem = func(source string) (string, error) {
+		return storage.FsTypeExt4, nil
+	}
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		t.Errorf("expected no mount of %s with data: %s", source, data)
+		return nil
+	}
+
+	// inode64 is an xfs option.
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{Options: []string{"inode64"}})
+	if _, ok := pkgerrors.Cause(err).(*InvalidOptionsError); !ok {
+		t.Fatalf("expected InvalidOptionsError got: %v", err)
+	}
+}
+
+func Test_ValidateMountOptions_Readonly_Conflict(t *testing.T) {
+	if err := ValidateMountOptions(false, []string{"rw"}); err != nil {
+		t.Fatalf("expected nil error for rw mount got: %v", err)
+	}
+	if err := ValidateMountOptions(true, []string{"rw"}); err == nil {
+		t.Fatal("expected error for rw option on a readonly mount")
+	}
+}
+
+func Test_ValidateEncryption(t *testing.T) {
+	type config struct {
+		readonly   bool
+		encryption *prot.DeviceEncryptionInfo
+		valid      bool
+	}
+	tests := []config{
+		{false, nil, true},
+		{true, nil, true},
+		{false, &prot.DeviceEncryptionInfo{}, true},
+		{true, &prot.DeviceEncryptionInfo{}, false},
+		{true, &prot.DeviceEncryptionInfo{Key: "00ff"}, true},
+		{false, &prot.DeviceEncryptionInfo{Cipher: "aes-cbc-essiv:sha256", Key: "00ff"}, true},
+		{false, &prot.DeviceEncryptionInfo{Key: "not hex"}, false},
+		{false, &prot.DeviceEncryptionInfo{Cipher: "aes xts"}, false},
+	}
+	for _, test := range tests {
+		err := ValidateEncryption(test.readonly, test.encryption)
+		if test.valid && err != nil {
+			t.Fatalf("%+v: expected nil error got: %v", test, err)
+		} else if !test.valid && err == nil {
+			t.Fatalf("%+v: expected error got nil", test)
+		}
+	}
+}
+
+func Test_Mount_Invalid_Encryption(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set any dependency because the encryption is validated
+	// before anything is done. Expect them not to be called.
+
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", true, MountOptions{FsType: "ext4", Encryption: &prot.DeviceEncryptionInfo{}})
+	if err == nil {
+		t.Fatal("expected error for ephemeral key on a readonly mount")
+	}
+}
+
+func Test_Mount_Verity_Requires_Readonly(t *testing.T) {
+	clearTestDependencies()
+
+	// NOTE: Do NOT set any dependency because the verity info is validated
+	// before anything is done. Expect them not to be called.
+
+	verityInfo := &prot.DeviceVerityInfo{
+		Ext4SizeInBytes: 4096,
+		Version:         1,
+		Algorithm:       "sha256",
+		RootDigest:      "00ff",
+		Salt:            "00ff",
+		BlockSize:       4096,
+	}
+	if err := ValidateVerity(true, verityInfo); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: "ext4", VerityInfo: verityInfo})
+	if err == nil {
+		t.Fatal("expected error for verity on a writable mount")
+	}
+}
+
+// busyUnmount fakes `storage.UnmountPath` of a target that is busy until
+// `*busy` is false.
+func busyUnmount(busy *bool) func(context.Context, string, bool) error {
+	return func(ctx context.Context, target string, removeTarget bool) error {
+		if *busy {
+			return pkgerrors.Wrapf(unix.EBUSY, "failed to unmount path '%s'", target)
+		}
+		return nil
+	}
+}
+
+func Test_Unmount_Busy_Returns_Holders(t *testing.T) {
+	clearTestDependencies()
+
+	busy := true
+	storageUnmountPath = busyUnmount(&busy)
+	holders := []storage.Holder{{PID: 100, Command: "sh", Use: "cwd"}}
+	storageFindHolders = func(target string) ([]storage.Holder, error) {
+		return holders, nil
+	}
+
+	err := Unmount(context.Background(), 0, 1, "/run/mounts/m1", nil, nil, "")
+	busyErr, ok := err.(*storage.BusyError)
+	if !ok {
+		t.Fatalf("expected *storage.BusyError got: %v", err)
+	}
+	if len(busyErr.Holders) != 1 || busyErr.Holders[0] != holders[0] {
+		t.Fatalf("expected holders: %v got: %v", holders, busyErr.Holders)
+	}
+}
+
+func Test_Unmount_Busy_Kill(t *testing.T) {
+	clearTestDependencies()
+
+	busy := true
+	storageUnmountPath = busyUnmount(&busy)
+	storageFindHolders = func(target string) ([]storage.Holder, error) {
+		return []storage.Holder{
+			{PID: 1, Command: "init", Use: "mount /run/mounts/m1"},
+			{PID: os.Getpid(), Command: "gcs", Use: "fd 3"},
+			{PID: 100, Command: "sh", Use: "cwd"},
+		}, nil
+	}
+	var killed []int
+	unixKill = func(pid int, sig unix.Signal) error {
+		killed = append(killed, pid)
+		busy = false
+		return nil
+	}
+
+	if err := Unmount(context.Background(), 0, 1, "/run/mounts/m1", nil, nil, prot.BpKill); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(killed) != 1 || killed[0] != 100 {
+		t.Fatalf("expected only pid 100 to be killed got: %v", killed)
+	}
+}
+
+func Test_Unmount_Busy_Detach(t *testing.T) {
+	clearTestDependencies()
+
+	busy := true
+	storageUnmountPath = busyUnmount(&busy)
+	storageFindHolders = func(target string) ([]storage.Holder, error) {
+		return nil, nil
+	}
+	detached := false
+	unixUnmount = func(target string, flags int) error {
+		if target != "/run/mounts/m1" || flags != unix.MNT_DETACH {
+			t.Errorf("unexpected unmount of %s with flags %d", target, flags)
+		}
+		detached = true
+		return nil
+	}
+	osRemoveAll = func(path string) error {
+		return nil
+	}
+
+	if err := Unmount(context.Background(), 0, 1, "/run/mounts/m1", nil, nil, prot.BpDetach); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if !detached {
+		t.Fatal("expected target to be detached")
+	}
+}
+
+func Test_ValidateBusyPolicy(t *testing.T) {
+	if err := ValidateBusyPolicy(prot.BpDetach, nil, nil); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if err := ValidateBusyPolicy(prot.BpDetach, &prot.DeviceEncryptionInfo{}, nil); err == nil {
+		t.Fatal("expected error detaching an encrypted device")
+	}
+	if err := ValidateBusyPolicy("Ignore", nil, nil); err == nil {
+		t.Fatal("expected error for an invalid busy policy")
+	}
+}
+
+func Test_Mount_FormatIfBlank(t *testing.T) {
+	for _, blank := range []bool{true, false} {
+		clearTestDependencies()
+
+		osMkdirAll = func(path string, perm os.FileMode) error {
+			return nil
+		}
+		controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+			// Exists so that waiting for the device returns immediately.
+			return "/dev/null", nil
+		}
+		isBlankDevice = func(source string) (bool, error) {
+			return blank, nil
+		}
+		formatted := false
+		formatFilesystem = func(ctx context.Context, source, fsType string) error {
+			if source != "/dev/null" || fsType != storage.FsTypeExt4 {
+				t.Errorf("unexpected format of %s as %s", source, fsType)
+			}
+			formatted = true
+			return nil
+		}
+		detectFilesystem = func(source string) (string, error) {
+			return storage.FsTypeXfs, nil
+		}
+		var mountedType string
+		unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+			mountedType = fstype
+			return nil
+		}
+
+		_, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FormatIfBlank: true})
+		if err != nil {
+			t.Fatalf("blank %v: expected nil error got: %v", blank, err)
+		}
+		if formatted != blank {
+			t.Fatalf("blank %v: expected formatted %v", blank, blank)
+		}
+		expectedType := storage.FsTypeXfs
+		if blank {
+			expectedType = storage.FsTypeExt4
+		}
+		if mountedType != expectedType {
+			t.Fatalf("blank %v: expected mount as %s got %s", blank, expectedType, mountedType)
+		}
+	}
+}
+
+func Test_Mount_FormatIfBlank_Readonly(t *testing.T) {
+	clearTestDependencies()
+
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", true, MountOptions{FormatIfBlank: true})
+	if err == nil {
+		t.Fatal("expected error formatting a readonly mount")
+	}
+}
+
+func Test_Mount_CheckFilesystem(t *testing.T) {
+	clearTestDependencies()
+
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	osRemoveAll = func(path string) error {
+		return nil
+	}
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		// Exists so that waiting for the device returns immediately.
+		return "/dev/null", nil
+	}
+	detectFilesystem = func(source string) (string, error) {
+		return storage.FsTypeExt4, nil
+	}
+	checked := false
+	checkFilesystem = func(ctx context.Context, source, fsType string) (*storage.FilesystemCheckResult, error) {
+		if source != "/dev/null" || fsType != storage.FsTypeExt4 {
+			t.Errorf("unexpected check of %s as %s", source, fsType)
+		}
+		checked = true
+		return &storage.FilesystemCheckResult{Repaired: true}, nil
+	}
+	mounted := false
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		if !checked {
+			t.Error("expected the filesystem to be checked before it is mounted")
+		}
+		mounted = true
+		return nil
+	}
+
+	result, err := Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{CheckFilesystem: true})
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if !mounted || result == nil || !result.Repaired {
+		t.Fatalf("expected repaired result got: %+v", result)
+	}
+
+	expectedErr := &storage.CorruptFilesystemError{Source: "/dev/null"}
+	checkFilesystem = func(ctx context.Context, source, fsType string) (*storage.FilesystemCheckResult, error) {
+		return nil, expectedErr
+	}
+	mounted = false
+	_, err = Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{CheckFilesystem: true})
+	if err != expectedErr {
+		t.Fatalf("expected err: %v, got: %v", expectedErr, err)
+	}
+	if mounted {
+		t.Fatal("expected a corrupt filesystem not to be mounted")
+	}
+}
+
+func Test_Mount_CheckFilesystem_Invalid(t *testing.T) {
+	clearTestDependencies()
+
+	_, err := Mount(context.Background(), 0, 0, "/fake/path", true, MountOptions{CheckFilesystem: true})
+	if _, ok := pkgerrors.Cause(err).(*InvalidOptionsError); !ok {
+		t.Fatalf("expected InvalidOptionsError checking a readonly mount got: %v", err)
+	}
+	_, err = Mount(context.Background(), 0, 0, "/fake/path", false, MountOptions{FsType: storage.FsTypeXfs, CheckFilesystem: true})
+	if _, ok := pkgerrors.Cause(err).(*InvalidOptionsError); !ok {
+		t.Fatalf("expected InvalidOptionsError checking an unsupported filesystem got: %v", err)
+	}
+}
+
+func Test_Mount_FormatIfBlank_Loop_Integration(t *testing.T) {
+	if !*integration {
+		t.Skip()
+	}
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "disk.img")
+	if err := ioutil.WriteFile(image, nil, 0600); err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	if err := os.Truncate(image, 64*1024*1024); err != nil {
+		t.Fatalf("failed to size image: %v", err)
+	}
+	out, err := exec.Command("losetup", "--find", "--show", image).Output()
+	if err != nil {
+		t.Fatalf("failed to attach loop device: %v", err)
+	}
+	loop := strings.TrimSpace(string(out))
+	defer exec.Command("losetup", "-d", loop).Run()
+
+	clearTestDependencies()
+	osMkdirAll = os.MkdirAll
+	osRemoveAll = os.RemoveAll
+	unixMount = unix.Mount
+	detectFilesystem = storage.DetectFilesystem
+	isBlankDevice = storage.IsBlankDevice
+	formatFilesystem = storage.FormatFilesystem
+	checkFilesystem = storage.CheckFilesystem
+	storageUnmountPath = storage.UnmountPath
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return loop, nil
+	}
+
+	target := filepath.Join(dir, "mnt")
+	// The first mount formats the blank device and the second mount checks
+	// it and must find the data written by the first.
+	for i := 0; i < 2; i++ {
+		if _, err := Mount(context.Background(), 0, 0, target, false, MountOptions{FormatIfBlank: true, CheckFilesystem: i == 1}); err != nil {
+			t.Fatalf("mount %d: expected nil error got: %v", i, err)
+		}
+		marker := filepath.Join(target, "marker")
+		if i == 0 {
+			err = ioutil.WriteFile(marker, []byte("data"), 0600)
+		} else {
+			_, err = os.Stat(marker)
+		}
+		if err != nil {
+			t.Fatalf("mount %d: marker: %v", i, err)
+		}
+		if err := Unmount(context.Background(), 0, 0, target, nil, nil, ""); err != nil {
+			t.Fatalf("mount %d: expected nil unmount error got: %v", i, err)
+		}
+	}
+	if fsType, err := storage.DetectFilesystem(loop); err != nil || fsType != storage.FsTypeExt4 {
+		t.Fatalf("expected ext4 got: %s, %v", fsType, err)
+	}
+}
+
+func Test_Resize(t *testing.T) {
+	clearTestDependencies()
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldDevicesPath := scsiDevicesPath
+	defer func() {
+		scsiDevicesPath = oldDevicesPath
+	}()
+	scsiDevicesPath = dir
+	rescanPath := filepath.Join(dir, "0:0:1:2", "rescan")
+	if err := os.MkdirAll(filepath.Dir(rescanPath), 0755); err != nil {
+		t.Fatalf("failed to create device: %v", err)
+	}
+	if err := ioutil.WriteFile(rescanPath, nil, 0600); err != nil {
+		t.Fatalf("failed to create rescan: %v", err)
+	}
+
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "/dev/sdc", nil
+	}
+	blockDeviceSize = func(source string) (int64, error) {
+		b, err := ioutil.ReadFile(rescanPath)
+		if err != nil || string(b) != "1\n" {
+			t.Errorf("expected the device to be rescanned first got: %q, %v", b, err)
+		}
+		return 2 << 30, nil
+	}
+	growFilesystem = func(ctx context.Context, source, target string, sizeInBytes uint64) (uint64, error) {
+		if source != "/dev/sdc" || target != "/run/mounts/m2" || sizeInBytes != 2<<30 {
+			t.Errorf("unexpected grow of %s at %s to %d", source, target, sizeInBytes)
+		}
+		return 2<<30 - 4096, nil
+	}
+
+	deviceSize, fsSize, err := Resize(context.Background(), 1, 2, "/run/mounts/m2", nil)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if deviceSize != 2<<30 || fsSize != 2<<30-4096 {
+		t.Fatalf("unexpected sizes device: %d filesystem: %d", deviceSize, fsSize)
+	}
+}
+
+func Test_Resize_Encrypted(t *testing.T) {
+	clearTestDependencies()
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldDevicesPath := scsiDevicesPath
+	defer func() {
+		scsiDevicesPath = oldDevicesPath
+	}()
+	scsiDevicesPath = dir
+	rescanPath := filepath.Join(dir, "0:0:1:2", "rescan")
+	if err := os.MkdirAll(filepath.Dir(rescanPath), 0755); err != nil {
+		t.Fatalf("failed to create device: %v", err)
+	}
+
+	controllerLunToName = func(ctx context.Context, controller, lun uint8) (string, error) {
+		return "/dev/sdc", nil
+	}
+	blockDeviceSize = func(source string) (int64, error) {
+		return 2 << 30, nil
+	}
+	reloaded := false
+	dmReloadDevice = func(name string, flags dm.CreateFlags, targets []dm.Target) error {
+		expected := dm.CryptTarget(0, (2<<30)/dm.BlockSize, defaultCipher, "00ff", 0, "/dev/sdc", 0)
+		if name != "dm-crypt-scsi1-2" || len(targets) != 1 || targets[0] != expected {
+			t.Errorf("unexpected reload of %s: %+v", name, targets)
+		}
+		reloaded = true
+		return nil
+	}
+	growFilesystem = func(ctx context.Context, source, target string, sizeInBytes uint64) (uint64, error) {
+		if !reloaded || source != "/dev/mapper/dm-crypt-scsi1-2" {
+			t.Errorf("expected the reloaded crypt target to be grown got: %s", source)
+		}
+		return sizeInBytes, nil
+	}
+
+	if _, _, err := Resize(context.Background(), 1, 2, "/run/mounts/m2", &prot.DeviceEncryptionInfo{Key: "00ff"}); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	reloaded = false
+	if _, _, err := Resize(context.Background(), 1, 2, "/run/mounts/m2", &prot.DeviceEncryptionInfo{}); err == nil {
+		t.Fatal("expected error resizing a disk with an ephemeral key")
+	}
+	if reloaded {
+		t.Fatal("expected no reload for a disk with an ephemeral key")
+	}
+}
@@ -0,0 +1,98 @@
+// +build linux
+
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+// FilesystemUsage is the usage of the filesystem a path is on.
+type FilesystemUsage struct {
+	TotalBytes     uint64
+	UsedBytes      uint64
+	AvailableBytes uint64
+	TotalInodes    uint64
+	UsedInodes     uint64
+	FreeInodes     uint64
+}
+
+// GetFilesystemUsage returns the usage of the filesystem `path` is on.
+func GetFilesystemUsage(path string) (*FilesystemUsage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return nil, errors.Wrapf(err, "failed to statfs %s", path)
+	}
+	bsize := uint64(st.Bsize)
+	return &FilesystemUsage{
+		TotalBytes:     st.Blocks * bsize,
+		UsedBytes:      (st.Blocks - st.Bfree) * bsize,
+		AvailableBytes: st.Bavail * bsize,
+		TotalInodes:    st.Files,
+		UsedInodes:     st.Files - st.Ffree,
+		FreeInodes:     st.Ffree,
+	}, nil
+}
+
+// inode identifies a file across the filesystems of a walk.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// GetDirectoryUsage returns the bytes allocated to and the number of inodes
+// used by `path` and everything under it, as `du -x` counts them. Files with
+// several hard links are counted once and directories on other filesystems
+// are not entered. Files removed during the walk are skipped.
+func GetDirectoryUsage(ctx context.Context, path string) (bytes, inodes uint64, err error) {
+	_, span := trace.StartSpan(ctx, "storage::GetDirectoryUsage")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(trace.StringAttribute("path", path))
+
+	var rootDev uint64
+	first := true
+	seen := make(map[inode]struct{})
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Errorf("failed to stat %s", p)
+		}
+		if first {
+			rootDev, first = uint64(st.Dev), false
+		} else if info.IsDir() && uint64(st.Dev) != rootDev {
+			return filepath.SkipDir
+		}
+		if st.Nlink > 1 && !info.IsDir() {
+			key := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+		}
+		bytes += uint64(st.Blocks) * 512
+		inodes++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to walk %s", path)
+	}
+	return bytes, inodes, nil
+}
@@ -0,0 +1,76 @@
+// +build linux
+
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_GetFilesystemUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	usage, err := GetFilesystemUsage(dir)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if usage.TotalBytes == 0 || usage.UsedBytes > usage.TotalBytes || usage.AvailableBytes > usage.TotalBytes {
+		t.Fatalf("unexpected byte usage: %+v", usage)
+	}
+	if usage.UsedInodes+usage.FreeInodes != usage.TotalInodes {
+		t.Fatalf("unexpected inode usage: %+v", usage)
+	}
+
+	if _, err := GetFilesystemUsage(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected error for a missing path")
+	}
+}
+
+func Test_GetDirectoryUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = 1
+	}
+	file := filepath.Join(dir, "sub", "file")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	// A hard link is counted once.
+	if err := os.Link(file, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("failed to link file: %v", err)
+	}
+
+	bytes, inodes, err := GetDirectoryUsage(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	// The root, sub and the linked file.
+	if inodes != 3 {
+		t.Fatalf("expected 3 inodes got: %d", inodes)
+	}
+	if bytes < uint64(len(data)) {
+		t.Fatalf("expected at least %d bytes got: %d", len(data), bytes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := GetDirectoryUsage(ctx, dir); err == nil {
+		t.Fatal("expected error for a cancelled context")
+	}
+}
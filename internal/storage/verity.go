@@ -0,0 +1,375 @@
+// +build linux
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+
+	"github.com/Microsoft/opengcs/internal/log"
+	"github.com/Microsoft/opengcs/internal/oc"
+	dm "github.com/Microsoft/opengcs/internal/storage/devicemapper"
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// veritySuperBlockSize is the size of the superblock written by
+	// `veritysetup format` in front of the hash tree.
+	veritySuperBlockSize = 512
+	veritySignature      = "verity\x00\x00"
+	// noSalt is the dm-verity table salt used for an empty salt.
+	noSalt = "-"
+
+	ext4SuperBlockOffset     = 1024
+	ext4FeatureIncompat64Bit = 0x80
+)
+
+// veritySuperBlock is the on-disk dm-verity superblock, all fields are little
+// endian.
+type veritySuperBlock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [256]byte
+	_             [168]byte
+}
+
+// verityHashes maps the supported dm-verity hash algorithms to their
+// implementation.
+var verityHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// ValidateVerityInfo returns an error if `verityInfo` does not describe a
+// valid dm-verity hash tree. If the hash tree parameters are read from the
+// verity superblock only the root digest is checked.
+func ValidateVerityInfo(verityInfo *prot.DeviceVerityInfo) error {
+	if !verityInfo.ReadSuperBlock {
+		if err := validateVerityParams(verityInfo); err != nil {
+			return err
+		}
+	}
+	if _, err := hex.DecodeString(verityInfo.RootDigest); err != nil || verityInfo.RootDigest == "" {
+		return errors.Errorf("invalid verity root digest '%s'", verityInfo.RootDigest)
+	}
+	if verityInfo.RootDigestSignature != "" {
+		if sig, err := base64.StdEncoding.DecodeString(verityInfo.RootDigestSignature); err != nil || len(sig) == 0 {
+			return errors.New("invalid verity root digest signature, expected base64")
+		}
+	}
+	return nil
+}
+
+// validateVerityParams returns an error if the hash tree parameters of
+// `verityInfo` are invalid. The root digest is not checked.
+func validateVerityParams(verityInfo *prot.DeviceVerityInfo) error {
+	if verityInfo.BlockSize <= 0 || verityInfo.BlockSize%dm.BlockSize != 0 {
+		return errors.Errorf("invalid verity block size %d", verityInfo.BlockSize)
+	}
+	if verityInfo.Ext4SizeInBytes <= 0 || verityInfo.Ext4SizeInBytes%int64(verityInfo.BlockSize) != 0 {
+		return errors.Errorf("invalid verity data size %d for block size %d", verityInfo.Ext4SizeInBytes, verityInfo.BlockSize)
+	}
+	for name, v := range map[string]string{
+		"algorithm": verityInfo.Algorithm,
+		"salt":      verityInfo.Salt,
+	} {
+		if v == "" || strings.ContainsAny(v, " \t\n\x00") {
+			return errors.Errorf("invalid verity %s '%s'", name, v)
+		}
+	}
+	return nil
+}
+
+// ext4Size returns the size in bytes of the ext4 filesystem at the start of
+// `r`.
+func ext4Size(r io.ReaderAt) (int64, error) {
+	var sb [0x158]byte
+	if _, err := r.ReadAt(sb[:], ext4SuperBlockOffset); err != nil {
+		return 0, errors.Wrap(err, "failed to read ext4 superblock")
+	}
+	if !bytes.Equal(sb[0x38:0x3a], le16(0xEF53)) {
+		return 0, errors.New("no ext4 superblock found")
+	}
+	blocks := uint64(binary.LittleEndian.Uint32(sb[0x4:]))
+	if binary.LittleEndian.Uint32(sb[0x60:])&ext4FeatureIncompat64Bit != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+	}
+	logBlockSize := binary.LittleEndian.Uint32(sb[0x18:])
+	if logBlockSize > 6 {
+		return 0, errors.Errorf("invalid ext4 block size 2^%d KiB", logBlockSize)
+	}
+	return int64(blocks * (1024 << logBlockSize)), nil
+}
+
+// ReadVeritySuperBlock returns the dm-verity hash tree parameters of the ext4
+// image `source` read from the verity superblock appended after the ext4
+// filesystem. The returned root digest is empty, it must come from a trusted
+// source.
+func ReadVeritySuperBlock(source string) (*prot.DeviceVerityInfo, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := ext4Size(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", source)
+	}
+	b := make([]byte, veritySuperBlockSize)
+	if _, err := f.ReadAt(b, size); err != nil {
+		return nil, errors.Wrapf(err, "failed to read verity superblock of %s", source)
+	}
+	var sb veritySuperBlock
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+
+	if string(sb.Signature[:]) != veritySignature {
+		return nil, errors.Errorf("no verity superblock found on %s", source)
+	}
+	if sb.Version != 1 {
+		return nil, errors.Errorf("unsupported verity superblock version %d", sb.Version)
+	}
+	if sb.DataBlockSize != sb.HashBlockSize {
+		return nil, errors.Errorf("verity data block size %d and hash block size %d differ", sb.DataBlockSize, sb.HashBlockSize)
+	}
+	if int(sb.SaltSize) > len(sb.Salt) {
+		return nil, errors.Errorf("invalid verity salt size %d", sb.SaltSize)
+	}
+	if dataSize := int64(sb.DataBlocks * uint64(sb.DataBlockSize)); dataSize != size {
+		return nil, errors.Errorf("verity data size %d does not match ext4 size %d", dataSize, size)
+	}
+
+	salt := noSalt
+	if sb.SaltSize != 0 {
+		salt = hex.EncodeToString(sb.Salt[:sb.SaltSize])
+	}
+	verityInfo := &prot.DeviceVerityInfo{
+		Ext4SizeInBytes: size,
+		Version:         int(sb.HashType),
+		Algorithm:       string(bytes.TrimRight(sb.Algorithm[:], "\x00")),
+		SuperBlock:      true,
+		Salt:            salt,
+		BlockSize:       int(sb.DataBlockSize),
+	}
+	if err := validateVerityParams(verityInfo); err != nil {
+		return nil, err
+	}
+	return verityInfo, nil
+}
+
+// VerityRootDigest computes the dm-verity root digest of the data described
+// by `verityInfo` at the start of `r`. This is the digest `veritysetup format`
+// produces for the data, so comparing it to a trusted digest verifies the
+// data offline.
+func VerityRootDigest(r io.ReaderAt, verityInfo *prot.DeviceVerityInfo) (string, error) {
+	newHash, ok := verityHashes[verityInfo.Algorithm]
+	if !ok {
+		return "", errors.Errorf("unsupported verity algorithm '%s'", verityInfo.Algorithm)
+	}
+	var salt []byte
+	if verityInfo.Salt != noSalt {
+		var err error
+		if salt, err = hex.DecodeString(verityInfo.Salt); err != nil {
+			return "", errors.Wrap(err, "invalid verity salt")
+		}
+	}
+	h := newHash()
+	digest := func(block []byte) []byte {
+		h.Reset()
+		if verityInfo.Version == 0 {
+			h.Write(block)
+			h.Write(salt)
+		} else {
+			h.Write(salt)
+			h.Write(block)
+		}
+		return h.Sum(nil)
+	}
+
+	// Version 1 pads every digest in a hash block to a power of two. Either
+	// way a hash block holds a power of two digests.
+	blockSize := verityInfo.BlockSize
+	digestSize := h.Size()
+	if verityInfo.Version != 0 {
+		digestSize = 1 << uint(bits.Len(uint(digestSize-1)))
+	}
+	if blockSize/digestSize < 2 {
+		return "", errors.Errorf("verity block size %d is too small for %s", blockSize, verityInfo.Algorithm)
+	}
+	perBlock := 1 << uint(bits.Len(uint(blockSize/digestSize))-1)
+
+	// Hash the data blocks, then every level of hash blocks until a single
+	// block remains whose digest is the root.
+	dataBlocks := verityInfo.Ext4SizeInBytes / int64(blockSize)
+	if dataBlocks == 0 {
+		return "", errors.New("no verity data blocks")
+	}
+	block := make([]byte, blockSize)
+	var digests [][]byte
+	for i := int64(0); i < dataBlocks; i++ {
+		if _, err := r.ReadAt(block, i*int64(blockSize)); err != nil {
+			return "", errors.Wrapf(err, "failed to read data block %d", i)
+		}
+		digests = append(digests, digest(block))
+	}
+	if len(digests) == 1 {
+		return hex.EncodeToString(digests[0]), nil
+	}
+	for {
+		var next [][]byte
+		for i := 0; i < len(digests); i += perBlock {
+			for j := range block {
+				block[j] = 0
+			}
+			for j := 0; j < perBlock && i+j < len(digests); j++ {
+				copy(block[j*digestSize:], digests[i+j])
+			}
+			next = append(next, digest(block))
+		}
+		if len(next) == 1 {
+			return hex.EncodeToString(next[0]), nil
+		}
+		digests = next
+	}
+}
+
+// verityTarget returns the dm-verity target for `devPath` with the hash tree
+// appended after the data described by `verityInfo`. If `sigKeyDesc` is not
+// empty it is the description of the user key holding the signature of the
+// root digest.
+//
+// verity target table
+//
+//	0 417792 verity 1 /dev/sdb /dev/sdc 4096 4096 52224 1 sha256 2aa4f7b7b6...f4952060e8 762307f4bc8...d2a6b7595d8..
+//	|    |     |    |     |     |        |    |    |    |    |              |                        |
+//	start|     |    |  data_dev |  data_block | #blocks | hash_alg      root_digest                salt
+//	    size   |  version    hash_dev         |     hash_offset
+//	         target                       hash_block
+func verityTarget(devPath string, verityInfo *prot.DeviceVerityInfo, sigKeyDesc string) dm.Target {
+	dmBlocks := verityInfo.Ext4SizeInBytes / dm.BlockSize
+	dataBlocks := verityInfo.Ext4SizeInBytes / int64(verityInfo.BlockSize)
+	hashOffsetBlocks := dataBlocks
+	if verityInfo.SuperBlock {
+		hashOffsetBlocks++
+	}
+	hashes := fmt.Sprintf("%s %s %s", verityInfo.Algorithm, verityInfo.RootDigest, verityInfo.Salt)
+	blkInfo := fmt.Sprintf("%d %d %d %d", verityInfo.BlockSize, verityInfo.BlockSize, dataBlocks, hashOffsetBlocks)
+	devices := fmt.Sprintf("%s %s", devPath, devPath)
+	params := fmt.Sprintf("%d %s %s %s", verityInfo.Version, devices, blkInfo, hashes)
+	if sigKeyDesc != "" {
+		params += " 2 root_hash_sig_key_desc " + sigKeyDesc
+	}
+
+	return dm.Target{
+		SectorStart:    0,
+		LengthInBlocks: dmBlocks,
+		Type:           "verity",
+		Params:         params,
+	}
+}
+
+// CreateVerityTarget creates the read-only dm-verity target `devName` for the
+// device `devPath` and returns its path. The hash device is `devPath` itself,
+// with the hash tree appended after the data. If `verityInfo.ReadSuperBlock`
+// is set the hash tree parameters are read from the device, see
+// `ReadVeritySuperBlock`. If `verityInfo.RootDigestSignature` is set the
+// signature is passed to the kernel in a user key that only exists while the
+// target is created.
+func CreateVerityTarget(ctx context.Context, devPath, devName string, verityInfo *prot.DeviceVerityInfo) (_ string, err error) {
+	_, span := trace.StartSpan(ctx, "storage::CreateVerityTarget")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	if verityInfo.ReadSuperBlock {
+		sbInfo, err := ReadVeritySuperBlock(devPath)
+		if err != nil {
+			return "", err
+		}
+		sbInfo.RootDigest = verityInfo.RootDigest
+		sbInfo.RootDigestSignature = verityInfo.RootDigestSignature
+		verityInfo = sbInfo
+	}
+	sigKeyDesc := ""
+	if verityInfo.RootDigestSignature != "" {
+		sig, err := base64.StdEncoding.DecodeString(verityInfo.RootDigestSignature)
+		if err != nil {
+			return "", errors.Wrap(err, "invalid verity root digest signature")
+		}
+		// The kernel reads the signature when the table is loaded, the key is
+		// not needed afterwards.
+		sigKeyDesc = "opengcs:" + devName
+		id, err := unix.AddKey("user", sigKeyDesc, sig, unix.KEY_SPEC_PROCESS_KEYRING)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to add verity root digest signature key")
+		}
+		defer func() {
+			if _, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_PROCESS_KEYRING, 0, 0); err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to unlink verity signature key: %s", sigKeyDesc)
+			}
+		}()
+	}
+	target := verityTarget(devPath, verityInfo, sigKeyDesc)
+
+	span.AddAttributes(
+		trace.StringAttribute("devicePath", devPath),
+		trace.StringAttribute("deviceName", devName),
+		trace.Int64Attribute("sectorSize", target.LengthInBlocks),
+		trace.StringAttribute("verityTable", target.Params))
+
+	mapperPath, err := dm.CreateDevice(devName, dm.CreateReadOnly, []dm.Target{target})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create dm-verity target: device: %s", devPath)
+	}
+
+	return mapperPath, nil
+}
+
+// RemoveVerityTarget removes the dm-verity target `devName`. A warning is
+// logged if the target detected corrupted data while it was in use.
+func RemoveVerityTarget(ctx context.Context, devName string) (err error) {
+	_, span := trace.StartSpan(ctx, "storage::RemoveVerityTarget")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(trace.StringAttribute("deviceName", devName))
+
+	if status, err := dm.Status(devName); err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to get the status of verity target: %s", devName)
+	} else {
+		for _, t := range status.Targets {
+			if t.Corrupted() {
+				log.G(ctx).WithField("deviceName", devName).Warning("verity target detected corrupted data")
+			}
+		}
+	}
+	if err := dm.RemoveDevice(devName); err != nil {
+		return errors.Wrapf(err, "failed to remove dm verity target: %s", devName)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// +build linux
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/opengcs/service/gcs/prot"
+)
+
+func validVerityInfo() *prot.DeviceVerityInfo {
+	return &prot.DeviceVerityInfo{
+		Ext4SizeInBytes: 213909504,
+		Version:         1,
+		Algorithm:       "sha256",
+		SuperBlock:      true,
+		RootDigest:      "2aa4f7b7b6f4952060e8",
+		Salt:            "762307f4bcd2a6b7595d",
+		BlockSize:       4096,
+	}
+}
+
+func Test_verityTarget(t *testing.T) {
+	target := verityTarget("/dev/sdb", validVerityInfo(), "")
+	if target.Type != "verity" || target.SectorStart != 0 || target.LengthInBlocks != 417792 {
+		t.Fatalf("unexpected target: %+v", target)
+	}
+	expected := "1 /dev/sdb /dev/sdb 4096 4096 52224 52225 sha256 2aa4f7b7b6f4952060e8 762307f4bcd2a6b7595d"
+	if target.Params != expected {
+		t.Fatalf("expected params '%s' got '%s'", expected, target.Params)
+	}
+
+	target = verityTarget("/dev/sdb", validVerityInfo(), "opengcs:dm-verity")
+	expected += " 2 root_hash_sig_key_desc opengcs:dm-verity"
+	if target.Params != expected {
+		t.Fatalf("expected params '%s' got '%s'", expected, target.Params)
+	}
+}
+
+func Test_ValidateVerityInfo(t *testing.T) {
+	if err := ValidateVerityInfo(validVerityInfo()); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	signed := validVerityInfo()
+	signed.RootDigestSignature = "MIIB"
+	if err := ValidateVerityInfo(signed); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+
+	for name, modify := range map[string]func(*prot.DeviceVerityInfo){
+		"BlockSize":       func(vi *prot.DeviceVerityInfo) { vi.BlockSize = 1000 },
+		"Ext4SizeInBytes": func(vi *prot.DeviceVerityInfo) { vi.Ext4SizeInBytes = 4097 },
+		"Algorithm":       func(vi *prot.DeviceVerityInfo) { vi.Algorithm = "" },
+		"Salt":            func(vi *prot.DeviceVerityInfo) { vi.Salt = "a b" },
+		"RootDigest":      func(vi *prot.DeviceVerityInfo) { vi.RootDigest = "xyz" },
+		"Signature":       func(vi *prot.DeviceVerityInfo) { vi.RootDigestSignature = "not base64!" },
+	} {
+		vi := validVerityInfo()
+		modify(vi)
+		if err := ValidateVerityInfo(vi); err == nil {
+			t.Fatalf("%s: expected error got nil", name)
+		}
+	}
+}
+
+// writeVerityImage writes an image of `dataBlocks` 4KiB blocks starting with an
+// ext4 superblock, followed by a verity superblock.
+func writeVerityImage(t *testing.T, path string, dataBlocks uint32, salt []byte) []byte {
+	data := make([]byte, int(dataBlocks)*4096)
+	copy(data[ext4SuperBlockOffset+0x38:], le16(0xEF53))
+	binary.LittleEndian.PutUint32(data[ext4SuperBlockOffset+0x4:], dataBlocks)
+	binary.LittleEndian.PutUint32(data[ext4SuperBlockOffset+0x18:], 2)
+	for i := 2048; i < len(data); i++ {
+		data[i] = byte(i / 4096)
+	}
+
+	sb := veritySuperBlock{
+		Version:       1,
+		HashType:      1,
+		DataBlockSize: 4096,
+		HashBlockSize: 4096,
+		DataBlocks:    uint64(dataBlocks),
+		SaltSize:      uint16(len(salt)),
+	}
+	copy(sb.Signature[:], veritySignature)
+	copy(sb.Algorithm[:], "sha256")
+	copy(sb.Salt[:], salt)
+	buf := bytes.NewBuffer(append([]byte{}, data...))
+	if err := binary.Write(buf, binary.LittleEndian, &sb); err != nil {
+		t.Fatalf("failed to write verity superblock: %v", err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+	return data
+}
+
+func Test_ReadVeritySuperBlock_RootDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	salt := []byte{0xde, 0xad, 0xbe, 0xef}
+	image := filepath.Join(dir, "image")
+	data := writeVerityImage(t, image, 2, salt)
+
+	verityInfo, err := ReadVeritySuperBlock(image)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	expected := prot.DeviceVerityInfo{
+		Ext4SizeInBytes: 8192,
+		Version:         1,
+		Algorithm:       "sha256",
+		SuperBlock:      true,
+		Salt:            "deadbeef",
+		BlockSize:       4096,
+	}
+	if *verityInfo != expected {
+		t.Fatalf("expected %+v got %+v", expected, *verityInfo)
+	}
+
+	// With two data blocks the tree is a single hash block of their digests.
+	digest := func(b []byte) []byte {
+		d := sha256.Sum256(append(append([]byte{}, salt...), b...))
+		return d[:]
+	}
+	hashBlock := make([]byte, 4096)
+	copy(hashBlock, digest(data[:4096]))
+	copy(hashBlock[32:], digest(data[4096:]))
+	expectedDigest := hex.EncodeToString(digest(hashBlock))
+
+	f, err := os.Open(image)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer f.Close()
+	rootDigest, err := VerityRootDigest(f, verityInfo)
+	if err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if rootDigest != expectedDigest {
+		t.Fatalf("expected root digest %s got %s", expectedDigest, rootDigest)
+	}
+}
+
+func Test_ReadVeritySuperBlock_Missing(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "image")
+	data := writeVerityImage(t, image, 2, nil)
+	if err := ioutil.WriteFile(image, append(data, make([]byte, veritySuperBlockSize)...), 0600); err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+	if _, err := ReadVeritySuperBlock(image); err == nil {
+		t.Fatal("expected error for image without verity superblock")
+	}
+}
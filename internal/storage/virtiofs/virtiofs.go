@@ -0,0 +1,123 @@
+// +build linux
+
+package virtiofs
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+
+	"github.com/Microsoft/opengcs/internal/oc"
+	"github.com/pkg/errors"
+	"go.opencensus.io/trace"
+	"golang.org/x/sys/unix"
+)
+
+// Test dependencies
+var (
+	osMkdirAll          = os.MkdirAll
+	osRemoveAll         = os.RemoveAll
+	unixMount           = unix.Mount
+	procFilesystemsFile = "/proc/filesystems"
+)
+
+// DAX modes of a virtio-fs mount.
+const (
+	// DAXAlways maps the files of the share directly into guest memory.
+	DAXAlways = "always"
+	// DAXNever uses the guest page cache for all files.
+	DAXNever = "never"
+	// DAXInode uses DAX per file as chosen by the host.
+	DAXInode = "inode"
+)
+
+// Supported returns true if the kernel supports virtio-fs.
+func Supported() bool {
+	f, err := os.Open(procFilesystemsFile)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "virtiofs" {
+			return true
+		}
+	}
+	return false
+}
+
+// mountData returns the mount data of the DAX mode `dax`. `DAXAlways` uses the
+// `dax` option understood by all kernels with DAX support. `DAXNever` must be
+// explicit because since Linux 5.17 the default of the kernel is
+// `DAXInode`, see `Mount` for older kernels.
+func mountData(dax string) (string, error) {
+	switch dax {
+	case "":
+		return "", nil
+	case DAXNever:
+		return "dax=" + DAXNever, nil
+	case DAXAlways:
+		return "dax", nil
+	case DAXInode:
+		return "dax=" + DAXInode, nil
+	default:
+		return "", errors.Errorf("invalid DAX mode %q, must be one of: %s, %s, %s", dax, DAXAlways, DAXNever, DAXInode)
+	}
+}
+
+// ValidateDAX returns an error if `dax` is not a valid DAX mode.
+func ValidateDAX(dax string) error {
+	_, err := mountData(dax)
+	return err
+}
+
+// Mount mounts the virtio-fs share with tag `tag` to `target` using the DAX
+// mode `dax`. An empty `dax` uses the kernel default. Kernels before 5.17 do not
+// understand `dax=never`, for them `DAXNever` is the default and the share is
+// mounted without a DAX option.
+//
+// `target` will be created. On mount failure the created `target` will be
+// automatically cleaned up.
+func Mount(ctx context.Context, tag, target string, readonly bool, dax string) (err error) {
+	_, span := trace.StartSpan(ctx, "virtiofs::Mount")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+
+	span.AddAttributes(
+		trace.StringAttribute("tag", tag),
+		trace.StringAttribute("target", target),
+		trace.BoolAttribute("readonly", readonly),
+		trace.StringAttribute("dax", dax))
+
+	if tag == "" {
+		return errors.New("virtio-fs tag must not be empty")
+	}
+	data, err := mountData(dax)
+	if err != nil {
+		return err
+	}
+	if err := osMkdirAll(target, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			osRemoveAll(target)
+		}
+	}()
+	var flags uintptr
+	if readonly {
+		flags |= unix.MS_RDONLY
+	}
+	err = unixMount(tag, target, "virtiofs", flags, data)
+	if err == unix.EINVAL && dax == DAXNever {
+		err = unixMount(tag, target, "virtiofs", flags, "")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to mount virtio-fs share %s onto %s", tag, target)
+	}
+	return nil
+}
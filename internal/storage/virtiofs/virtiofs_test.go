@@ -0,0 +1,109 @@
+// +build linux
+
+package virtiofs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func Test_Supported(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := procFilesystemsFile
+	defer func() {
+		procFilesystemsFile = old
+	}()
+	procFilesystemsFile = filepath.Join(dir, "filesystems")
+
+	for _, test := range []struct {
+		content  string
+		expected bool
+	}{
+		{"nodev\tsysfs\nnodev\t9p\n\text4\n", false},
+		{"nodev\tsysfs\nnodev\tvirtiofs\n\text4\n", true},
+	} {
+		if err := ioutil.WriteFile(procFilesystemsFile, []byte(test.content), 0600); err != nil {
+			t.Fatalf("failed to write filesystems: %v", err)
+		}
+		if Supported() != test.expected {
+			t.Fatalf("expected supported: %v for %q", test.expected, test.content)
+		}
+	}
+}
+
+func Test_Mount_DAX(t *testing.T) {
+	oldMkdirAll, oldRemoveAll, oldMount := osMkdirAll, osRemoveAll, unixMount
+	defer func() {
+		osMkdirAll, osRemoveAll, unixMount = oldMkdirAll, oldRemoveAll, oldMount
+	}()
+	osMkdirAll = func(path string, perm os.FileMode) error {
+		return nil
+	}
+	osRemoveAll = func(path string) error {
+		return nil
+	}
+
+	for _, test := range []struct {
+		dax  string
+		data string
+	}{
+		{"", ""},
+		{DAXNever, "dax=never"},
+		{DAXAlways, "dax"},
+		{DAXInode, "dax=inode"},
+	} {
+		unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+			if source != "share0" || target != "/run/mounts/m0" || fstype != "virtiofs" {
+				t.Errorf("unexpected mount of %s onto %s type %s", source, target, fstype)
+			}
+			if flags != unix.MS_RDONLY {
+				t.Errorf("expected flags: %v got: %v", unix.MS_RDONLY, flags)
+			}
+			if data != test.data {
+				t.Errorf("expected data: %q got: %q", test.data, data)
+			}
+			return nil
+		}
+		if err := Mount(context.Background(), "share0", "/run/mounts/m0", true, test.dax); err != nil {
+			t.Fatalf("dax %q: expected nil error got: %v", test.dax, err)
+		}
+	}
+
+	// Kernels before 5.17 reject dax=never and never use DAX without an
+	// option.
+	var mounts []string
+	unixMount = func(source string, target string, fstype string, flags uintptr, data string) error {
+		mounts = append(mounts, data)
+		if data == "dax=never" {
+			return unix.EINVAL
+		}
+		return nil
+	}
+	if err := Mount(context.Background(), "share0", "/run/mounts/m0", true, DAXNever); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(mounts) != 2 || mounts[1] != "" {
+		t.Fatalf("expected a retry without a DAX option got: %q", mounts)
+	}
+	mounts = nil
+	if err := Mount(context.Background(), "share0", "/run/mounts/m0", true, DAXInode); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("expected no retry for dax=inode got: %q", mounts)
+	}
+
+	unixMount = nil
+	if err := Mount(context.Background(), "share0", "/run/mounts/m0", true, "sometimes"); err == nil {
+		t.Fatal("expected error for an invalid DAX mode")
+	}
+}
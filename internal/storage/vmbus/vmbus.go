@@ -4,15 +4,47 @@ package vmbus
 
 import (
 	"context"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/pkg/errors"
 )
 
 var storageWaitForFileMatchingPattern = storage.WaitForFileMatchingPattern
 
+// Test dependencies
+var devicesPath = "/sys/bus/vmbus/devices"
+
 // WaitForDevicePath waits for the vmbus device to exist at /sys/bus/vmbus/devices/<vmbusGUIDPattern>...
 func WaitForDevicePath(ctx context.Context, vmbusGUIDPattern string) (string, error) {
-	vmBusPath := filepath.Join("/sys/bus/vmbus/devices", vmbusGUIDPattern)
+	vmBusPath := filepath.Join(devicesPath, vmbusGUIDPattern)
 	return storageWaitForFileMatchingPattern(ctx, vmBusPath)
 }
+
+// WaitForDeviceRemoval waits for the vmbus device /sys/bus/vmbus/devices/<vmbusGUID>
+// to no longer exist.
+func WaitForDeviceRemoval(ctx context.Context, vmbusGUID string) error {
+	vmBusPath := filepath.Join(devicesPath, vmbusGUID)
+	for {
+		if _, err := os.Stat(vmBusPath); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "timed out waiting for vmbus device %s to be removed", vmbusGUID)
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+// DeviceExists returns true if the vmbus device /sys/bus/vmbus/devices/<vmbusGUID>
+// exists.
+func DeviceExists(vmbusGUID string) bool {
+	_, err := os.Stat(filepath.Join(devicesPath, vmbusGUID))
+	return err == nil
+}
@@ -4,6 +4,8 @@ package vmbus
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -33,3 +35,40 @@ func Test_WaitForVMBusDevicePath_Success(t *testing.T) {
 		t.Fatalf("result %s does not match expected result %s", result, expectedResult)
 	}
 }
+
+func Test_WaitForDeviceRemoval(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	oldDevicesPath := devicesPath
+	defer func() {
+		devicesPath = oldDevicesPath
+	}()
+	devicesPath = dir
+
+	vmBusGUID := "1111-2222-3333-4444"
+	if err := os.Mkdir(filepath.Join(dir, vmBusGUID), 0755); err != nil {
+		t.Fatalf("failed to create device: %v", err)
+	}
+	if !DeviceExists(vmBusGUID) {
+		t.Fatal("expected device to exist")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := WaitForDeviceRemoval(ctx, vmBusGUID); err == nil {
+		t.Fatal("expected timeout waiting for a device that is not removed")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.Remove(filepath.Join(dir, vmBusGUID))
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := WaitForDeviceRemoval(ctx, vmBusGUID); err != nil {
+		t.Fatalf("expected nil error got: %v", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -215,6 +216,7 @@ func (b *Bridge) AssignHandlers(mux *Mux, host *hcsv2.Host) {
 		mux.HandleFunc(prot.ComputeSystemModifySettingsV1, prot.PvV4, b.modifySettingsV2)
 		mux.HandleFunc(prot.ComputeSystemDumpStacksV1, prot.PvV4, b.dumpStacksV2)
 		mux.HandleFunc(prot.ComputeSystemDeleteContainerStateV1, prot.PvV4, b.deleteContainerStateV2)
+		mux.HandleFunc(prot.ComputeSystemPortForwardV1, prot.PvV4, b.portForwardV2)
 	}
 }
 
@@ -298,7 +300,9 @@ func (b *Bridge) ListenAndServe(bridgeIn io.ReadCloser, bridgeOut io.WriteCloser
 					trace.StringAttribute("activityID", base.ActivityID),
 					trace.StringAttribute("cid", base.ContainerID))
 
-				log.G(ctx).WithField("message", string(message)).Debug("request read message")
+				if entry := log.G(ctx); entry.Logger.IsLevelEnabled(logrus.DebugLevel) {
+					entry.WithField("message", redactMessage(message)).Debug("request read message")
+				}
 
 				requestChan <- &Request{
 					Context:     ctx,
@@ -456,3 +460,47 @@ func setErrorForResponseBase(response *prot.MessageResponseBase, errForResponse
 	}
 	response.ErrorRecords = append(response.ErrorRecords, newRecord)
 }
+
+// redactedValue replaces secrets in logged messages.
+const redactedValue = "<redacted>"
+
+// redactMessage returns the JSON `message` for logging with the key of every
+// `prot.DeviceEncryptionInfo` in it replaced.
+func redactMessage(message []byte) string {
+	if !strings.Contains(strings.ToLower(string(message)), "encryption") {
+		return string(message)
+	}
+	var v interface{}
+	if err := json.Unmarshal(message, &v); err != nil {
+		return redactedValue
+	}
+	redactEncryptionKeys(v)
+	b, err := json.Marshal(v)
+	if err != nil {
+		return redactedValue
+	}
+	return string(b)
+}
+
+// redactEncryptionKeys replaces the `Key` of every `Encryption` object in the
+// decoded JSON `v`. Field names match case-insensitively as they do when the
+// message is unmarshaled.
+func redactEncryptionKeys(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			if encryption, ok := child.(map[string]interface{}); ok && strings.EqualFold(name, "Encryption") {
+				for field := range encryption {
+					if strings.EqualFold(field, "Key") {
+						encryption[field] = redactedValue
+					}
+				}
+			}
+			redactEncryptionKeys(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactEncryptionKeys(child)
+		}
+	}
+}
@@ -661,3 +661,19 @@ func Test_Bridge_ListenAndServe_HandlersAreAsync_Success(t *testing.T) {
 		t.Error("Incorrect response order for 1st request")
 	}
 }
+
+func Test_redactMessage(t *testing.T) {
+	message := `{"ContainerId":"00000000-0000-0000-0000-000000000000","Request":{"ResourceType":"MappedVirtualDisk","RequestType":"Add","Settings":{"MountPath":"/run/mounts/m1","encryption":{"Cipher":"aes-xts-plain64","key":"00112233"}}}}`
+	redacted := redactMessage([]byte(message))
+	if strings.Contains(redacted, "00112233") {
+		t.Fatalf("expected the key to be redacted got: %s", redacted)
+	}
+	if !strings.Contains(redacted, "aes-xts-plain64") || !strings.Contains(redacted, "/run/mounts/m1") {
+		t.Fatalf("expected the rest of the message to be kept got: %s", redacted)
+	}
+
+	message = `{"ContainerId":"test"}`
+	if redacted := redactMessage([]byte(message)); redacted != message {
+		t.Fatalf("expected %s got: %s", message, redacted)
+	}
+}
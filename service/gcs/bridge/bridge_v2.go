@@ -36,6 +36,7 @@ var capabilities = prot.GcsCapabilities{
 		SignalProcessSupported:        true,
 		DumpStacksSupported:           true,
 		DeleteContainerStateSupported: true,
+		PortForwardSupported:          true,
 	},
 }
 
@@ -68,9 +69,12 @@ func (b *Bridge) negotiateProtocolV2(r *Request) (_ RequestResponse, err error)
 	// Set our protocol selected version before return.
 	b.protVer = prot.ProtocolVersion(major)
 
+	caps := capabilities
+	caps.GuestDefinedCapabilities.SupportedOverlayOptions = b.hostState.SupportedOverlayOptions()
+	caps.GuestDefinedCapabilities.VirtioFSSupported = b.hostState.VirtioFSSupported()
 	return &prot.NegotiateProtocolResponse{
 		Version:      major,
-		Capabilities: capabilities,
+		Capabilities: caps,
 	}, nil
 }
 
@@ -331,12 +335,26 @@ func (b *Bridge) getPropertiesV2(r *Request) (_ RequestResponse, err error) {
 	if len(request.Query) != 0 {
 		if err := json.Unmarshal([]byte(request.Query), &query); err != nil {
 			e := gcserr.WrapHresult(err, gcserr.HrVmcomputeInvalidJSON)
-			return nil, errors.Wrapf(e, "The query could not be unmarshaled: '%s'", query)
+			return nil, errors.Wrapf(e, "The query could not be unmarshaled: '%s'", request.Query)
 		}
 	}
 
 	if request.ContainerID == hcsv2.UVMContainerID {
-		return nil, errors.New("getPropertiesV2 is not supported against the UVM")
+		for _, requestedProperty := range query.PropertyTypes {
+			switch requestedProperty {
+			case prot.PtMounts:
+				properties.Mounts = b.hostState.Mounts()
+			case prot.PtStorageUsage:
+				usage, err := b.hostState.GetStorageUsage(ctx, request.ContainerID, query.StorageUsage)
+				if err != nil {
+					return nil, err
+				}
+				properties.StorageUsage = usage
+			default:
+				return nil, errors.Errorf("getPropertiesV2 of \"%s\" is not supported against the UVM", requestedProperty)
+			}
+		}
+		return marshalPropertiesV2(properties)
 	}
 
 	c, err := b.hostState.GetContainer(request.ContainerID)
@@ -360,9 +378,25 @@ func (b *Bridge) getPropertiesV2(r *Request) (_ RequestResponse, err error) {
 				return nil, err
 			}
 			properties.Metrics = cgroupMetrics
+		} else if requestedProperty == prot.PtScratchUsage {
+			usage, err := b.hostState.GetScratchUsage(ctx, request.ContainerID)
+			if err != nil {
+				return nil, err
+			}
+			properties.ScratchUsage = usage
+		} else if requestedProperty == prot.PtStorageUsage {
+			usage, err := b.hostState.GetStorageUsage(ctx, request.ContainerID, query.StorageUsage)
+			if err != nil {
+				return nil, err
+			}
+			properties.StorageUsage = usage
 		}
 	}
 
+	return marshalPropertiesV2(properties)
+}
+
+func marshalPropertiesV2(properties *prot.PropertiesV2) (RequestResponse, error) {
 	propertyJSON := []byte("{}")
 	if properties != nil {
 		var err error
@@ -474,14 +508,17 @@ func (b *Bridge) modifySettingsV2(r *Request) (_ RequestResponse, err error) {
 
 	request, err := prot.UnmarshalContainerModifySettings(r.Message)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+		// The message is not included, it can hold encryption keys.
+		return nil, errors.Wrap(err, "failed to unmarshal JSON in modify settings message")
 	}
 
-	err = b.hostState.ModifySettings(ctx, request.ContainerID, request.Request.(*prot.ModifySettingRequest))
+	response, err := b.hostState.ModifySettings(ctx, request.ContainerID, request.Request.(*prot.ModifySettingRequest))
 	if err != nil {
 		return nil, err
 	}
-
+	if response != nil {
+		return response, nil
+	}
 	return &prot.MessageResponseBase{}, nil
 }
 
@@ -521,3 +558,36 @@ func (b *Bridge) deleteContainerStateV2(r *Request) (_ RequestResponse, err erro
 	b.hostState.RemoveContainer(request.ContainerID)
 	return &prot.MessageResponseBase{}, nil
 }
+
+// portForwardV2 opens a single port forwarding stream between a host vsock
+// port and a TCP port in the network namespace of the sandbox or standalone
+// container. The response is sent once both ends are connected; the stream
+// itself runs until either side closes or the container is deleted.
+//
+// This is allowed only for protocol version 4+, schema version 2.1+
+func (b *Bridge) portForwardV2(r *Request) (_ RequestResponse, err error) {
+	ctx, span := trace.StartSpan(r.Context, "opengcs::bridge::portForwardV2")
+	defer span.End()
+	defer func() { oc.SetSpanStatus(span, err) }()
+	span.AddAttributes(trace.StringAttribute("cid", r.ContainerID))
+
+	var request prot.ContainerPortForward
+	if err := commonutils.UnmarshalJSONWithHresult(r.Message, &request); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal JSON in message \"%s\"", r.Message)
+	}
+
+	span.AddAttributes(
+		trace.Int64Attribute("port", int64(request.Port)),
+		trace.Int64Attribute("vsockPort", int64(request.VsockPort)))
+
+	c, err := b.hostState.GetContainer(request.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.PortForward(ctx, request.Port, request.VsockPort); err != nil {
+		return nil, err
+	}
+
+	return &prot.MessageResponseBase{}, nil
+}
@@ -17,6 +17,14 @@ const (
 	HrFail = Hresult(-2147467259) // 0x80004005
 	// HrErrNotFound is the HRESULT for an invalid process id.
 	HrErrNotFound = Hresult(-2147023728) // 0x80070490
+	// HrInvalidArg is the HRESULT for one or more arguments that are not
+	// valid.
+	HrInvalidArg = Hresult(-2147024809) // 0x80070057
+	// HrErrBusy is the HRESULT for a resource that is in use.
+	HrErrBusy = Hresult(-2147024726) // 0x800700AA
+	// HrErrDiskCorrupt is the HRESULT for a disk whose filesystem is corrupt
+	// and cannot be repaired.
+	HrErrDiskCorrupt = Hresult(-2147023503) // 0x80070571
 	// HvVmcomputeTimeout is the HRESULT for operations that timed out.
 	HvVmcomputeTimeout = Hresult(-1070137079) // 0xC0370109
 	// HrVmcomputeInvalidJSON is the HRESULT for failing to unmarshal a json
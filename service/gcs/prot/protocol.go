@@ -104,6 +104,8 @@ const (
 	ComputeSystemDumpStacksV1 = 0x10100c01
 	// ComputeSystemDeleteContainerStateV1 is the delete container request.
 	ComputeSystemDeleteContainerStateV1 = 0x10100d01
+	// ComputeSystemPortForwardV1 is the port forward request.
+	ComputeSystemPortForwardV1 = 0x10100e01
 
 	// ComputeSystemResponseCreateV1 is the create container response.
 	ComputeSystemResponseCreateV1 = 0x20100101
@@ -134,6 +136,8 @@ const (
 	ComputeSystemResponseNegotiateProtocolV1 = 0x20100b01
 	// ComputeSystemResponseDumpStacksV1 is the dump stack response
 	ComputeSystemResponseDumpStacksV1 = 0x20100c01
+	// ComputeSystemResponsePortForwardV1 is the port forward response.
+	ComputeSystemResponsePortForwardV1 = 0x20100e01
 
 	// ComputeSystemNotificationV1 is the notification identifier.
 	ComputeSystemNotificationV1 = 0x30100101
@@ -170,6 +174,8 @@ func (mi MessageIdentifier) String() string {
 		return "ComputeSystemDumpStacksV1"
 	case ComputeSystemDeleteContainerStateV1:
 		return "ComputeSystemDeleteContainerStateV1"
+	case ComputeSystemPortForwardV1:
+		return "ComputeSystemPortForwardV1"
 	case ComputeSystemResponseCreateV1:
 		return "ComputeSystemResponseCreateV1"
 	case ComputeSystemResponseStartV1:
@@ -194,6 +200,8 @@ func (mi MessageIdentifier) String() string {
 		return "ComputeSystemResponseNegotiateProtocolV1"
 	case ComputeSystemResponseDumpStacksV1:
 		return "ComputeSystemResponseDumpStacksV1"
+	case ComputeSystemResponsePortForwardV1:
+		return "ComputeSystemResponsePortForwardV1"
 	case ComputeSystemNotificationV1:
 		return "ComputeSystemNotificationV1"
 	default:
@@ -271,6 +279,12 @@ type GcsGuestCapabilities struct {
 	SignalProcessSupported        bool `json:",omitempty"`
 	DumpStacksSupported           bool `json:",omitempty"`
 	DeleteContainerStateSupported bool `json:",omitempty"`
+	PortForwardSupported          bool `json:",omitempty"`
+	// SupportedOverlayOptions are the names of the CombinedLayersV2 overlay
+	// options supported by the guest kernel.
+	SupportedOverlayOptions []string `json:",omitempty"`
+	// VirtioFSSupported is true if MappedDirectoryV2 may use MdtVirtioFS.
+	VirtioFSSupported bool `json:",omitempty"`
 }
 
 // ocspancontext is the internal JSON representation of the OpenCensus
@@ -440,6 +454,17 @@ type ContainerSignalProcess struct {
 	Options   SignalProcessOptions `json:",omitempty"`
 }
 
+// ContainerPortForward is the message from the HCS specifying to forward a
+// single stream between a host vsock port and a TCP port in the network
+// namespace of the container. Each stream is opened by its own request.
+type ContainerPortForward struct {
+	MessageBase
+	// Port is the TCP port on `127.0.0.1` in the container network namespace.
+	Port uint16
+	// VsockPort is the host vsock port the GCS dials for this stream.
+	VsockPort uint32
+}
+
 // ContainerGetProperties is the message from the HCS requesting certain
 // properties of the container, such as a list of its processes.
 type ContainerGetProperties struct {
@@ -476,6 +501,14 @@ const (
 	PtMappedPipe = PropertyType("MappedPipe")
 	// PtMappedVirtualDisk is the property type for mapped virtual disks
 	PtMappedVirtualDisk = PropertyType("MappedVirtualDisk")
+	// PtMounts is the property type for the storage mounted in the UVM
+	PtMounts = PropertyType("Mounts")
+	// PtScratchUsage is the property type for the usage of a size limited
+	// container scratch
+	PtScratchUsage = PropertyType("ScratchUsage")
+	// PtStorageUsage is the property type for the usage of the storage
+	// mounted for the UVM or a container
+	PtStorageUsage = PropertyType("StorageUsage")
 )
 
 // RequestType is the type of operation to perform on a given property type.
@@ -519,6 +552,9 @@ const (
 	MrtVPCIDevice = ModifyResourceType("VPCIDevice")
 	// MrtContainerConstraints is the modify resource type for updating container constraints
 	MrtContainerConstraints = ModifyResourceType("ContainerConstraints")
+	// MrtNetworkPolicy is the modify resource type for the `NetworkPolicyV2`
+	// firewall policy of a network namespace.
+	MrtNetworkPolicy = ModifyResourceType("NetworkPolicy")
 )
 
 // ModifyRequestType is the type of operation to perform on a given modify
@@ -618,6 +654,12 @@ func UnmarshalContainerModifySettings(b []byte) (*ContainerModifySettings, error
 			return &request, errors.Wrap(err, "failed to unmarshal settings as ContainerConstraintsV2")
 		}
 		msr.Settings = cc
+	case MrtNetworkPolicy:
+		np := &NetworkPolicyV2{}
+		if err := commonutils.UnmarshalJSONWithHresult(msrRawSettings, np); err != nil {
+			return &request, errors.Wrap(err, "failed to unmarshal settings as NetworkPolicyV2")
+		}
+		msr.Settings = np
 	default:
 		return &request, errors.Errorf("invalid ResourceType '%s'", msr.ResourceType)
 	}
@@ -652,6 +694,35 @@ func (mrp *MessageResponseBase) Base() *MessageResponseBase {
 	return mrp
 }
 
+// ModifySettingResponse is the response to a modify settings request. Only
+// requests with a result set their field.
+type ModifySettingResponse struct {
+	MessageResponseBase
+	// DiskSize is the size of a MrtMappedVirtualDisk after a MreqtUpdate.
+	DiskSize *DiskSizeV2 `json:",omitempty"`
+	// FilesystemCheck is the result of checking the filesystem of a
+	// MrtMappedVirtualDisk add with CheckFilesystem set.
+	FilesystemCheck *FilesystemCheckV2 `json:",omitempty"`
+}
+
+// DiskSizeV2 is the size of a resized MappedVirtualDiskV2.
+type DiskSizeV2 struct {
+	DeviceSizeInBytes uint64
+	// FilesystemSizeInBytes is the size of the filesystem from the block count
+	// of its superblock, including its metadata. It is not the usable capacity.
+	FilesystemSizeInBytes uint64
+}
+
+// FilesystemCheckV2 is the result of checking the filesystem of a
+// MappedVirtualDiskV2 before it is mounted.
+type FilesystemCheckV2 struct {
+	// Repaired is true if errors were found and corrected, including a
+	// replayed journal.
+	Repaired bool
+	// Output is the output of the check.
+	Output string `json:",omitempty"`
+}
+
 // NegotiateProtocolResponse is the message to the HCS responding to a
 // NegotiateProtocol message. It specifies the prefered protocol version and
 // available capabilities of the GCS.
@@ -713,6 +784,29 @@ type CombinedLayersV2 struct {
 	Layers            []Layer `json:",omitempty"`
 	ScratchPath       string  `json:",omitempty"`
 	ContainerRootPath string
+	// ScratchSizeInBytes limits the size of the writable layer in
+	// ScratchPath if non-zero.
+	ScratchSizeInBytes uint64 `json:",omitempty"`
+	// TmpfsScratchSizeInBytes requests a writable layer on a tmpfs of at most
+	// this size if non-zero. Only valid when ScratchPath is empty.
+	TmpfsScratchSizeInBytes uint64 `json:",omitempty"`
+	// OverlayOptions are the optional overlay features of the mount. Only
+	// features in GcsGuestCapabilities.SupportedOverlayOptions may be used.
+	OverlayOptions *OverlayOptionsV2 `json:",omitempty"`
+}
+
+// OverlayOptionsV2 are the optional features of a CombinedLayersV2 overlay
+// mount. Empty values leave the kernel defaults in place.
+type OverlayOptionsV2 struct {
+	// Index is "on" or "off".
+	Index string `json:",omitempty"`
+	// Metacopy is "on" or "off".
+	Metacopy string `json:",omitempty"`
+	// RedirectDir is "on", "follow", "nofollow" or "off".
+	RedirectDir string `json:",omitempty"`
+	// Volatile skips syncs of the writable layer. Requires a ScratchPath or
+	// TmpfsScratchSizeInBytes.
+	Volatile bool `json:",omitempty"`
 }
 
 // NetworkAdapter represents a network interface and its associated
@@ -744,6 +838,25 @@ type NetworkAdapterV2 struct {
 	DNSServerList   string `json:",omitempty"`
 	EnableLowMetric bool   `json:",omitempty"`
 	EncapOverhead   uint16 `json:",omitempty"`
+	// IngressBandwidth and EgressBandwidth are the optional maximum rates in
+	// bits per second of the traffic received and sent by the adapter. The
+	// bursts are in bits; `0` selects a default based on the rate.
+	IngressBandwidth uint64 `json:",omitempty"`
+	IngressBurst     uint64 `json:",omitempty"`
+	EgressBandwidth  uint64 `json:",omitempty"`
+	EgressBurst      uint64 `json:",omitempty"`
+	// Routes are static routes through the adapter in addition to the default
+	// route via GatewayAddress.
+	Routes []RouteV2 `json:",omitempty"`
+}
+
+// RouteV2 is a static route through a network adapter. DestinationPrefix is
+// a CIDR and NextHop the gateway address, or empty for an on-link
+// destination.
+type RouteV2 struct {
+	DestinationPrefix string
+	NextHop           string `json:",omitempty"`
+	Metric            uint32 `json:",omitempty"`
 }
 
 // MappedVirtualDisk represents a disk on the host which is mapped into a
@@ -764,6 +877,52 @@ type MappedVirtualDiskV2 struct {
 	Controller uint8    `json:",omitempty"`
 	ReadOnly   bool     `json:",omitempty"`
 	Options    []string `json:",omitempty"`
+	// Filesystem is the type of the filesystem on the disk. If empty it is
+	// detected from the superblock.
+	Filesystem string `json:",omitempty"`
+	// Encryption encrypts the disk with dm-crypt in the guest if non-nil.
+	Encryption *DeviceEncryptionInfo `json:",omitempty"`
+	// VerityInfo protects the integrity of a read-only disk with dm-verity
+	// if non-nil.
+	VerityInfo *DeviceVerityInfo `json:",omitempty"`
+	// FormatIfBlank formats the disk as Filesystem, or ext4 if empty, before
+	// it is mounted if the disk is blank. Requires a writable mount.
+	FormatIfBlank bool `json:",omitempty"`
+	// BusyPolicy is what a remove does when MountPath is busy. Defaults to
+	// BpFail.
+	BusyPolicy BusyPolicy `json:",omitempty"`
+	// CheckFilesystem replays the journal of the filesystem and repairs any
+	// errors before the disk is mounted. Requires a writable mount. A
+	// filesystem that cannot be repaired fails the add with
+	// HrErrDiskCorrupt.
+	CheckFilesystem bool `json:",omitempty"`
+}
+
+// Policies of a MappedVirtualDiskV2 remove when its mount is busy.
+const (
+	// BpFail fails the remove and returns the processes using the mount.
+	BpFail = BusyPolicy("Fail")
+	// BpKill kills the processes using the mount and retries the unmount.
+	BpKill = BusyPolicy("Kill")
+	// BpDetach lazily detaches the mount. The processes using it get I/O
+	// errors once the disk is unplugged.
+	BpDetach = BusyPolicy("Detach")
+)
+
+// BusyPolicy is what the remove of a MappedVirtualDiskV2 does when its mount
+// is busy.
+type BusyPolicy string
+
+// DeviceEncryptionInfo represents the dm-crypt encryption of a disk. A disk
+// that is blank is formatted after the encrypted device is created.
+type DeviceEncryptionInfo struct {
+	// Cipher is the dm-crypt cipher specification. Defaults to
+	// `aes-xts-plain64` if empty.
+	Cipher string `json:",omitempty"`
+	// Key is the hex encoded key. If empty an ephemeral key is generated in
+	// the guest, the disk is always formatted and its contents are lost when
+	// it is removed.
+	Key string `json:",omitempty"`
 }
 
 // MappedDirectory represents a directory on the host which is mapped to a
@@ -775,13 +934,53 @@ type MappedDirectory struct {
 	Port              uint32 `json:",omitempty"`
 }
 
+// Transports of a MappedDirectoryV2.
+const (
+	MdtPlan9    = MappedDirectoryTransport("Plan9")
+	MdtVirtioFS = MappedDirectoryTransport("VirtioFS")
+)
+
+// MappedDirectoryTransport is the transport a MappedDirectoryV2 is shared
+// with. An empty transport is Plan9.
+type MappedDirectoryTransport string
+
 // MappedDirectoryV2 represents a directory on the host which is mapped to a
-// directory on the guest through Plan9 in the V2 schema.
+// directory on the guest through Plan9 or virtio-fs in the V2 schema.
 type MappedDirectoryV2 struct {
-	MountPath string `json:",omitempty"`
-	Port      uint32 `json:",omitempty"`
-	ShareName string `json:",omitempty"`
-	ReadOnly  bool   `json:",omitempty"`
+	MountPath string                   `json:",omitempty"`
+	Port      uint32                   `json:",omitempty"`
+	ShareName string                   `json:",omitempty"`
+	ReadOnly  bool                     `json:",omitempty"`
+	Transport MappedDirectoryTransport `json:",omitempty"`
+	// VirtioFS is required when Transport is MdtVirtioFS.
+	VirtioFS *VirtioFSOptionsV2 `json:",omitempty"`
+	// Plan9 optionally tunes the mount when Transport is MdtPlan9.
+	Plan9 *Plan9OptionsV2 `json:",omitempty"`
+}
+
+// Plan9OptionsV2 are the tunable parameters of a Plan9 MappedDirectoryV2.
+// Zero values use the defaults.
+type Plan9OptionsV2 struct {
+	// Msize is the maximum 9p message size in bytes.
+	Msize uint32 `json:",omitempty"`
+	// Cache is the cache mode: "none", "loose", "fscache" or "mmap".
+	Cache string `json:",omitempty"`
+	// Access is the access mode: "user", "any", "client" or a uid.
+	Access string `json:",omitempty"`
+	// DefaultUID and DefaultGID own files whose owner the host does not
+	// report.
+	DefaultUID *uint32 `json:",omitempty"`
+	DefaultGID *uint32 `json:",omitempty"`
+}
+
+// VirtioFSOptionsV2 are the settings of a virtio-fs MappedDirectoryV2. The
+// cache mode of the share is set by the host's virtio-fs daemon.
+type VirtioFSOptionsV2 struct {
+	// Tag is the tag of the virtio-fs device.
+	Tag string
+	// DAX is the DAX mode of the mount: "always", "never" or "inode". Empty
+	// uses the kernel default.
+	DAX string `json:",omitempty"`
 }
 
 // DeviceMappingInfo represents a mapped device on a given VPMem
@@ -801,6 +1000,15 @@ type DeviceVerityInfo struct {
 	RootDigest      string
 	Salt            string
 	BlockSize       int
+	// ReadSuperBlock reads all the fields but RootDigest from the verity
+	// superblock appended to the ext4 data of the device, the other fields
+	// are ignored.
+	ReadSuperBlock bool `json:",omitempty"`
+	// RootDigestSignature is the base64 encoded PKCS#7 signature of
+	// RootDigest. If set the kernel verifies it against its trusted keys
+	// before the verity device is created, so the root digest does not have
+	// to come from a trusted host.
+	RootDigestSignature string `json:",omitempty"`
 }
 
 // MappedVPMemDeviceV2 represents a VPMem device that is mapped into a guest
@@ -808,6 +1016,9 @@ type DeviceVerityInfo struct {
 type MappedVPMemDeviceV2 struct {
 	DeviceNumber uint32 `json:",omitempty"`
 	MountPath    string `json:",omitempty"`
+	// Filesystem is the type of the filesystem on the device. If empty it is
+	// detected from the superblock.
+	Filesystem string `json:",omitempty"`
 	// MappingInfo is used when multiple devices are mapped onto a single VPMem device
 	MappingInfo *DeviceMappingInfo `json:",omitempty"`
 	VerityInfo  *DeviceVerityInfo  `json:",omitempty"`
@@ -815,6 +1026,55 @@ type MappedVPMemDeviceV2 struct {
 
 type MappedVPCIDeviceV2 struct {
 	VMBusGUID string `json:",omitempty"`
+	// Driver optionally binds the device to a driver, such as vfio-pci, on
+	// add instead of the driver the kernel picks.
+	Driver string `json:",omitempty"`
+}
+
+// NetworkPolicyAction is the action taken on traffic matched by a network
+// policy.
+type NetworkPolicyAction string
+
+const (
+	// NpaAllow accepts the matched traffic.
+	NpaAllow = NetworkPolicyAction("Allow")
+	// NpaDeny drops the matched traffic.
+	NpaDeny = NetworkPolicyAction("Deny")
+)
+
+// NetworkPolicyDirection is the direction of the traffic matched by a network
+// policy rule.
+type NetworkPolicyDirection string
+
+const (
+	// NpdIngress matches traffic received by the network namespace.
+	NpdIngress = NetworkPolicyDirection("Ingress")
+	// NpdEgress matches traffic sent by the network namespace.
+	NpdEgress = NetworkPolicyDirection("Egress")
+)
+
+// NetworkPolicyRuleV2 matches the traffic of a network namespace in one
+// direction. Addresses are the CIDRs of the remote end, Protocol is `TCP`,
+// `UDP` or empty for any and Ports are destination ports. Ports without a
+// Protocol match both TCP and UDP. Empty fields match all traffic.
+type NetworkPolicyRuleV2 struct {
+	Direction NetworkPolicyDirection
+	Action    NetworkPolicyAction
+	Addresses []string `json:",omitempty"`
+	Protocol  string   `json:",omitempty"`
+	Ports     []uint16 `json:",omitempty"`
+}
+
+// NetworkPolicyV2 is the firewall policy of a network namespace. Rules are
+// evaluated in order and the first match decides. Traffic that matches no rule
+// gets the default action of its direction, which is `Allow` when empty.
+// Loopback traffic, traffic of established connections and IPv6 neighbor
+// discovery is always allowed.
+type NetworkPolicyV2 struct {
+	NamespaceID          string                `json:",omitempty"`
+	DefaultIngressAction NetworkPolicyAction   `json:",omitempty"`
+	DefaultEgressAction  NetworkPolicyAction   `json:",omitempty"`
+	Rules                []NetworkPolicyRuleV2 `json:",omitempty"`
 }
 
 type ContainerConstraintsV2 struct {
@@ -920,6 +1180,16 @@ type ProcessDetails struct {
 // PropertyQuery is a query to specify which properties are requested.
 type PropertyQuery struct {
 	PropertyTypes []PropertyType `json:",omitempty"`
+	// StorageUsage are the options of a PtStorageUsage query.
+	StorageUsage *StorageUsageQueryV2 `json:",omitempty"`
+}
+
+// StorageUsageQueryV2 are the options of a PtStorageUsage query.
+type StorageUsageQueryV2 struct {
+	// WritableLayerDirectories also walks each top level directory of the
+	// writable layer of a container to report its usage. Walking a large
+	// writable layer is slow.
+	WritableLayerDirectories bool `json:",omitempty"`
 }
 
 // Properties represents the properties of a compute system.
@@ -930,4 +1200,64 @@ type Properties struct {
 type PropertiesV2 struct {
 	ProcessList []ProcessDetails `json:"ProcessList,omitempty"`
 	Metrics     *v1.Metrics      `json:"LCOWMetrics,omitempty"`
+	Mounts      []MountV2        `json:"Mounts,omitempty"`
+	// ScratchUsage is only set for containers with a size limited scratch.
+	ScratchUsage *ScratchUsageV2 `json:"ScratchUsage,omitempty"`
+	StorageUsage *StorageUsageV2 `json:"StorageUsage,omitempty"`
+}
+
+// ScratchUsageV2 represents the usage of a size limited container scratch.
+type ScratchUsageV2 struct {
+	LimitInBytes uint64
+	UsedInBytes  uint64
+}
+
+// StorageUsageV2 represents the usage of the storage mounted for the UVM or a
+// container.
+type StorageUsageV2 struct {
+	Filesystems []FilesystemUsageV2
+	// WritableLayer is the usage of each top level directory of the writable
+	// layer of a container. Only set if requested by the query.
+	WritableLayer []DirectoryUsageV2 `json:",omitempty"`
+}
+
+// FilesystemUsageV2 represents the usage of the filesystem of a mount.
+type FilesystemUsageV2 struct {
+	// Kind is the kind of the mount, a MountV2 kind, `WritableLayer` for the
+	// upper directory of the overlay of a container or `SandboxMounts` for
+	// the sandbox mounts of a pod.
+	Kind string
+	// Path is the path in the UVM of the mount.
+	Path string
+	// ContainerPath is the destination of the mount in the container. Only
+	// set for container mounts.
+	ContainerPath  string `json:",omitempty"`
+	TotalBytes     uint64
+	UsedBytes      uint64
+	AvailableBytes uint64
+	TotalInodes    uint64
+	UsedInodes     uint64
+	FreeInodes     uint64
+}
+
+// DirectoryUsageV2 represents the usage of a directory and everything under
+// it.
+type DirectoryUsageV2 struct {
+	// Path is the path of the directory in the container.
+	Path       string
+	UsedBytes  uint64
+	UsedInodes uint64
+}
+
+// MountV2 represents storage mounted in the UVM by a modify settings request.
+type MountV2 struct {
+	// Kind is the resource type of the mount, for example `SCSI` or `VPMem`.
+	Kind string
+	// Device identifies the mounted device within its kind.
+	Device string
+	// Target is the mount path in the UVM. Empty for SCSI disks that are
+	// attached without being mounted.
+	Target string `json:",omitempty"`
+	// RefCount is the number of adds of the mount not yet removed.
+	RefCount int
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Microsoft/opengcs/internal/storage"
+	"github.com/pkg/errors"
+)
+
+// runVerifyVerity reads the verity superblock of a layer image, computes the
+// root digest of its data and compares it to the expected digest if one is
+// given. The resulting verity information is written to stdout. A signature
+// of the root digest is not checked, it is only verified by the kernel of the
+// UVM when the verity device is created.
+func runVerifyVerity() error {
+	rootDigest := flag.String("roothash", "", "expected root digest of the image")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		return errors.New("usage: verifyverity [-roothash <digest>] <image>")
+	}
+	image := flag.Arg(0)
+
+	verityInfo, err := storage.ReadVeritySuperBlock(image)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if verityInfo.RootDigest, err = storage.VerityRootDigest(f, verityInfo); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(verityInfo, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	if *rootDigest != "" && *rootDigest != verityInfo.RootDigest {
+		return errors.Errorf("root digest %s does not match expected %s", verityInfo.RootDigest, *rootDigest)
+	}
+	return nil
+}
+
+func verifyVerityMain() {
+	if err := runVerifyVerity(); err != nil {
+		fmt.Fprintf(os.Stderr, "error in verifyverity: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}